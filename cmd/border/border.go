@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/erikh/border/pkg/api"
@@ -18,6 +19,7 @@ import (
 	"github.com/erikh/go-hashchain"
 	"github.com/ghodss/yaml"
 	"github.com/go-jose/go-jose/v3"
+	"github.com/miekg/dns"
 	"github.com/peterbourgon/ff/ffcli"
 	"golang.org/x/sys/unix"
 )
@@ -27,6 +29,8 @@ var (
 	serveFlagSet       = flag.NewFlagSet("border serve", flag.ExitOnError)
 	clientFlagSet      = flag.NewFlagSet("border client", flag.ExitOnError)
 	keyGenerateFlagSet = flag.NewFlagSet("border keygenerate", flag.ExitOnError)
+	exportZoneFlagSet  = flag.NewFlagSet("border client exportzone", flag.ExitOnError)
+	exportConfigured   = exportZoneFlagSet.Bool("configured", false, "export the zone as configured, without health checks applied")
 	configFile         = appFlagSet.String("c", "/etc/border/config.yaml", "configuration file path")
 	clientConfigFile   = appFlagSet.String("client", "/etc/border/client.yaml", "client configuration file path")
 )
@@ -73,6 +77,44 @@ func main() {
 						ShortHelp: "Force a reload of the configuration",
 						Exec:      clientReloadConfig,
 					},
+					{
+						Name:      "importzone",
+						Usage:     "border client importzone <zone> <file>",
+						ShortHelp: "Convert a zone file into border configuration, printed as YAML",
+						Exec:      clientImportZone,
+					},
+					{
+						Name:      "exportzone",
+						Usage:     "border client exportzone [-configured] <zone>",
+						ShortHelp: "Print a zone as it is served, in zone file format",
+						FlagSet:   exportZoneFlagSet,
+						Exec:      clientExportZone,
+					},
+					{
+						Name:      "acme-challenge",
+						Usage:     "border client acme-challenge --help",
+						ShortHelp: "Manage TXT records for ACME DNS-01 challenges",
+						Subcommands: []*ffcli.Command{
+							{
+								Name:      "set",
+								Usage:     "border client acme-challenge set <name> <token>",
+								ShortHelp: "Publish a challenge token for a name",
+								Exec:      clientACMEChallengeSet,
+							},
+							{
+								Name:      "clear",
+								Usage:     "border client acme-challenge clear <name> <token>",
+								ShortHelp: "Remove a challenge token for a name",
+								Exec:      clientACMEChallengeClear,
+							},
+						},
+					},
+					{
+						Name:      "rrl",
+						Usage:     "border client rrl",
+						ShortHelp: "Print the response rate limiting counters of the peer",
+						Exec:      clientRRLCounters,
+					},
 					{
 						Name:      "identifypublisher",
 						Usage:     "border client identifypublisher",
@@ -88,6 +130,12 @@ func main() {
 				FlagSet:   keyGenerateFlagSet,
 				Exec:      keyGenerate,
 			},
+			{
+				Name:      "ds",
+				Usage:     "border ds <zone>",
+				ShortHelp: "Print the DS record of a zone signed with DNSSEC, for its parent zone",
+				Exec:      printDS,
+			},
 		},
 	}
 
@@ -262,6 +310,80 @@ func clientUpdateConfig(args []string) error {
 	return nil
 }
 
+func clientImportZone(args []string) error {
+	if len(args) != 2 {
+		return errors.New("Please provide a zone name and a zone file to import")
+	}
+
+	f, err := os.Open(args[1])
+	if err != nil {
+		return fmt.Errorf("Could not open zone file: %w", err)
+	}
+	defer f.Close()
+
+	zone, unsupported, err := config.ImportZone(args[0], f, args[1])
+	if err != nil {
+		return err
+	}
+
+	for _, rr := range unsupported {
+		fmt.Fprintf(os.Stderr, "Skipping record border cannot represent: %v\n", rr)
+	}
+
+	// nested under the zone name, so it can be pasted under `zones:`.
+	byt, err := yaml.Marshal(map[string]*config.Zone{strings.TrimSuffix(args[0], "."): zone})
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(string(byt))
+	return nil
+}
+
+func clientExportZone(args []string) error {
+	client, err := controlclient.Load(*clientConfigFile)
+	if err != nil {
+		return fmt.Errorf("Could not load client configuration at %q: %w", *clientConfigFile, err)
+	}
+
+	if len(args) != 1 {
+		return errors.New("Please provide a zone to export")
+	}
+
+	resp, err := client.Exchange(&api.ExportZoneRequest{Zone: args[0], Configured: *exportConfigured}, false)
+	if err != nil {
+		return fmt.Errorf("Error exporting zone: %w", err)
+	}
+
+	fmt.Print(resp.(*api.ExportZoneResponse).Zone)
+	return nil
+}
+
+func clientACMEChallengeSet(args []string) error {
+	return clientACMEChallenge(args, false)
+}
+
+func clientACMEChallengeClear(args []string) error {
+	return clientACMEChallenge(args, true)
+}
+
+func clientACMEChallenge(args []string, remove bool) error {
+	client, err := controlclient.Load(*clientConfigFile)
+	if err != nil {
+		return fmt.Errorf("Could not load client configuration at %q: %w", *clientConfigFile, err)
+	}
+
+	if len(args) != 2 {
+		return errors.New("Please provide a name and a challenge token")
+	}
+
+	if _, err := client.Exchange(&api.ACMEChallengeRequest{Name: args[0], Token: args[1], Clear: remove}, false); err != nil {
+		return fmt.Errorf("Error updating challenge: %w", err)
+	}
+
+	return nil
+}
+
 func clientIdentifyPublisher(args []string) error {
 	client, err := controlclient.Load(*clientConfigFile)
 	if err != nil {
@@ -277,6 +399,25 @@ func clientIdentifyPublisher(args []string) error {
 	return nil
 }
 
+func clientRRLCounters(args []string) error {
+	client, err := controlclient.Load(*clientConfigFile)
+	if err != nil {
+		return fmt.Errorf("Could not load client configuration at %q: %w", *clientConfigFile, err)
+	}
+
+	resp, err := client.Exchange(&api.RRLCountersRequest{}, false)
+	if err != nil {
+		return fmt.Errorf("Error fetching rate limiting counters: %w", err)
+	}
+
+	counters := resp.(*api.RRLCountersResponse)
+
+	fmt.Println("Responses:", counters.Responses)
+	fmt.Println("Dropped:", counters.Dropped)
+	fmt.Println("Slipped:", counters.Slipped)
+	return nil
+}
+
 func keyGenerate(args []string) error {
 	if len(args) != 1 {
 		return errors.New("Please provide a key id as an argument")
@@ -296,3 +437,30 @@ func keyGenerate(args []string) error {
 
 	return nil
 }
+
+func printDS(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Please provide a zone")
+	}
+
+	c := config.New(hashchain.New(nil))
+
+	c, err := c.FromDisk(*configFile, config.LoadYAML)
+	if err != nil {
+		return err
+	}
+
+	name := dns.Fqdn(args[0])
+
+	zone, ok := c.Zones[name]
+	if !ok {
+		return fmt.Errorf("Zone %q is not configured", args[0])
+	}
+
+	if !zone.DNSSEC.Ready() {
+		return fmt.Errorf("Zone %q is not signed, or its keys have not been generated yet", args[0])
+	}
+
+	fmt.Println(zone.DNSSEC.DS(name, zone.NS.TTL))
+	return nil
+}
@@ -89,3 +89,65 @@ func TestHealthCheck(t *testing.T) {
 		t.Fatal("Health check did not succeed after revive")
 	}
 }
+
+func TestTCPHealthCheck(t *testing.T) {
+	var successful atomic.Bool
+	successful.Store(true)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Close()
+		}
+	}()
+
+	check := &hc.HealthCheck{
+		Name:     "tcp test",
+		Type:     hc.TypeTCP,
+		Timeout:  100 * time.Millisecond,
+		Failures: 3,
+	}
+	check.SetTarget(addr)
+
+	hcr := hc.Init([]*hc.HealthCheckAction{
+		{
+			Check: check,
+			FailedAction: func(*hc.HealthCheck) error {
+				successful.Store(false)
+				return nil
+			},
+			ReviveAction: func(*hc.HealthCheck) error {
+				successful.Store(true)
+				return nil
+			},
+		},
+	}, 100*time.Millisecond)
+
+	t.Cleanup(hcr.Shutdown)
+
+	go hcr.Start()
+
+	time.Sleep(time.Second)
+
+	if !successful.Load() {
+		t.Fatal("Health check did not succeed")
+	}
+
+	l.Close()
+	time.Sleep(time.Second)
+
+	if successful.Load() {
+		t.Fatal("Health check did not fail")
+	}
+}
@@ -13,6 +13,9 @@ const (
 	PathConfigUpdate      = "configUpdate"
 	PathConfigReload      = "configReload"
 	PathIdentifyPublisher = "identifyPublisher"
+	PathExportZone        = "exportZone"
+	PathACMEChallenge     = "acmeChallenge"
+	PathRRLCounters       = "rrlCounters"
 )
 
 type NonceRequest struct{}
@@ -223,3 +226,146 @@ func (ipr *IdentifyPublisherResponse) Marshal() ([]byte, error) {
 func (ipr *IdentifyPublisherResponse) Unmarshal(byt []byte) error {
 	return json.Unmarshal(byt, ipr)
 }
+
+type ExportZoneRequest struct {
+	NonceValue []byte `json:"nonce"`
+	Zone       string `json:"zone"`
+	// Configured exports the zone as configured, instead of as served, which
+	// has failed health checks pruned from it.
+	Configured bool `json:"configured"`
+}
+
+func (*ExportZoneRequest) New() Request {
+	return &ExportZoneRequest{}
+}
+
+func (*ExportZoneRequest) Response() Message {
+	return &ExportZoneResponse{}
+}
+
+func (*ExportZoneRequest) Endpoint() string {
+	return PathExportZone
+}
+
+func (ezr *ExportZoneRequest) Unmarshal(byt []byte) error {
+	return json.Unmarshal(byt, ezr)
+}
+
+func (ezr *ExportZoneRequest) Nonce() string {
+	return string(ezr.NonceValue)
+}
+
+func (ezr *ExportZoneRequest) SetNonce(nonce []byte) error {
+	ezr.NonceValue = nonce
+	return nil
+}
+
+func (ezr *ExportZoneRequest) Marshal() ([]byte, error) {
+	return json.Marshal(ezr)
+}
+
+type ExportZoneResponse struct {
+	// Zone is the zone in the master file format of RFC 1035.
+	Zone string `json:"zone"`
+}
+
+func (ezr *ExportZoneResponse) Marshal() ([]byte, error) {
+	return json.Marshal(ezr)
+}
+
+func (ezr *ExportZoneResponse) Unmarshal(byt []byte) error {
+	return json.Unmarshal(byt, ezr)
+}
+
+// ACMEChallengeRequest publishes or removes the TXT record an ACME server
+// looks for when validating control of a name with the DNS-01 challenge.
+type ACMEChallengeRequest struct {
+	NonceValue []byte `json:"nonce"`
+	// Name is the name being validated; "_acme-challenge." is prepended to it
+	// if it is not already there.
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// Clear removes the token instead of publishing it.
+	Clear bool `json:"clear"`
+}
+
+func (*ACMEChallengeRequest) New() Request {
+	return &ACMEChallengeRequest{}
+}
+
+func (*ACMEChallengeRequest) Response() Message {
+	return &NilResponse{}
+}
+
+func (*ACMEChallengeRequest) Endpoint() string {
+	return PathACMEChallenge
+}
+
+func (acr *ACMEChallengeRequest) Unmarshal(byt []byte) error {
+	return json.Unmarshal(byt, acr)
+}
+
+func (acr *ACMEChallengeRequest) Nonce() string {
+	return string(acr.NonceValue)
+}
+
+func (acr *ACMEChallengeRequest) SetNonce(nonce []byte) error {
+	acr.NonceValue = nonce
+	return nil
+}
+
+func (acr *ACMEChallengeRequest) Marshal() ([]byte, error) {
+	return json.Marshal(acr)
+}
+
+// RRLCountersRequest asks what response rate limiting has done since the
+// server started, across configuration reloads.
+type RRLCountersRequest struct {
+	NonceValue []byte `json:"nonce"`
+}
+
+func (*RRLCountersRequest) New() Request {
+	return &RRLCountersRequest{}
+}
+
+func (*RRLCountersRequest) Response() Message {
+	return &RRLCountersResponse{}
+}
+
+func (*RRLCountersRequest) Endpoint() string {
+	return PathRRLCounters
+}
+
+func (rcr *RRLCountersRequest) Unmarshal(byt []byte) error {
+	return json.Unmarshal(byt, rcr)
+}
+
+func (rcr *RRLCountersRequest) Nonce() string {
+	return string(rcr.NonceValue)
+}
+
+func (rcr *RRLCountersRequest) SetNonce(nonce []byte) error {
+	rcr.NonceValue = nonce
+	return nil
+}
+
+func (rcr *RRLCountersRequest) Marshal() ([]byte, error) {
+	return json.Marshal(rcr)
+}
+
+type RRLCountersResponse struct {
+	// Responses counts every response subject to rate limiting.
+	Responses uint64 `json:"responses"`
+	// Dropped counts responses that were not sent at all.
+	Dropped uint64 `json:"dropped"`
+	// Slipped counts responses that were sent truncated instead.
+	Slipped uint64 `json:"slipped"`
+}
+
+func (rcr *RRLCountersResponse) Marshal() ([]byte, error) {
+	return json.Marshal(rcr)
+}
+
+func (rcr *RRLCountersResponse) Unmarshal(byt []byte) error {
+	return json.Unmarshal(byt, rcr)
+}
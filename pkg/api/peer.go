@@ -13,6 +13,7 @@ const (
 	PathPing        = "ping"
 	PathConfigChain = "configChain"
 	PathConfigFetch = "configFetch"
+	PathZoneUpdate  = "zoneUpdate"
 )
 
 type PeerNonceRequest struct{}
@@ -215,3 +216,58 @@ func (cr *ConfigFetchResponse) Unmarshal(byt []byte) error {
 func (cr *ConfigFetchResponse) Marshal() ([]byte, error) {
 	return json.Marshal(cr)
 }
+
+// ZoneUpdateRequest carries a dynamic update received by a peer to the
+// publisher, which is the only one allowed to change the configuration.
+type ZoneUpdateRequest struct {
+	NonceValue []byte `json:"nonce"`
+	// Update is the DNS UPDATE message in wire format, stripped of its TSIG
+	// signature, which the peer has already checked.
+	Update []byte `json:"update"`
+}
+
+func (*ZoneUpdateRequest) New() Request {
+	return &ZoneUpdateRequest{}
+}
+
+func (*ZoneUpdateRequest) Response() Message {
+	return &ZoneUpdateResponse{}
+}
+
+func (*ZoneUpdateRequest) Endpoint() string {
+	return PathZoneUpdate
+}
+
+func (zur *ZoneUpdateRequest) Unmarshal(byt []byte) error {
+	return json.Unmarshal(byt, zur)
+}
+
+func (zur *ZoneUpdateRequest) Nonce() string {
+	return string(zur.NonceValue)
+}
+
+func (zur *ZoneUpdateRequest) SetNonce(nonce []byte) error {
+	zur.NonceValue = nonce
+	return nil
+}
+
+func (zur *ZoneUpdateRequest) Marshal() ([]byte, error) {
+	return json.Marshal(zur)
+}
+
+type ZoneUpdateResponse struct {
+	// Rcode is the DNS response code for the update.
+	Rcode int `json:"rcode"`
+	// Error says why the update failed, if it did.
+	Error string `json:"error,omitempty"`
+	// Serial is the serial of the zone after the update.
+	Serial uint32 `json:"serial,omitempty"`
+}
+
+func (zur *ZoneUpdateResponse) Marshal() ([]byte, error) {
+	return json.Marshal(zur)
+}
+
+func (zur *ZoneUpdateResponse) Unmarshal(byt []byte) error {
+	return json.Unmarshal(byt, zur)
+}
@@ -1,16 +1,21 @@
 package config
 
 import (
+	"bytes"
 	"crypto/sha512"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/erikh/border/pkg/dnsconfig"
 	"github.com/erikh/go-hashchain"
 	"github.com/go-jose/go-jose/v3"
+	"github.com/miekg/dns"
 )
 
 var (
@@ -34,6 +39,13 @@ type Config struct {
 	Listen         ListenConfig     `json:"listen"`
 	Peers          []*Peer          `json:"peers"`
 	Zones          map[string]*Zone `json:"zones"`
+	// RRL limits the rate of DNS responses to each client. Zones may override
+	// it with their own.
+	RRL *RRL `json:"rrl,omitempty"`
+	// Forward makes border a resolver for names outside of its zones.
+	Forward *Forward `json:"forward,omitempty"`
+	// Views give clients in some networks their own version of zones.
+	Views map[string]*View `json:"views,omitempty"`
 
 	chain  *hashchain.Chain
 	reload chan struct{}
@@ -42,6 +54,41 @@ type Config struct {
 type ListenConfig struct {
 	DNS     string `json:"dns"`
 	Control string `json:"control"`
+	// DoT is where to serve DNS-over-TLS, usually on port 853. It requires TLS
+	// to be set.
+	DoT string `json:"dot,omitempty"`
+	// DoH is where to serve DNS-over-HTTPS, usually on port 443. Queries are
+	// answered at /dns-query. It also requires TLS.
+	DoH string `json:"doh,omitempty"`
+	// TLS is the certificate used by the encrypted DNS listeners.
+	TLS *ListenTLS `json:"tls,omitempty"`
+}
+
+// ListenTLS holds a PEM encoded certificate (with any intermediates) and its
+// key.
+type ListenTLS struct {
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+}
+
+func (lt *ListenTLS) KeyPair() (tls.Certificate, error) {
+	return tls.X509KeyPair([]byte(lt.Certificate), []byte(lt.Key))
+}
+
+func (lc ListenConfig) validate() error {
+	if lc.DoT == "" && lc.DoH == "" {
+		return nil
+	}
+
+	if lc.TLS == nil {
+		return errors.New("Encrypted DNS listeners require a TLS certificate in listen.tls")
+	}
+
+	if _, err := lc.TLS.KeyPair(); err != nil {
+		return fmt.Errorf("Invalid TLS certificate in listen.tls: %w", err)
+	}
+
+	return nil
 }
 
 type Peer struct {
@@ -58,6 +105,296 @@ type Zone struct {
 	SOA     *dnsconfig.SOA `json:"soa"`
 	NS      *dnsconfig.NS  `json:"ns"`
 	Records []*Record      `json:"records"`
+	// Auto is only valid for reverse zones (in-addr.arpa and ip6.arpa). When
+	// set, PTR records are synthesized from the A, AAAA and LB records of the
+	// forward zones.
+	Auto bool `json:"auto,omitempty"`
+	// Transfer allows secondaries outside of border to transfer the zone with
+	// AXFR and IXFR. Peers do not need this; they sync through the control
+	// server.
+	Transfer *Transfer `json:"transfer,omitempty"`
+	// RRL overrides the response rate limiting of the configuration for this
+	// zone.
+	RRL *RRL `json:"rrl,omitempty"`
+	// Update allows clients to change the zone with RFC 2136 dynamic updates.
+	Update *Update `json:"update,omitempty"`
+	// DNSSEC signs the zone's answers.
+	DNSSEC *DNSSEC `json:"dnssec,omitempty"`
+	// ACMEChallenges are the deadlines of the DNS-01 challenge tokens added to
+	// the zone by dynamic updates. This is kept by the publisher.
+	ACMEChallenges []*ACMEChallenge `json:"acme_challenges,omitempty"`
+}
+
+// ACMEChallenge is a challenge token published in a TXT record, which is
+// removed once it expires, in case the ACME client never clears it.
+type ACMEChallenge struct {
+	Name    string    `json:"name"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Update controls who may send dynamic updates for a zone. Updates must be
+// signed with one of the TSIG keys.
+type Update struct {
+	// TSIG maps key names to their base64 encoded secrets.
+	TSIG map[string]string `json:"tsig"`
+}
+
+// RRL configures response rate limiting, after the one in BIND. Clients are
+// grouped by network, and each group may receive a number of identical
+// responses per second over UDP; the rest are dropped, except for every
+// Slip'th one, which is sent truncated so that real clients retry over TCP.
+type RRL struct {
+	ResponsesPerSecond uint `json:"responses_per_second"`
+	// Slip defaults to 2. 0 drops every response over the limit.
+	Slip *uint `json:"slip,omitempty"`
+	// Window is how many seconds of responses are accounted for; defaults to
+	// 15.
+	Window uint `json:"window,omitempty"`
+	// IPv4PrefixLength and IPv6PrefixLength size the networks clients are
+	// grouped in; 24 and 56 by default.
+	IPv4PrefixLength int `json:"ipv4_prefix_length,omitempty"`
+	IPv6PrefixLength int `json:"ipv6_prefix_length,omitempty"`
+}
+
+func (rrl *RRL) validate() error {
+	if rrl == nil {
+		return nil
+	}
+
+	if rrl.ResponsesPerSecond == 0 {
+		return errors.New("RRL requires responses_per_second")
+	}
+
+	if rrl.IPv4PrefixLength < 0 || rrl.IPv4PrefixLength > 32 {
+		return fmt.Errorf("RRL ipv4_prefix_length %d is out of range", rrl.IPv4PrefixLength)
+	}
+
+	if rrl.IPv6PrefixLength < 0 || rrl.IPv6PrefixLength > 128 {
+		return fmt.Errorf("RRL ipv6_prefix_length %d is out of range", rrl.IPv6PrefixLength)
+	}
+
+	return nil
+}
+
+// Forward configures forwarding of queries for names outside of our zones to
+// upstream resolvers, so that clients may use border as their only resolver.
+// Answers are cached for their TTL.
+type Forward struct {
+	// Upstreams are the default resolvers ("host" or "host:port").
+	Upstreams []string `json:"upstreams,omitempty"`
+	// Domains maps domain suffixes to the resolvers for names beneath them,
+	// overriding Upstreams. The longest suffix wins.
+	Domains map[string][]string `json:"domains,omitempty"`
+	// Allow is a list of IPs or networks in CIDR notation that may recurse.
+	// Nobody may if it is empty.
+	Allow []string `json:"allow"`
+	// CacheSize is the most answers kept in the cache; defaults to 10000.
+	CacheSize int `json:"cache_size,omitempty"`
+}
+
+func (f *Forward) validate() error {
+	if f == nil {
+		return nil
+	}
+
+	if len(f.Upstreams) == 0 && len(f.Domains) == 0 {
+		return errors.New("Forwarding requires upstreams or domains")
+	}
+
+	upstreams := append([]string{}, f.Upstreams...)
+
+	for domain, servers := range f.Domains {
+		if _, ok := dns.IsDomainName(domain); !ok {
+			return fmt.Errorf("Forwarding domain %q is not a domain name", domain)
+		}
+
+		if len(servers) == 0 {
+			return fmt.Errorf("Forwarding domain %q has no upstreams", domain)
+		}
+
+		upstreams = append(upstreams, servers...)
+	}
+
+	for _, upstream := range upstreams {
+		host := upstream
+		if h, _, err := net.SplitHostPort(upstream); err == nil {
+			host = h
+		}
+
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("Forwarding upstream %q is not an IP or IP:port", upstream)
+		}
+	}
+
+	if err := validateAllowList(f.Allow); err != nil {
+		return fmt.Errorf("Forwarding: %w", err)
+	}
+
+	if f.CacheSize < 0 {
+		return fmt.Errorf("Forwarding cache_size %d is negative", f.CacheSize)
+	}
+
+	return nil
+}
+
+// Allowed reports whether an address may recurse.
+func (f *Forward) Allowed(ip net.IP) bool {
+	return allowListed(f.Allow, ip)
+}
+
+// Transfer controls who may transfer a zone. A client is allowed if its
+// address is in Allow, or if it signs the request with one of the TSIG keys.
+type Transfer struct {
+	// Allow is a list of IPs or networks in CIDR notation.
+	Allow []string `json:"allow,omitempty"`
+	// TSIG maps key names to their base64 encoded secrets.
+	TSIG map[string]string `json:"tsig,omitempty"`
+	// Notify lists the secondaries ("host" or "host:port") to send NOTIFY
+	// messages to when the zone changes.
+	Notify []string `json:"notify,omitempty"`
+}
+
+// Allowed reports whether an address is in the allow-list.
+func (t *Transfer) Allowed(ip net.IP) bool {
+	return allowListed(t.Allow, ip)
+}
+
+// allowListed reports whether an address is in a list of IPs and networks.
+func allowListed(list []string, ip net.IP) bool {
+	for _, allow := range list {
+		if _, network, err := net.ParseCIDR(allow); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if net.ParseIP(allow).Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateAllowList(list []string) error {
+	for _, allow := range list {
+		if _, _, err := net.ParseCIDR(allow); err != nil && net.ParseIP(allow) == nil {
+			return fmt.Errorf("allow-list entry %q is not an IP or CIDR", allow)
+		}
+	}
+
+	return nil
+}
+
+// ChangedZones yields the names of the zones in newZones which are not in
+// oldZones, or differ from the zone of the same name there. Zones are
+// compared by their configuration, not by what they would serve.
+func ChangedZones(oldZones, newZones map[string]*Zone) []string {
+	changed := []string{}
+
+	for name, zone := range newZones {
+		oldZone, ok := oldZones[name]
+		if !ok {
+			changed = append(changed, name)
+			continue
+		}
+
+		oldContent, oldErr := json.Marshal(oldZone)
+		newContent, newErr := json.Marshal(zone)
+
+		if oldErr != nil || newErr != nil || !bytes.Equal(oldContent, newContent) {
+			changed = append(changed, name)
+		}
+	}
+
+	sort.Strings(changed)
+
+	return changed
+}
+
+// copy copies the zone and its records, which saving the configuration
+// modifies in place. The values of the records are shared.
+func (z *Zone) copy() *Zone {
+	soa := *z.SOA
+	ns := *z.NS
+
+	newZone := *z
+	newZone.SOA = &soa
+	newZone.NS = &ns
+	newZone.Records = []*Record{}
+
+	for _, rec := range z.Records {
+		copied := *rec
+		newZone.Records = append(newZone.Records, &copied)
+	}
+
+	if z.Transfer != nil {
+		transfer := *z.Transfer
+		newZone.Transfer = &transfer
+	}
+
+	if z.Update != nil {
+		update := *z.Update
+		newZone.Update = &update
+	}
+
+	newZone.ACMEChallenges = nil
+
+	for _, challenge := range z.ACMEChallenges {
+		copied := *challenge
+		newZone.ACMEChallenges = append(newZone.ACMEChallenges, &copied)
+	}
+
+	return &newZone
+}
+
+// Zone copies the zone as it is served, or returns nil if there is no such
+// zone.
+func (c *Config) Zone(name string) *Zone {
+	EditMutex.RLock()
+	defer EditMutex.RUnlock()
+
+	zone, ok := c.Zones[name]
+	if !ok {
+		return nil
+	}
+
+	return zone.copy()
+}
+
+// ConfiguredZones parses the zones from their literal values again, yielding
+// them as they were configured. The zones in the configuration are modified
+// as the service runs, e.g. by health checks pruning addresses.
+func (c *Config) ConfiguredZones() (map[string]*Zone, error) {
+	EditMutex.RLock()
+	zones := map[string]*Zone{}
+
+	for name, zone := range c.Zones {
+		newZone := zone.copy()
+		newZone.Records = []*Record{}
+
+		// the keys are parsed again, so they must not be shared with the zone
+		// being served.
+		if zone.DNSSEC != nil {
+			newZone.DNSSEC = zone.DNSSEC.copy()
+		}
+
+		for _, rec := range zone.Records {
+			newZone.Records = append(newZone.Records, &Record{Type: rec.Type, Name: rec.Name, LiteralValue: rec.LiteralValue})
+		}
+
+		zones[name] = newZone
+	}
+	EditMutex.RUnlock()
+
+	configured := &Config{Zones: zones}
+
+	if err := configured.convertLiterals(); err != nil {
+		return nil, err
+	}
+
+	configured.decorateZones()
+
+	return configured.Zones, nil
 }
 
 func New(chain *hashchain.Chain) *Config {
@@ -114,6 +451,9 @@ func (c *Config) CopyFrom(newConfig *Config) {
 	c.Listen = newConfig.Listen
 	c.Peers = newConfig.Peers
 	c.Zones = newConfig.Zones
+	c.RRL = newConfig.RRL
+	c.Forward = newConfig.Forward
+	c.Views = newConfig.Views
 }
 
 func (c *Config) FindPeer(name string) (*Peer, error) {
@@ -149,6 +489,12 @@ func (c *Config) SetPeers(peers []*Peer) {
 	c.Peers = peers
 }
 
+func (c *Config) SetZones(zones map[string]*Zone) {
+	EditMutex.Lock()
+	defer EditMutex.Unlock()
+	c.Zones = zones
+}
+
 func (c *Config) AddPeer(peer *Peer) {
 	EditMutex.Lock()
 	defer EditMutex.Unlock()
@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/erikh/border/pkg/dnsconfig"
 	"github.com/erikh/border/pkg/josekit"
 	"github.com/erikh/go-hashchain"
 )
@@ -128,3 +129,136 @@ func TestMarshal(t *testing.T) {
 		t.Fatal("loaded content did not equal saved")
 	}
 }
+
+func TestListenValidation(t *testing.T) {
+	table := map[string]struct {
+		listen ListenConfig
+		valid  bool
+	}{
+		"plain": {
+			listen: ListenConfig{DNS: ":53"},
+			valid:  true,
+		},
+		"dot without tls": {
+			listen: ListenConfig{DNS: ":53", DoT: ":853"},
+		},
+		"doh without tls": {
+			listen: ListenConfig{DNS: ":53", DoH: ":443"},
+		},
+		"dot with bad tls": {
+			listen: ListenConfig{DNS: ":53", DoT: ":853", TLS: &ListenTLS{Certificate: "nope", Key: "nope"}},
+		},
+	}
+
+	for name, test := range table {
+		err := test.listen.validate()
+		if test.valid && err != nil {
+			t.Fatalf("%q should be valid: %v", name, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%q should not be valid", name)
+		}
+	}
+}
+
+func TestRRLValidation(t *testing.T) {
+	table := map[string]struct {
+		rrl   *RRL
+		valid bool
+	}{
+		"unset": {
+			valid: true,
+		},
+		"rate": {
+			rrl:   &RRL{ResponsesPerSecond: 5},
+			valid: true,
+		},
+		"no rate": {
+			rrl: &RRL{Window: 5},
+		},
+		"v4 prefix": {
+			rrl: &RRL{ResponsesPerSecond: 5, IPv4PrefixLength: 33},
+		},
+		"v6 prefix": {
+			rrl: &RRL{ResponsesPerSecond: 5, IPv6PrefixLength: 129},
+		},
+	}
+
+	for name, test := range table {
+		err := test.rrl.validate()
+		if test.valid && err != nil {
+			t.Fatalf("%q should be valid: %v", name, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%q should not be valid", name)
+		}
+	}
+}
+
+func TestForwardValidation(t *testing.T) {
+	table := map[string]struct {
+		forward *Forward
+		valid   bool
+	}{
+		"unset": {
+			valid: true,
+		},
+		"upstreams": {
+			forward: &Forward{Upstreams: []string{"192.0.2.1", "[2001:db8::1]:5353"}, Allow: []string{"10.0.0.0/8", "::1"}},
+			valid:   true,
+		},
+		"domains": {
+			forward: &Forward{Domains: map[string][]string{"corp.example.com": {"192.0.2.1:53"}}},
+			valid:   true,
+		},
+		"no upstreams": {
+			forward: &Forward{Allow: []string{"10.0.0.0/8"}},
+		},
+		"hostname upstream": {
+			forward: &Forward{Upstreams: []string{"resolver.example.com"}},
+		},
+		"empty domain": {
+			forward: &Forward{Domains: map[string][]string{"corp.example.com": {}}},
+		},
+		"allow-list": {
+			forward: &Forward{Upstreams: []string{"192.0.2.1"}, Allow: []string{"everyone"}},
+		},
+		"cache size": {
+			forward: &Forward{Upstreams: []string{"192.0.2.1"}, CacheSize: -1},
+		},
+	}
+
+	for name, test := range table {
+		err := test.forward.validate()
+		if test.valid && err != nil {
+			t.Fatalf("%q should be valid: %v", name, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%q should not be valid", name)
+		}
+	}
+}
+
+func TestZoneCopy(t *testing.T) {
+	c := New(hashchain.New(nil))
+	c.Zones = map[string]*Zone{
+		"test.home.arpa.": {
+			SOA:     &dnsconfig.SOA{Domain: "test.home.arpa.", Admin: "administrator.test.home.arpa."},
+			NS:      &dnsconfig.NS{Servers: []string{"test.home.arpa."}},
+			Records: []*Record{{Type: dnsconfig.TypeA, Name: "foo.test.home.arpa."}},
+		},
+	}
+
+	if zone := c.Zone("other.home.arpa."); zone != nil {
+		t.Fatalf("Found a zone that is not configured: %v", zone)
+	}
+
+	zone := c.Zone("test.home.arpa.")
+	if zone == nil {
+		t.Fatal("Configured zone was not found")
+	}
+
+	// saving the configuration trims the names of the zones in place.
+	c.trimZones()
+
+	if zone.SOA.Domain != "test.home.arpa." || zone.Records[0].Name != "foo.test.home.arpa." {
+		t.Fatalf("Copy of the zone changed with the configuration: %v %v", zone.SOA, zone.Records[0])
+	}
+}
@@ -92,6 +92,18 @@ func (c *Config) postLoad(filename string, chain *hashchain.Chain, reload chan s
 		return errors.New("You must specify at least one peer")
 	}
 
+	if err := c.Listen.validate(); err != nil {
+		return err
+	}
+
+	if err := c.RRL.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Forward.validate(); err != nil {
+		return err
+	}
+
 	if err := c.convertLiterals(); err != nil {
 		return err
 	}
@@ -133,6 +145,35 @@ func (c *Config) Save() error {
 	return nil
 }
 
+// AddGeneration adds the configuration saved on disk to the chain, so peers
+// see it as a new generation to fetch from the publisher. Call it after Save.
+func (c *Config) AddGeneration() error {
+	FileMutex.RLock()
+	defer FileMutex.RUnlock()
+
+	f, err := os.Open(c.FilenamePrefix + ".json")
+	if err != nil {
+		return fmt.Errorf("Could not open saved configuration: %w", err)
+	}
+	defer f.Close()
+
+	EditMutex.Lock()
+	defer EditMutex.Unlock()
+
+	// others may be holding on to the old chain, so build a new one.
+	chain, err := hashchain.NewFromString(c.chain.AllSums())
+	if err != nil {
+		return err
+	}
+
+	if _, err := chain.Add(f, HashFunc()); err != nil {
+		return fmt.Errorf("Could not add configuration to chain: %w", err)
+	}
+
+	c.chain = chain
+	return nil
+}
+
 func (c *Config) SaveJSON(w io.Writer) error {
 	c.trimZones()
 
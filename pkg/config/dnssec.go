@@ -0,0 +1,268 @@
+package config
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultDNSSECAlgorithm signs zones which do not name an algorithm.
+const DefaultDNSSECAlgorithm = "ECDSAP256SHA256"
+
+// dnssecKeySizes are the algorithms zones may be signed with, and the size of
+// the keys generated for them.
+var dnssecKeySizes = map[uint8]int{
+	dns.RSASHA256:       2048,
+	dns.ECDSAP256SHA256: 256,
+	dns.ECDSAP384SHA384: 384,
+	dns.ED25519:         256,
+}
+
+// DNSSEC signs the answers of a zone as they are given, since health checks
+// change them as border runs. Missing keys are generated, and kept in the
+// configuration so that every peer signs with the same ones.
+type DNSSEC struct {
+	// Algorithm is the name of the signing algorithm, e.g. ECDSAP256SHA256 (the
+	// default) or ED25519.
+	Algorithm string `json:"algorithm,omitempty"`
+	// KSK signs the DNSKEY records, and is what the DS record in the parent
+	// zone refers to. ZSK signs everything else.
+	KSK *DNSSECKey `json:"ksk,omitempty"`
+	ZSK *DNSSECKey `json:"zsk,omitempty"`
+}
+
+// DNSSECKey is a key pair signing a zone.
+type DNSSECKey struct {
+	// PublicKey is the base64 encoded public key, as in DNSKEY records.
+	PublicKey string `json:"public_key"`
+	// PrivateKey is in the format of BIND's private key files.
+	PrivateKey string `json:"private_key"`
+
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// Ready reports whether the zone can be signed: it has DNSSEC configured, and
+// its keys.
+func (d *DNSSEC) Ready() bool {
+	return d != nil && d.KSK != nil && d.KSK.signer != nil && d.ZSK != nil && d.ZSK.signer != nil
+}
+
+// DNSKEYs yields the DNSKEY records of the zone.
+func (d *DNSSEC) DNSKEYs(apex string, ttl uint32) []dns.RR {
+	return []dns.RR{d.KSK.DNSKEY(apex, ttl), d.ZSK.DNSKEY(apex, ttl)}
+}
+
+// DS yields the record the parent zone must hold to delegate to the zone
+// securely.
+func (d *DNSSEC) DS(apex string, ttl uint32) *dns.DS {
+	ds := d.KSK.DNSKEY(apex, ttl).ToDS(dns.SHA256)
+	ds.Hdr.Ttl = ttl
+
+	return ds
+}
+
+// DNSKEY yields the public key as a record of the zone.
+func (k *DNSSECKey) DNSKEY(apex string, ttl uint32) *dns.DNSKEY {
+	dnskey := *k.dnskey
+	dnskey.Hdr.Name = apex
+	dnskey.Hdr.Ttl = ttl
+
+	return &dnskey
+}
+
+// Signer yields the private key.
+func (k *DNSSECKey) Signer() crypto.Signer {
+	return k.signer
+}
+
+// copy yields the configuration of the keys, without the parsed keys.
+func (d *DNSSEC) copy() *DNSSEC {
+	dnssec := &DNSSEC{Algorithm: d.Algorithm}
+
+	if d.KSK != nil {
+		dnssec.KSK = &DNSSECKey{PublicKey: d.KSK.PublicKey, PrivateKey: d.KSK.PrivateKey}
+	}
+
+	if d.ZSK != nil {
+		dnssec.ZSK = &DNSSECKey{PublicKey: d.ZSK.PublicKey, PrivateKey: d.ZSK.PrivateKey}
+	}
+
+	return dnssec
+}
+
+// algorithm yields the number of the configured algorithm.
+func (d *DNSSEC) algorithm() (uint8, error) {
+	name := d.Algorithm
+	if name == "" {
+		name = DefaultDNSSECAlgorithm
+	}
+
+	alg, ok := dns.StringToAlgorithm[name]
+	if _, supported := dnssecKeySizes[alg]; !ok || !supported {
+		return 0, fmt.Errorf("Unsupported algorithm %q", name)
+	}
+
+	return alg, nil
+}
+
+// parse reads the key pair, and checks that the halves belong together by
+// signing with one and verifying with the other.
+func (k *DNSSECKey) parse(alg uint8, flags uint16) error {
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: alg,
+		PublicKey: k.PublicKey,
+	}
+
+	priv, err := dnskey.NewPrivateKey(k.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("Could not parse private key: %w", err)
+	}
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return errors.New("Private key cannot sign")
+	}
+
+	dnskey.Hdr.Name = "."
+
+	rrset := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4zero}}
+
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET},
+		KeyTag:     dnskey.KeyTag(),
+		SignerName: ".",
+		Algorithm:  alg,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+
+	if err := sig.Sign(signer, rrset); err != nil {
+		return fmt.Errorf("Could not sign with private key: %w", err)
+	}
+
+	if err := sig.Verify(dnskey, rrset); err != nil {
+		return errors.New("Public key does not match the private key")
+	}
+
+	dnskey.Hdr.Name = ""
+
+	k.dnskey = dnskey
+	k.signer = signer
+
+	return nil
+}
+
+// generateDNSSECKey makes a new key pair for the algorithm.
+func generateDNSSECKey(alg uint8, flags uint16) (*DNSSECKey, error) {
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: alg,
+	}
+
+	priv, err := dnskey.Generate(dnssecKeySizes[alg])
+	if err != nil {
+		return nil, err
+	}
+
+	key := &DNSSECKey{PublicKey: dnskey.PublicKey, PrivateKey: dnskey.PrivateKeyString(priv)}
+
+	return key, key.parse(alg, flags)
+}
+
+// validateDNSSEC checks the algorithm of a zone, and parses its keys. Zones may
+// lack keys until they are generated. Signed zones cannot be transferred:
+// answers are signed as they are given, so secondaries would serve the zone
+// without signatures, which resolvers following its DS record reject.
+func validateDNSSEC(key string, z *Zone) error {
+	if z.DNSSEC == nil {
+		return nil
+	}
+
+	if z.Transfer != nil {
+		return fmt.Errorf("Zone %q is signed with DNSSEC, and cannot be transferred to secondaries", key)
+	}
+
+	alg, err := z.DNSSEC.algorithm()
+	if err != nil {
+		return fmt.Errorf("DNSSEC for zone %q: %w", key, err)
+	}
+
+	if z.DNSSEC.KSK != nil {
+		if err := z.DNSSEC.KSK.parse(alg, dns.ZONE|dns.SEP); err != nil {
+			return fmt.Errorf("KSK for zone %q: %w", key, err)
+		}
+	}
+
+	if z.DNSSEC.ZSK != nil {
+		if err := z.DNSSEC.ZSK.parse(alg, dns.ZONE); err != nil {
+			return fmt.Errorf("ZSK for zone %q: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// GenerateDNSSECKeys gives the zones signed with DNSSEC any keys they are
+// missing. Keys of the zone of the same name in previous are kept if they are
+// for the same algorithm, so that a configuration without them does not
+// invalidate the DS records already given to the parent zones. It reports
+// whether any keys were added.
+func (c *Config) GenerateDNSSECKeys(previous map[string]*Zone) (bool, error) {
+	var changed bool
+
+	for name, z := range c.Zones {
+		if z.DNSSEC == nil || (z.DNSSEC.KSK != nil && z.DNSSEC.ZSK != nil) {
+			continue
+		}
+
+		alg, err := z.DNSSEC.algorithm()
+		if err != nil {
+			return false, fmt.Errorf("DNSSEC for zone %q: %w", name, err)
+		}
+
+		old := &DNSSEC{}
+
+		for oldName, oldZone := range previous {
+			if dns.Fqdn(oldName) != dns.Fqdn(name) || !oldZone.DNSSEC.Ready() {
+				continue
+			}
+
+			if oldAlg, err := oldZone.DNSSEC.algorithm(); err == nil && oldAlg == alg {
+				old = oldZone.DNSSEC
+			}
+		}
+
+		if z.DNSSEC.KSK == nil {
+			z.DNSSEC.KSK = old.KSK
+			if z.DNSSEC.KSK == nil {
+				if z.DNSSEC.KSK, err = generateDNSSECKey(alg, dns.ZONE|dns.SEP); err != nil {
+					return false, fmt.Errorf("Could not generate KSK for zone %q: %w", name, err)
+				}
+			}
+		}
+
+		if z.DNSSEC.ZSK == nil {
+			z.DNSSEC.ZSK = old.ZSK
+			if z.DNSSEC.ZSK == nil {
+				if z.DNSSEC.ZSK, err = generateDNSSECKey(alg, dns.ZONE); err != nil {
+					return false, fmt.Errorf("Could not generate ZSK for zone %q: %w", name, err)
+				}
+			}
+		}
+
+		changed = true
+	}
+
+	return changed, nil
+}
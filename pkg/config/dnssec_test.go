@@ -0,0 +1,145 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/erikh/border/pkg/dnsconfig"
+)
+
+func makeDNSSECConfig(dnssec *DNSSEC) *Config {
+	return &Config{
+		Zones: map[string]*Zone{
+			"test.home.arpa": {
+				SOA:     &dnsconfig.SOA{Domain: "test.home.arpa", MinTTL: 60},
+				NS:      &dnsconfig.NS{Servers: []string{"test.home.arpa"}},
+				Records: []*Record{},
+				DNSSEC:  dnssec,
+			},
+		},
+	}
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	c := makeDNSSECConfig(&DNSSEC{})
+
+	if _, err := c.GenerateDNSSECKeys(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ksk := c.Zones["test.home.arpa"].DNSSEC.KSK
+	zsk := c.Zones["test.home.arpa"].DNSSEC.ZSK
+
+	table := map[string]struct {
+		dnssec *DNSSEC
+		valid  bool
+	}{
+		"keys": {
+			dnssec: &DNSSEC{KSK: &DNSSECKey{PublicKey: ksk.PublicKey, PrivateKey: ksk.PrivateKey}, ZSK: &DNSSECKey{PublicKey: zsk.PublicKey, PrivateKey: zsk.PrivateKey}},
+			valid:  true,
+		},
+		"no keys yet": {
+			dnssec: &DNSSEC{Algorithm: "ED25519"},
+			valid:  true,
+		},
+		"unknown algorithm": {
+			dnssec: &DNSSEC{Algorithm: "ROT13"},
+		},
+		"unsupported algorithm": {
+			dnssec: &DNSSEC{Algorithm: "RSASHA1"},
+		},
+		"keys for another algorithm": {
+			dnssec: &DNSSEC{Algorithm: "ED25519", KSK: &DNSSECKey{PublicKey: ksk.PublicKey, PrivateKey: ksk.PrivateKey}},
+		},
+		"mismatched keys": {
+			dnssec: &DNSSEC{KSK: &DNSSECKey{PublicKey: ksk.PublicKey, PrivateKey: zsk.PrivateKey}},
+		},
+		"bad private key": {
+			dnssec: &DNSSEC{ZSK: &DNSSECKey{PublicKey: zsk.PublicKey, PrivateKey: "garbage"}},
+		},
+	}
+
+	for name, test := range table {
+		err := makeDNSSECConfig(test.dnssec).convertLiterals()
+		if test.valid && err != nil {
+			t.Fatalf("%q should be valid: %v", name, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%q should not be valid", name)
+		}
+	}
+
+	// secondaries would serve the zone unsigned.
+	c = makeDNSSECConfig(&DNSSEC{})
+	c.Zones["test.home.arpa"].Transfer = &Transfer{Allow: []string{"127.0.0.1"}}
+
+	if err := c.convertLiterals(); err == nil {
+		t.Fatal("Transfer of a signed zone was allowed")
+	}
+}
+
+func TestGenerateDNSSECKeys(t *testing.T) {
+	c := makeDNSSECConfig(&DNSSEC{})
+
+	changed, err := c.GenerateDNSSECKeys(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dnssec := c.Zones["test.home.arpa"].DNSSEC
+	if !changed || !dnssec.Ready() {
+		t.Fatal("Keys were not generated")
+	}
+
+	if dnssec.KSK.PublicKey == dnssec.ZSK.PublicKey {
+		t.Fatal("KSK and ZSK are the same key")
+	}
+
+	if changed, err := c.GenerateDNSSECKeys(nil); err != nil || changed {
+		t.Fatalf("Keys were generated for a zone which had them: %v", err)
+	}
+
+	// a configuration without keys keeps those of the previous one, even when
+	// names are decorated differently.
+	previous := map[string]*Zone{"test.home.arpa.": c.Zones["test.home.arpa"]}
+
+	c = makeDNSSECConfig(&DNSSEC{})
+
+	if _, err := c.GenerateDNSSECKeys(previous); err != nil {
+		t.Fatal(err)
+	}
+
+	if kept := c.Zones["test.home.arpa"].DNSSEC; kept.KSK != dnssec.KSK || kept.ZSK != dnssec.ZSK {
+		t.Fatal("Keys of the previous configuration were not kept")
+	}
+
+	// unless the algorithm changed.
+	c = makeDNSSECConfig(&DNSSEC{Algorithm: "ECDSAP384SHA384"})
+
+	if _, err := c.GenerateDNSSECKeys(previous); err != nil {
+		t.Fatal(err)
+	}
+
+	if kept := c.Zones["test.home.arpa"].DNSSEC; kept.KSK == dnssec.KSK || !kept.Ready() {
+		t.Fatal("Keys of the previous configuration were kept for another algorithm")
+	}
+
+	// the generated keys survive a round trip through the configuration.
+	if err := c.convertLiterals(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.decorateZones()
+
+	zones, err := c.ConfiguredZones()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configured := zones["test.home.arpa."].DNSSEC
+	if !configured.Ready() || configured.KSK == c.Zones["test.home.arpa."].DNSSEC.KSK {
+		t.Fatal("Keys were not parsed into a copy of the configured zones")
+	}
+
+	if configured.DS("test.home.arpa.", 60).Digest != c.Zones["test.home.arpa."].DNSSEC.DS("test.home.arpa.", 60).Digest {
+		t.Fatal("Configured zones have different keys")
+	}
+}
@@ -0,0 +1,225 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+)
+
+var ErrImport = errors.New("while importing zone")
+
+// ImportZone reads a zone in the master file format of RFC 1035, as used by
+// BIND and friends, and converts it into a zone. The zone is returned in the
+// same shape as one freshly loaded from a configuration file: names have no
+// trailing dot, and the LiteralValue of each record is filled in, so it can be
+// marshaled into a configuration. Records border cannot represent are returned
+// separately, so they can be reported.
+func ImportZone(name string, r io.Reader, filename string) (*Zone, []dns.RR, error) {
+	apex := dns.CanonicalName(name)
+
+	zone := &Zone{Records: []*Record{}}
+	unsupported := []dns.RR{}
+
+	// records are grouped by name and type, in the order they first appear.
+	records := map[string]*Record{}
+	sets := map[*Record][]dns.RR{}
+
+	parser := dns.NewZoneParser(r, apex, filename)
+
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		hdr := rr.Header()
+		owner := dns.CanonicalName(hdr.Name)
+
+		if !dns.IsSubDomain(apex, owner) {
+			unsupported = append(unsupported, rr)
+			continue
+		}
+
+		if owner == apex {
+			switch rr := rr.(type) {
+			case *dns.SOA:
+				zone.SOA = &dnsconfig.SOA{
+					Domain:  trimDot(rr.Ns),
+					Admin:   trimDot(rr.Mbox),
+					MinTTL:  rr.Minttl,
+					Serial:  rr.Serial,
+					Refresh: rr.Refresh,
+					Retry:   rr.Retry,
+					Expire:  rr.Expire,
+				}
+
+				continue
+			case *dns.NS:
+				if zone.NS == nil {
+					zone.NS = &dnsconfig.NS{Servers: []string{}, TTL: hdr.Ttl}
+				}
+
+				zone.NS.Servers = append(zone.NS.Servers, trimDot(rr.Ns))
+				zone.NS.TTL = minTTL(zone.NS.TTL, hdr.Ttl)
+
+				continue
+			}
+		}
+
+		typ, _ := importValue(rr)
+		if typ == "" {
+			unsupported = append(unsupported, rr)
+			continue
+		}
+
+		key := owner + "/" + typ
+
+		rec, ok := records[key]
+		if !ok {
+			rec = &Record{Type: typ, Name: trimDot(owner)}
+			records[key] = rec
+			zone.Records = append(zone.Records, rec)
+		}
+
+		sets[rec] = append(sets[rec], rr)
+	}
+
+	if err := parser.Err(); err != nil {
+		return nil, nil, errors.Join(ErrImport, err)
+	}
+
+	if zone.SOA == nil {
+		return nil, nil, fmt.Errorf("%w: zone %q has no SOA record", ErrImport, trimDot(apex))
+	}
+
+	if zone.NS == nil {
+		return nil, nil, fmt.Errorf("%w: zone %q has no NS records", ErrImport, trimDot(apex))
+	}
+
+	for _, rec := range zone.Records {
+		rec.LiteralValue = literal(rec.Type, sets[rec], nil)
+	}
+
+	// parse the literals the same way a configuration would be, which also
+	// validates the result.
+	c := &Config{Zones: map[string]*Zone{trimDot(apex): zone}}
+	if err := c.convertLiterals(); err != nil {
+		return nil, nil, errors.Join(ErrImport, err)
+	}
+
+	return zone, unsupported, nil
+}
+
+func minTTL(a, b uint32) uint32 {
+	if b < a {
+		return b
+	}
+
+	return a
+}
+
+// literal builds the literal value of a record from a set of RRs, which must
+// all be of the type importValue gives them. A set shares one TTL in border, so
+// the smallest is taken. Fields of base that do not come from the RRs, such as
+// health checks, are kept.
+func literal(typ string, rrs []dns.RR, base map[string]any) map[string]any {
+	value := map[string]any{}
+
+	for field, item := range base {
+		value[field] = item
+	}
+
+	items := map[string][]any{}
+
+	for i, rr := range rrs {
+		if i == 0 {
+			value["ttl"] = rr.Header().Ttl
+		}
+
+		value["ttl"] = minTTL(value["ttl"].(uint32), rr.Header().Ttl)
+
+		_, fields := importValue(rr)
+		for field, item := range fields {
+			items[field] = append(items[field], item)
+		}
+
+		if typ == dnsconfig.TypeCNAME {
+			// there can be only one.
+			value["target"] = trimDot(rr.(*dns.CNAME).Target)
+		}
+	}
+
+	for field, item := range items {
+		value[field] = item
+	}
+
+	return value
+}
+
+// importValue converts a record into the type border knows it as, and the
+// items it adds to the literal value of that type. An empty type is returned
+// for records border cannot represent.
+func importValue(rr dns.RR) (string, map[string]any) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return dnsconfig.TypeA, map[string]any{"addresses": rr.A.String()}
+	case *dns.AAAA:
+		return dnsconfig.TypeAAAA, map[string]any{"addresses": rr.AAAA.String()}
+	case *dns.CNAME:
+		return dnsconfig.TypeCNAME, map[string]any{}
+	case *dns.MX:
+		return dnsconfig.TypeMX, map[string]any{"exchangers": map[string]any{
+			"preference": rr.Preference,
+			"exchange":   trimDot(rr.Mx),
+		}}
+	case *dns.TXT:
+		// border splits values into character-strings itself.
+		value := ""
+		for _, txt := range rr.Txt {
+			value += unescapeTXT(txt)
+		}
+
+		return dnsconfig.TypeTXT, map[string]any{"values": value}
+	case *dns.SRV:
+		return dnsconfig.TypeSRV, map[string]any{"targets": map[string]any{
+			"priority": rr.Priority,
+			"weight":   rr.Weight,
+			"port":     rr.Port,
+			"target":   trimDot(rr.Target),
+		}}
+	case *dns.CAA:
+		return dnsconfig.TypeCAA, map[string]any{"policies": map[string]any{
+			"flag":  rr.Flag,
+			"tag":   rr.Tag,
+			"value": rr.Value,
+		}}
+	}
+
+	return "", nil
+}
+
+// unescapeTXT undoes the escaping of the master file format (\X and \DDD),
+// which the zone parser leaves in place.
+func unescapeTXT(s string) string {
+	var out strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		if i+3 < len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+4], 10, 8); err == nil {
+				out.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+
+		out.WriteByte(s[i+1])
+		i++
+	}
+
+	return out.String()
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+)
+
+const testZoneFile = `
+$ORIGIN test.home.arpa.
+$TTL 300
+@	IN	SOA	ns1 administrator 2023040101 3600 600 86400 60
+	IN	NS	ns1
+	IN	NS	ns2.example.com.
+	IN	MX	10 mail
+	IN	MX	20 mail.example.com.
+	IN	TXT	"v=spf1 mx -all"
+	IN	CAA	0 issue "letsencrypt.org"
+ns1	IN	A	127.0.0.1
+	IN	AAAA	::1
+mail	60	IN	A	127.0.0.2
+mail	IN	A	127.0.0.3
+www	IN	CNAME	ns1
+long	IN	TXT	"first half;" "second\" half\059"
+_ldap._tcp	IN	SRV	0 100 389 ns1
+sub	IN	NS	ns1.elsewhere.com.
+1.0.0.127.in-addr.arpa.	IN	PTR	ns1
+`
+
+func TestImportZone(t *testing.T) {
+	zone, unsupported, err := ImportZone("test.home.arpa", strings.NewReader(testZoneFile), "test.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zone.SOA.Serial != 2023040101 || zone.SOA.Domain != "ns1.test.home.arpa" || zone.SOA.Admin != "administrator.test.home.arpa" || zone.SOA.MinTTL != 60 {
+		t.Fatalf("Unexpected SOA: %#v", zone.SOA)
+	}
+
+	if !reflect.DeepEqual(zone.NS.Servers, []string{"ns1.test.home.arpa", "ns2.example.com"}) || zone.NS.TTL != 300 {
+		t.Fatalf("Unexpected NS: %#v", zone.NS)
+	}
+
+	// the delegation, and the name outside of the zone
+	if len(unsupported) != 2 {
+		t.Fatalf("Unexpected unsupported records: %v", unsupported)
+	}
+
+	if _, ok := unsupported[0].(*dns.NS); !ok {
+		t.Fatalf("Delegation was not reported as unsupported: %v", unsupported[0])
+	}
+
+	values := map[string]dnsconfig.Record{}
+
+	for _, rec := range zone.Records {
+		values[rec.Name+"/"+rec.Type] = rec.Value
+	}
+
+	table := map[string]dnsconfig.Record{
+		"test.home.arpa/MX": &dnsconfig.MX{
+			Exchangers: []*dnsconfig.MXExchanger{
+				{Preference: 10, Exchange: "mail.test.home.arpa"},
+				{Preference: 20, Exchange: "mail.example.com"},
+			},
+			TTL: 300,
+		},
+		"test.home.arpa/TXT":      &dnsconfig.TXT{Values: []string{"v=spf1 mx -all"}, TTL: 300},
+		"test.home.arpa/CAA":      &dnsconfig.CAA{Policies: []*dnsconfig.CAAPolicy{{Tag: "issue", Value: "letsencrypt.org"}}, TTL: 300},
+		"ns1.test.home.arpa/A":    &dnsconfig.A{Addresses: []net.IP{net.ParseIP("127.0.0.1")}, TTL: 300},
+		"ns1.test.home.arpa/AAAA": &dnsconfig.AAAA{Addresses: []net.IP{net.ParseIP("::1")}, TTL: 300},
+		// TTLs of a set are collapsed into the smallest one.
+		"mail.test.home.arpa/A":    &dnsconfig.A{Addresses: []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")}, TTL: 60},
+		"www.test.home.arpa/CNAME": &dnsconfig.CNAME{Target: "ns1.test.home.arpa", TTL: 300},
+		"long.test.home.arpa/TXT":  &dnsconfig.TXT{Values: []string{`first half;second" half;`}, TTL: 300},
+		"_ldap._tcp.test.home.arpa/SRV": &dnsconfig.SRV{
+			Targets: []*dnsconfig.SRVTarget{{Priority: 0, Weight: 100, Port: 389, Target: "ns1.test.home.arpa"}},
+			TTL:     300,
+		},
+	}
+
+	if len(values) != len(table) {
+		t.Fatalf("Unexpected records: %v", values)
+	}
+
+	for key, expected := range table {
+		if !reflect.DeepEqual(values[key], expected) {
+			t.Fatalf("Unexpected value for %q: %#v (expected: %#v)", key, values[key], expected)
+		}
+	}
+}
+
+func TestImportZoneErrors(t *testing.T) {
+	table := map[string]string{
+		"no soa":    "$ORIGIN test.home.arpa.\n@ 60 IN NS ns1\n",
+		"no ns":     "$ORIGIN test.home.arpa.\n@ 60 IN SOA ns1 admin 1 60 60 60 60\n",
+		"bad cname": "$ORIGIN test.home.arpa.\n@ 60 IN SOA ns1 admin 1 60 60 60 60\n@ 60 IN NS ns1\nfoo 60 IN CNAME bar\nfoo 60 IN A 127.0.0.1\n",
+		"syntax":    "$ORIGIN test.home.arpa.\n@ 60 IN SOA ns1\n",
+	}
+
+	for name, file := range table {
+		if _, _, err := ImportZone("test.home.arpa", strings.NewReader(file), name); err == nil {
+			t.Fatalf("%q: zone should not have imported", name)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"reflect"
 	"strings"
@@ -165,7 +166,8 @@ func typeAssert(typ reflect.Type, literal any, value reflect.Value) error {
 			for i := 0; i < valueTyp.NumField(); i++ {
 				field := valueTyp.Field(i)
 				rec, ok = field.Tag.Lookup(RecordTag)
-				if ok && rec == strKey {
+				// strip options such as "optional" from the tag before comparing
+				if ok && strings.Split(rec, ",")[0] == strKey {
 					if value.Type().Kind() == reflect.Pointer {
 						valueField = value.Elem().Field(i)
 					} else {
@@ -175,12 +177,12 @@ func typeAssert(typ reflect.Type, literal any, value reflect.Value) error {
 				}
 			}
 
-			if !ok {
+			if !valueField.IsValid() {
 				return fmt.Errorf("Inner struct %T for %q field did not have record tag", literal, strKey)
 			}
 
 			if err := typeAssert(reflect.TypeOf(val.Interface()), val.Interface(), valueField); err != nil {
-				return err
+				return fmt.Errorf("In field %q: %w", strKey, err)
 			}
 		}
 	case reflect.Chan:
@@ -191,14 +193,42 @@ func typeAssert(typ reflect.Type, literal any, value reflect.Value) error {
 		return errors.New("Records with unsafe pointers are not supported. Change the type or fix the code.")
 	default:
 		if value.CanSet() {
+			// JSON (and YAML, which is converted to JSON on load) decodes all
+			// numbers as float64, so convert those to whatever the field needs.
+			if f, ok := literal.(float64); ok {
+				switch value.Kind() {
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					if f != math.Trunc(f) {
+						return fmt.Errorf("%v is not a whole number", f)
+					}
+
+					if f < math.MinInt64 || f >= math.MaxInt64 || value.OverflowInt(int64(f)) {
+						return fmt.Errorf("%v is out of range for %v", f, value.Type())
+					}
+
+					value.SetInt(int64(f))
+					return nil
+				case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+					if f != math.Trunc(f) {
+						return fmt.Errorf("%v is not a whole number", f)
+					}
+
+					if f < 0 {
+						return fmt.Errorf("%v is negative, and must not be", f)
+					}
+
+					if f >= math.MaxUint64 || value.OverflowUint(uint64(f)) {
+						return fmt.Errorf("%v is out of range for %v", f, value.Type())
+					}
+
+					value.SetUint(uint64(f))
+					return nil
+				}
+			}
+
 			switch value.Kind() {
 			case reflect.Int:
-				switch typ := literal.(type) {
-				case float64:
-					value.Set(reflect.ValueOf(int(typ)))
-				default:
-					value.Set(reflect.ValueOf(int(typ.(int))))
-				}
+				value.Set(reflect.ValueOf(literal.(int)))
 			case reflect.Int8:
 				value.Set(reflect.ValueOf(literal.(int8)))
 			case reflect.Int16:
@@ -137,3 +137,61 @@ func TestLiteral(t *testing.T) {
 		t.Fatalf("map was not set properly: %v", tr.Map)
 	}
 }
+
+type testNumberRecord struct {
+	Int    int              `record:"int,optional"`
+	Int8   int8             `record:"int8,optional"`
+	Uint   uint             `record:"uint,optional"`
+	Uint8  uint8            `record:"uint8,optional"`
+	Uint16 uint16           `record:"uint16,optional"`
+	Uint32 uint32           `record:"uint32,optional"`
+	Uint64 uint64           `record:"uint64,optional"`
+	Struct testStructRecord `record:"struct,optional"`
+}
+
+func (tr *testNumberRecord) Convert(name string) []dns.RR {
+	return []dns.RR{}
+}
+
+func TestLiteralNumbers(t *testing.T) {
+	// numbers arrive as float64 from JSON and YAML
+	table := map[string]struct {
+		field string
+		value float64
+		valid bool
+	}{
+		"int":                 {field: "int", value: -1, valid: true},
+		"uint8":               {field: "uint8", value: 255, valid: true},
+		"uint16":              {field: "uint16", value: 65535, valid: true},
+		"fraction":            {field: "int", value: 1.5},
+		"negative unsigned":   {field: "uint16", value: -1},
+		"overflowing int8":    {field: "int8", value: 128},
+		"underflowing int8":   {field: "int8", value: -129},
+		"overflowing uint16":  {field: "uint16", value: 70000},
+		"overflowing uint32":  {field: "uint32", value: 1 << 32},
+		"overflowing uint64":  {field: "uint64", value: 1e20},
+		"fractional unsigned": {field: "uint", value: 0.1},
+		"fraction in struct":  {field: "struct", value: 0.5},
+	}
+
+	for testName, test := range table {
+		var literal any = test.value
+		if test.field == "struct" {
+			literal = map[string]any{"int": test.value}
+		}
+
+		record := &Record{
+			Type:         "test",
+			Name:         "test",
+			LiteralValue: map[string]any{test.field: literal},
+			Value:        &testNumberRecord{},
+		}
+
+		err := record.parseLiteral()
+		if test.valid && err != nil {
+			t.Fatalf("%q should be valid: %v", testName, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%q should not be valid: %+v", testName, record.Value)
+		}
+	}
+}
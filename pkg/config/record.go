@@ -1,10 +1,13 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
 )
 
 type Record struct {
@@ -46,10 +49,48 @@ func (c *Config) trimZones() {
 			record.Name = trimDot(record.Name)
 		}
 
+		for _, challenge := range zone.ACMEChallenges {
+			challenge.Name = trimDot(challenge.Name)
+		}
+
+		if zone.Transfer != nil {
+			keys := map[string]string{}
+
+			for name, secret := range zone.Transfer.TSIG {
+				keys[trimDot(name)] = secret
+			}
+
+			zone.Transfer.TSIG = keys
+		}
+
+		if zone.Update != nil {
+			keys := map[string]string{}
+
+			for name, secret := range zone.Update.TSIG {
+				keys[trimDot(name)] = secret
+			}
+
+			zone.Update.TSIG = keys
+		}
+
 		newZones[trimDot(key)] = zone
 	}
 
 	c.Zones = newZones
+
+	for _, view := range c.Views {
+		newViewZones := map[string]*ViewZone{}
+
+		for key, vz := range view.Zones {
+			for _, record := range vz.Records {
+				record.Name = trimDot(record.Name)
+			}
+
+			newViewZones[trimDot(key)] = vz
+		}
+
+		view.Zones = newViewZones
+	}
 }
 
 // Decorate zones with a trailing dot. Used in loading the configuration.
@@ -69,13 +110,71 @@ func (c *Config) decorateZones() {
 		zone.NS.Servers = newServers
 
 		for _, record := range zone.Records {
-			record.Name = addDot(record.Name)
+			decorateRecord(record)
+		}
+
+		for _, challenge := range zone.ACMEChallenges {
+			challenge.Name = addDot(challenge.Name)
+		}
+
+		if zone.Transfer != nil {
+			keys := map[string]string{}
+
+			// the dns package wants key names in canonical form.
+			for name, secret := range zone.Transfer.TSIG {
+				keys[dns.CanonicalName(name)] = secret
+			}
+
+			zone.Transfer.TSIG = keys
+		}
+
+		if zone.Update != nil {
+			keys := map[string]string{}
+
+			for name, secret := range zone.Update.TSIG {
+				keys[dns.CanonicalName(name)] = secret
+			}
+
+			zone.Update.TSIG = keys
 		}
 
 		newZones[addDot(key)] = zone
 	}
 
 	c.Zones = newZones
+
+	for _, view := range c.Views {
+		newViewZones := map[string]*ViewZone{}
+
+		for key, vz := range view.Zones {
+			for _, record := range vz.Records {
+				decorateRecord(record)
+			}
+
+			newViewZones[addDot(key)] = vz
+		}
+
+		view.Zones = newViewZones
+	}
+}
+
+func decorateRecord(record *Record) {
+	record.Name = addDot(record.Name)
+
+	switch value := record.Value.(type) {
+	case *dnsconfig.CNAME:
+		value.Target = addDot(value.Target)
+	case *dnsconfig.ALIAS:
+		value.Target = addDot(value.Target)
+	case *dnsconfig.MX:
+		for _, exchanger := range value.Exchangers {
+			exchanger.Exchange = addDot(exchanger.Exchange)
+		}
+	case *dnsconfig.SRV:
+		for _, target := range value.Targets {
+			target.Target = addDot(target.Target)
+		}
+	}
 }
 
 // decompose the "literal value" into a dnsconfig struct record, to be
@@ -84,33 +183,275 @@ func (c *Config) decorateZones() {
 // this could probably be done much better with struct tags; I'm just too lazy
 // at this point.
 func (c *Config) convertLiterals() error {
-	for _, z := range c.Zones {
+	// TSIG keys are found by name alone, so a name must mean the same secret in
+	// every zone it is used in.
+	secrets := map[string]string{}
+
+	for key, z := range c.Zones {
 		if z.NS.TTL == 0 {
 			z.NS.TTL = z.SOA.MinTTL
 		}
 
 		for _, r := range z.Records {
-			switch r.Type {
-			case dnsconfig.TypeA:
-				a := &dnsconfig.A{}
-				a.TTL = z.SOA.MinTTL
-
-				r.Value = a
-			case dnsconfig.TypeLB:
-				lb := &dnsconfig.LB{}
-				lb.TTL = z.SOA.MinTTL
-				lb.MaxConnectionsPerAddress = dnsconfig.DefaultMaxConnectionsPerAddress
-				lb.SimultaneousConnections = dnsconfig.DefaultSimultaneousConnections
-
-				r.Value = lb
-			default:
-				return fmt.Errorf("invalid type for record %q", r.Name)
+			if err := r.convert(z); err != nil {
+				return err
 			}
+		}
+
+		if err := validateCNAMEs(key, z); err != nil {
+			return err
+		}
+
+		if z.Auto && !IsReverseZone(key) {
+			return fmt.Errorf("Zone %q is not a reverse zone, and cannot have auto set", key)
+		}
+
+		if err := validateTransfer(key, z, secrets); err != nil {
+			return err
+		}
+
+		if err := validateUpdate(key, z, secrets); err != nil {
+			return err
+		}
+
+		if err := validateDNSSEC(key, z); err != nil {
+			return err
+		}
+
+		if err := z.RRL.validate(); err != nil {
+			return fmt.Errorf("In zone %q: %w", key, err)
+		}
+	}
+
+	return c.validateViews()
+}
+
+// convert parses the literal value of a record in the zone, whose SOA gives
+// the default TTL.
+func (r *Record) convert(z *Zone) error {
+	switch r.Type {
+	case dnsconfig.TypeA:
+		a := &dnsconfig.A{}
+		a.TTL = z.SOA.MinTTL
+
+		r.Value = a
+	case dnsconfig.TypeAAAA:
+		aaaa := &dnsconfig.AAAA{}
+		aaaa.TTL = z.SOA.MinTTL
+
+		r.Value = aaaa
+	case dnsconfig.TypeCNAME:
+		cname := &dnsconfig.CNAME{}
+		cname.TTL = z.SOA.MinTTL
+
+		r.Value = cname
+	case dnsconfig.TypeALIAS:
+		alias := &dnsconfig.ALIAS{}
+		alias.TTL = z.SOA.MinTTL
+
+		r.Value = alias
+	case dnsconfig.TypeMX:
+		mx := &dnsconfig.MX{}
+		mx.TTL = z.SOA.MinTTL
+
+		r.Value = mx
+	case dnsconfig.TypeTXT:
+		txt := &dnsconfig.TXT{}
+		txt.TTL = z.SOA.MinTTL
+
+		r.Value = txt
+	case dnsconfig.TypeSRV:
+		srv := &dnsconfig.SRV{}
+		srv.TTL = z.SOA.MinTTL
+
+		r.Value = srv
+	case dnsconfig.TypeCAA:
+		caa := &dnsconfig.CAA{}
+		caa.TTL = z.SOA.MinTTL
+
+		r.Value = caa
+	case dnsconfig.TypeLB:
+		lb := &dnsconfig.LB{}
+		lb.TTL = z.SOA.MinTTL
+		lb.MaxConnectionsPerAddress = dnsconfig.DefaultMaxConnectionsPerAddress
+		lb.SimultaneousConnections = dnsconfig.DefaultSimultaneousConnections
+
+		r.Value = lb
+	default:
+		return fmt.Errorf("invalid type for record %q", r.Name)
+	}
+
+	if err := r.parseLiteral(); err != nil {
+		return fmt.Errorf("Error parsing record %q: %v", r.Name, err)
+	}
 
-			if err := r.parseLiteral(); err != nil {
-				return fmt.Errorf("Error parsing record %q: %v", r.Name, err)
+	if err := validateAddresses(r); err != nil {
+		return err
+	}
+
+	if err := validateOrdering(r); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateAddresses checks that A records only hold IPv4 addresses, and AAAA
+// records only IPv6 ones; the others would be dropped when answering.
+func validateAddresses(r *Record) error {
+	switch value := r.Value.(type) {
+	case *dnsconfig.A:
+		for _, addr := range value.Addresses {
+			if addr.To4() == nil {
+				return fmt.Errorf("A record %q has %q, which is not an IPv4 address", r.Name, addr)
 			}
 		}
+	case *dnsconfig.AAAA:
+		for _, addr := range value.Addresses {
+			if addr == nil || addr.To4() != nil {
+				return fmt.Errorf("AAAA record %q has %q, which is not an IPv6 address", r.Name, addr)
+			}
+		}
+	}
+
+	return nil
+}
+
+// IsReverseZone reports whether the zone is under in-addr.arpa or ip6.arpa.
+func IsReverseZone(name string) bool {
+	name = strings.ToLower(trimDot(name))
+
+	for _, suffix := range []string{"in-addr.arpa", "ip6.arpa"} {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CNAMEs cannot live alongside any other data for the same name, which also
+// means they cannot live at the apex, where the SOA and NS records are.
+func validateCNAMEs(key string, z *Zone) error {
+	names := map[string]int{}
+
+	for _, r := range z.Records {
+		names[trimDot(r.Name)]++
+	}
+
+	for _, r := range z.Records {
+		if r.Type != dnsconfig.TypeCNAME {
+			continue
+		}
+
+		if trimDot(r.Name) == trimDot(key) {
+			return fmt.Errorf("CNAME record %q cannot be at the apex of zone %q", r.Name, key)
+		}
+
+		if names[trimDot(r.Name)] > 1 {
+			return fmt.Errorf("CNAME record %q cannot share its name with other records", r.Name)
+		}
+	}
+
+	return nil
+}
+
+// validateOrdering checks the answer ordering and weights of records with
+// several addresses.
+func validateOrdering(r *Record) error {
+	ordered, ok := r.Value.(dnsconfig.Ordered)
+	if !ok {
+		return nil
+	}
+
+	ordering, maxAnswers := ordered.Ordering()
+
+	switch ordering {
+	case "", dnsconfig.OrderingFixed, dnsconfig.OrderingRoundRobin, dnsconfig.OrderingRandom:
+	default:
+		return fmt.Errorf("Record %q has invalid ordering %q", r.Name, ordering)
+	}
+
+	if maxAnswers < 0 {
+		return fmt.Errorf("Record %q has a negative max_answers", r.Name)
+	}
+
+	return validateWeights(r, ordering)
+}
+
+// validateWeights checks the weights of a record's addresses, which are keyed
+// by the address, or the listener for LB records. Weights pick the order of
+// the answers themselves, so they cannot be combined with another ordering.
+func validateWeights(r *Record, ordering string) error {
+	weighted, ok := r.Value.(dnsconfig.Weighted)
+	if !ok || len(weighted.Weighting()) == 0 {
+		return nil
+	}
+
+	if ordering != "" {
+		return fmt.Errorf("Record %q cannot have both weights and ordering %q", r.Name, ordering)
+	}
+
+	for key, weight := range weighted.Weighting() {
+		if weight < 0 {
+			return fmt.Errorf("Record %q has a negative weight for %q", r.Name, key)
+		}
+
+		if r.Type == dnsconfig.TypeLB {
+			if _, _, err := net.SplitHostPort(key); err != nil {
+				return fmt.Errorf("Record %q has a weight for %q, which is not a listener: %v", r.Name, key, err)
+			}
+		} else if net.ParseIP(key) == nil {
+			return fmt.Errorf("Record %q has a weight for %q, which is not an address", r.Name, key)
+		}
+	}
+
+	return nil
+}
+
+// validateTransfer checks the allow-list and TSIG keys of a zone. secrets
+// holds the keys seen in other zones so far.
+func validateTransfer(key string, z *Zone, secrets map[string]string) error {
+	if z.Transfer == nil {
+		return nil
+	}
+
+	for _, allow := range z.Transfer.Allow {
+		if _, _, err := net.ParseCIDR(allow); err != nil && net.ParseIP(allow) == nil {
+			return fmt.Errorf("Transfer allow-list entry %q in zone %q is not an IP or CIDR", allow, key)
+		}
+	}
+
+	return validateTSIG(key, z.Transfer.TSIG, secrets)
+}
+
+// validateUpdate checks the TSIG keys allowed to update a zone. There must be
+// at least one, as unsigned updates are never accepted.
+func validateUpdate(key string, z *Zone, secrets map[string]string) error {
+	if z.Update == nil {
+		return nil
+	}
+
+	if len(z.Update.TSIG) == 0 {
+		return fmt.Errorf("Updates to zone %q require at least one TSIG key", key)
+	}
+
+	return validateTSIG(key, z.Update.TSIG, secrets)
+}
+
+func validateTSIG(key string, keys map[string]string, secrets map[string]string) error {
+	for name, secret := range keys {
+		if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+			return fmt.Errorf("TSIG key %q in zone %q is not valid base64: %v", name, key, err)
+		}
+
+		name = dns.CanonicalName(name)
+
+		if other, ok := secrets[name]; ok && other != secret {
+			return fmt.Errorf("TSIG key %q in zone %q has a different secret in another zone", name, key)
+		}
+
+		secrets[name] = secret
 	}
 
 	return nil
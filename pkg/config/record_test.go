@@ -3,10 +3,13 @@ package config
 import (
 	"net"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/erikh/border/pkg/healthcheck"
 	"github.com/erikh/border/pkg/josekit"
 )
 
@@ -47,6 +50,15 @@ func TestRecordParse(t *testing.T) {
 							},
 						},
 					},
+					{
+						Type: dnsconfig.TypeAAAA,
+						Name: "foo.test.home.arpa",
+						LiteralValue: map[string]any{
+							"addresses": []string{
+								"::1",
+							},
+						},
+					},
 					{
 						Type: dnsconfig.TypeLB,
 						Name: "border.test.home.arpa",
@@ -80,7 +92,17 @@ func TestRecordParse(t *testing.T) {
 		t.Fatal("A records did not match")
 	}
 
-	lbRecord := config.Zones["test.home.arpa"].Records[1].Value.(*dnsconfig.LB)
+	aaaaRecord := config.Zones["test.home.arpa"].Records[1].Value.(*dnsconfig.AAAA)
+	realAAAARecord := &dnsconfig.AAAA{
+		Addresses: []net.IP{net.ParseIP("::1")},
+		TTL:       60,
+	}
+
+	if !reflect.DeepEqual(realAAAARecord, aaaaRecord) {
+		t.Fatal("AAAA records did not match")
+	}
+
+	lbRecord := config.Zones["test.home.arpa"].Records[2].Value.(*dnsconfig.LB)
 	realLBRecord := &dnsconfig.LB{
 		Listeners:                []string{"test"},
 		Kind:                     "tcp",
@@ -97,3 +119,400 @@ func TestRecordParse(t *testing.T) {
 	}
 
 }
+
+func TestCNAMEValidation(t *testing.T) {
+	makeZone := func(records ...*Record) map[string]*Zone {
+		return map[string]*Zone{
+			"test.home.arpa": {
+				SOA:     &dnsconfig.SOA{Domain: "test.home.arpa", MinTTL: 60},
+				NS:      &dnsconfig.NS{Servers: []string{"test.home.arpa"}},
+				Records: records,
+			},
+		}
+	}
+
+	cname := func(name string) *Record {
+		return &Record{
+			Type:         dnsconfig.TypeCNAME,
+			Name:         name,
+			LiteralValue: map[string]any{"target": "foo.test.home.arpa"},
+		}
+	}
+
+	config := Config{Zones: makeZone(cname("bar.test.home.arpa"))}
+	if err := config.convertLiterals(); err != nil {
+		t.Fatal(err)
+	}
+
+	config.decorateZones()
+
+	if target := config.Zones["test.home.arpa."].Records[0].Value.(*dnsconfig.CNAME).Target; target != "foo.test.home.arpa." {
+		t.Fatalf("CNAME target was not decorated: %q", target)
+	}
+
+	config = Config{Zones: makeZone(cname("test.home.arpa"))}
+	if err := config.convertLiterals(); err == nil {
+		t.Fatal("CNAME at the apex did not error")
+	}
+
+	config = Config{Zones: makeZone(cname("bar.test.home.arpa"), &Record{
+		Type:         dnsconfig.TypeA,
+		Name:         "bar.test.home.arpa",
+		LiteralValue: map[string]any{"addresses": []string{"127.0.0.1"}},
+	})}
+
+	if err := config.convertLiterals(); err == nil {
+		t.Fatal("CNAME sharing a name with an A record did not error")
+	}
+}
+
+func TestAddressValidation(t *testing.T) {
+	table := map[string]struct {
+		typ       string
+		addresses []string
+		valid     bool
+	}{
+		"A with IPv4":       {typ: dnsconfig.TypeA, addresses: []string{"127.0.0.1"}, valid: true},
+		"AAAA with IPv6":    {typ: dnsconfig.TypeAAAA, addresses: []string{"::1"}, valid: true},
+		"A with IPv6":       {typ: dnsconfig.TypeA, addresses: []string{"127.0.0.1", "::1"}},
+		"AAAA with IPv4":    {typ: dnsconfig.TypeAAAA, addresses: []string{"::1", "127.0.0.1"}},
+		"A with garbage":    {typ: dnsconfig.TypeA, addresses: []string{"localhost"}},
+		"AAAA with garbage": {typ: dnsconfig.TypeAAAA, addresses: []string{"localhost"}},
+	}
+
+	for testName, test := range table {
+		config := Config{Zones: map[string]*Zone{
+			"test.home.arpa": {
+				SOA: &dnsconfig.SOA{Domain: "test.home.arpa", MinTTL: 60},
+				NS:  &dnsconfig.NS{Servers: []string{"test.home.arpa"}},
+				Records: []*Record{{
+					Type:         test.typ,
+					Name:         "foo.test.home.arpa",
+					LiteralValue: map[string]any{"addresses": test.addresses},
+				}},
+			},
+		}}
+
+		err := config.convertLiterals()
+		if test.valid && err != nil {
+			t.Fatalf("%q should be valid: %v", testName, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%q should not be valid", testName)
+		}
+	}
+}
+
+func TestMXParse(t *testing.T) {
+	// numbers arrive as float64 from JSON and YAML
+	config := Config{
+		Zones: map[string]*Zone{
+			"test.home.arpa": {
+				SOA: &dnsconfig.SOA{Domain: "test.home.arpa", MinTTL: 60},
+				NS:  &dnsconfig.NS{Servers: []string{"test.home.arpa"}},
+				Records: []*Record{
+					{
+						Type: dnsconfig.TypeMX,
+						Name: "test.home.arpa",
+						LiteralValue: map[string]any{
+							"exchangers": []any{
+								map[string]any{"preference": float64(10), "exchange": "mx1.test.home.arpa"},
+								map[string]any{"preference": float64(20), "exchange": "mx2.test.home.arpa"},
+							},
+							"ttl": float64(30),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := config.convertLiterals(); err != nil {
+		t.Fatal(err)
+	}
+
+	config.decorateZones()
+
+	mxRecord := config.Zones["test.home.arpa."].Records[0].Value.(*dnsconfig.MX)
+	realMXRecord := &dnsconfig.MX{
+		Exchangers: []*dnsconfig.MXExchanger{
+			{Preference: 10, Exchange: "mx1.test.home.arpa."},
+			{Preference: 20, Exchange: "mx2.test.home.arpa."},
+		},
+		TTL: 30,
+	}
+
+	if !reflect.DeepEqual(realMXRecord, mxRecord) {
+		t.Fatalf("MX records did not match: %#v", mxRecord)
+	}
+}
+
+func TestNumberValidation(t *testing.T) {
+	table := map[string]struct {
+		typ     string
+		literal map[string]any
+		field   string
+	}{
+		"SRV port": {
+			typ: dnsconfig.TypeSRV,
+			literal: map[string]any{"targets": []any{
+				map[string]any{"priority": float64(0), "weight": float64(0), "port": float64(70000), "target": "dc1.test.home.arpa"},
+			}},
+			field: "port",
+		},
+		"MX preference": {
+			typ: dnsconfig.TypeMX,
+			literal: map[string]any{"exchangers": []any{
+				map[string]any{"preference": float64(-1), "exchange": "mx1.test.home.arpa"},
+			}},
+			field: "preference",
+		},
+		"TTL": {
+			typ:     dnsconfig.TypeA,
+			literal: map[string]any{"addresses": []string{"127.0.0.1"}, "ttl": float64(1.5)},
+			field:   "ttl",
+		},
+	}
+
+	for testName, test := range table {
+		config := Config{Zones: map[string]*Zone{
+			"test.home.arpa": {
+				SOA:     &dnsconfig.SOA{Domain: "test.home.arpa", MinTTL: 60},
+				NS:      &dnsconfig.NS{Servers: []string{"test.home.arpa"}},
+				Records: []*Record{{Type: test.typ, Name: "foo.test.home.arpa", LiteralValue: test.literal}},
+			},
+		}}
+
+		err := config.convertLiterals()
+		if err == nil {
+			t.Fatalf("%q should not be valid", testName)
+		}
+
+		if !strings.Contains(err.Error(), strconv.Quote(test.field)) {
+			t.Fatalf("Error for %q does not name the field %q: %v", testName, test.field, err)
+		}
+	}
+}
+
+func TestSRVParse(t *testing.T) {
+	config := Config{
+		Zones: map[string]*Zone{
+			"test.home.arpa": {
+				SOA: &dnsconfig.SOA{Domain: "test.home.arpa", MinTTL: 60},
+				NS:  &dnsconfig.NS{Servers: []string{"test.home.arpa"}},
+				Records: []*Record{
+					{
+						Type: dnsconfig.TypeSRV,
+						Name: "_ldap._tcp.test.home.arpa",
+						LiteralValue: map[string]any{
+							"targets": []any{
+								map[string]any{
+									"priority": float64(0),
+									"weight":   float64(100),
+									"port":     float64(389),
+									"target":   "dc1.test.home.arpa",
+									"healthcheck": []any{
+										map[string]any{
+											"timeout":  "1s",
+											"failures": float64(3),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := config.convertLiterals(); err != nil {
+		t.Fatal(err)
+	}
+
+	config.decorateZones()
+
+	srvRecord := config.Zones["test.home.arpa."].Records[0].Value.(*dnsconfig.SRV)
+	realSRVRecord := &dnsconfig.SRV{
+		Targets: []*dnsconfig.SRVTarget{
+			{
+				Priority: 0,
+				Weight:   100,
+				Port:     389,
+				Target:   "dc1.test.home.arpa.",
+				HealthCheck: []*healthcheck.HealthCheck{
+					{
+						Timeout:  time.Second,
+						Failures: 3,
+					},
+				},
+			},
+		},
+		TTL: 60,
+	}
+
+	if !reflect.DeepEqual(realSRVRecord, srvRecord) {
+		t.Fatalf("SRV records did not match: %#v", srvRecord.Targets[0])
+	}
+}
+
+func TestAutoReverseZone(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"0.0.127.in-addr.arpa": true,
+		"ip6.arpa":             true,
+		"test.home.arpa":       false,
+		"notip6.arpa":          false,
+	} {
+		config := Config{
+			Zones: map[string]*Zone{
+				name: {
+					SOA:     &dnsconfig.SOA{Domain: name, MinTTL: 60},
+					NS:      &dnsconfig.NS{Servers: []string{"test.home.arpa"}},
+					Records: []*Record{},
+					Auto:    true,
+				},
+			},
+		}
+
+		err := config.convertLiterals()
+		if valid && err != nil {
+			t.Fatalf("%q should be a valid auto zone: %v", name, err)
+		} else if !valid && err == nil {
+			t.Fatalf("%q should not be a valid auto zone", name)
+		}
+	}
+}
+
+func TestTransferValidation(t *testing.T) {
+	table := map[string]struct {
+		transfers map[string]*Transfer
+		valid     bool
+	}{
+		"allow": {
+			transfers: map[string]*Transfer{"test.home.arpa": {Allow: []string{"127.0.0.1", "10.0.0.0/8", "::1"}}},
+			valid:     true,
+		},
+		"bad allow": {
+			transfers: map[string]*Transfer{"test.home.arpa": {Allow: []string{"localhost"}}},
+		},
+		"tsig": {
+			transfers: map[string]*Transfer{"test.home.arpa": {TSIG: map[string]string{"xfr": "c2VjcmV0"}}},
+			valid:     true,
+		},
+		"bad tsig": {
+			transfers: map[string]*Transfer{"test.home.arpa": {TSIG: map[string]string{"xfr": "not base64!"}}},
+		},
+		"shared tsig": {
+			transfers: map[string]*Transfer{
+				"test.home.arpa":  {TSIG: map[string]string{"xfr": "c2VjcmV0"}},
+				"other.home.arpa": {TSIG: map[string]string{"xfr.": "c2VjcmV0"}},
+			},
+			valid: true,
+		},
+		"conflicting tsig": {
+			transfers: map[string]*Transfer{
+				"test.home.arpa":  {TSIG: map[string]string{"xfr": "c2VjcmV0"}},
+				"other.home.arpa": {TSIG: map[string]string{"xfr": "b3RoZXI="}},
+			},
+		},
+	}
+
+	for testName, test := range table {
+		config := Config{Zones: map[string]*Zone{}}
+
+		for name, transfer := range test.transfers {
+			config.Zones[name] = &Zone{
+				SOA:      &dnsconfig.SOA{Domain: name, MinTTL: 60},
+				NS:       &dnsconfig.NS{Servers: []string{name}},
+				Records:  []*Record{},
+				Transfer: transfer,
+			}
+		}
+
+		err := config.convertLiterals()
+		if test.valid && err != nil {
+			t.Fatalf("%q should be valid: %v", testName, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%q should not be valid", testName)
+		}
+	}
+}
+
+func TestOrderingValidation(t *testing.T) {
+	table := map[string]struct {
+		typ     string
+		literal map[string]any
+		valid   bool
+	}{
+		"default": {
+			typ:     dnsconfig.TypeA,
+			literal: map[string]any{"addresses": []string{"127.0.0.1"}},
+			valid:   true,
+		},
+		"round-robin": {
+			typ:     dnsconfig.TypeA,
+			literal: map[string]any{"addresses": []string{"127.0.0.1"}, "ordering": "round-robin", "max_answers": float64(2)},
+			valid:   true,
+		},
+		"random": {
+			typ:     dnsconfig.TypeAAAA,
+			literal: map[string]any{"addresses": []string{"::1"}, "ordering": "random"},
+			valid:   true,
+		},
+		"fixed": {
+			typ:     dnsconfig.TypeLB,
+			literal: map[string]any{"listeners": []string{"127.0.0.1:80"}, "kind": "tcp", "backends": []string{"127.0.0.1:8080"}, "ordering": "fixed"},
+			valid:   true,
+		},
+		"unknown ordering": {
+			typ:     dnsconfig.TypeA,
+			literal: map[string]any{"addresses": []string{"127.0.0.1"}, "ordering": "sorted"},
+		},
+		"negative max_answers": {
+			typ:     dnsconfig.TypeA,
+			literal: map[string]any{"addresses": []string{"127.0.0.1"}, "max_answers": float64(-1)},
+		},
+		"weights": {
+			typ:     dnsconfig.TypeA,
+			literal: map[string]any{"addresses": []string{"127.0.0.1", "127.0.0.2"}, "weights": map[string]any{"127.0.0.1": float64(90), "127.0.0.2": float64(10)}},
+			valid:   true,
+		},
+		"listener weights": {
+			typ:     dnsconfig.TypeLB,
+			literal: map[string]any{"listeners": []string{"127.0.0.1:80"}, "kind": "tcp", "backends": []string{"127.0.0.1:8080"}, "weights": map[string]any{"127.0.0.1:80": float64(1)}},
+			valid:   true,
+		},
+		"weights and ordering": {
+			typ:     dnsconfig.TypeA,
+			literal: map[string]any{"addresses": []string{"127.0.0.1"}, "ordering": "round-robin", "weights": map[string]any{"127.0.0.1": float64(1)}},
+		},
+		"negative weight": {
+			typ:     dnsconfig.TypeA,
+			literal: map[string]any{"addresses": []string{"127.0.0.1"}, "weights": map[string]any{"127.0.0.1": float64(-1)}},
+		},
+		"weight for a name": {
+			typ:     dnsconfig.TypeA,
+			literal: map[string]any{"addresses": []string{"127.0.0.1"}, "weights": map[string]any{"localhost": float64(1)}},
+		},
+		"weight for an address of an LB": {
+			typ:     dnsconfig.TypeLB,
+			literal: map[string]any{"listeners": []string{"127.0.0.1:80"}, "kind": "tcp", "backends": []string{"127.0.0.1:8080"}, "weights": map[string]any{"127.0.0.1": float64(1)}},
+		},
+	}
+
+	for testName, test := range table {
+		config := Config{Zones: map[string]*Zone{
+			"test.home.arpa": {
+				SOA:     &dnsconfig.SOA{Domain: "test.home.arpa", MinTTL: 60},
+				NS:      &dnsconfig.NS{Servers: []string{"test.home.arpa"}},
+				Records: []*Record{{Type: test.typ, Name: "foo.test.home.arpa", LiteralValue: test.literal}},
+			},
+		}}
+
+		err := config.convertLiterals()
+		if test.valid && err != nil {
+			t.Fatalf("%q should be valid: %v", testName, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%q should not be valid", testName)
+		}
+	}
+}
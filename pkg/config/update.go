@@ -0,0 +1,560 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+)
+
+type rrsetKey struct {
+	name string
+	typ  uint16
+}
+
+// zoneUpdate holds the records of a zone as RR sets while an update is applied
+// to them, so that each step sees the changes of the ones before it.
+type zoneUpdate struct {
+	apex string
+	zone *Zone
+
+	sets map[rrsetKey][]dns.RR
+	// the literal value of the first record of each set, which holds fields
+	// that are not part of the RRs, like health checks.
+	bases map[rrsetKey]map[string]any
+	// new sets go after the records of the zone, in the order they are added.
+	added []rrsetKey
+
+	soaChanged bool
+}
+
+// UpdateZone applies an RFC 2136 dynamic update to the zones, which must be in
+// the shape they are in after loading: decorated with trailing dots, and
+// parsed. The response code for the update is returned, with an error saying
+// why if it is not NOERROR; the zones may be partially changed in that case,
+// and should be thrown away.
+//
+// LB and ALIAS records belong to border, and are left alone by updates.
+func UpdateZone(zones map[string]*Zone, update *dns.Msg) (int, error) {
+	if len(update.Question) != 1 || update.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError, errors.New("the zone section must hold a single SOA")
+	}
+
+	apex := dns.CanonicalName(update.Question[0].Name)
+
+	var (
+		key  string
+		zone *Zone
+	)
+
+	for name, z := range zones {
+		if dns.CanonicalName(name) == apex {
+			key = name
+			zone = z
+		}
+	}
+
+	if zone == nil {
+		return dns.RcodeNotAuth, fmt.Errorf("zone %q is not ours", apex)
+	}
+
+	u := newZoneUpdate(apex, zone)
+
+	if rcode, err := u.prerequisites(update.Answer); err != nil {
+		return rcode, err
+	}
+
+	if rcode, err := u.prescan(update.Ns); err != nil {
+		return rcode, err
+	}
+
+	var changed bool
+
+	for _, rr := range update.Ns {
+		if u.apply(rr) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return dns.RcodeSuccess, nil
+	}
+
+	u.rebuild()
+
+	// RFC 2136 section 3.6; secondaries would not notice the change otherwise.
+	if !u.soaChanged {
+		zone.SOA.Serial++
+	}
+
+	// parse the records the same way a configuration would be, which also
+	// validates the result.
+	c := &Config{Zones: map[string]*Zone{key: zone}}
+	if err := c.convertLiterals(); err != nil {
+		return dns.RcodeRefused, err
+	}
+
+	c.decorateZones()
+
+	return dns.RcodeSuccess, nil
+}
+
+// owned reports whether a record is one of border's own types, which have no
+// RRs of their own to update.
+func owned(rec *Record) bool {
+	return rec.Type == dnsconfig.TypeLB || rec.Type == dnsconfig.TypeALIAS
+}
+
+func newZoneUpdate(apex string, zone *Zone) *zoneUpdate {
+	u := &zoneUpdate{
+		apex:  apex,
+		zone:  zone,
+		sets:  map[rrsetKey][]dns.RR{},
+		bases: map[rrsetKey]map[string]any{},
+	}
+
+	for _, rec := range zone.Records {
+		if owned(rec) {
+			continue
+		}
+
+		for _, rr := range rec.Value.Convert(dns.CanonicalName(rec.Name)) {
+			key := rrsetKey{name: dns.CanonicalName(rec.Name), typ: rr.Header().Rrtype}
+
+			if _, ok := u.bases[key]; !ok {
+				u.bases[key] = rec.LiteralValue
+			}
+
+			u.sets[key] = append(u.sets[key], rr)
+		}
+	}
+
+	return u
+}
+
+// rrset yields the RRs of a type at a name. dns.TypeANY yields all of them.
+func (u *zoneUpdate) rrset(name string, typ uint16) []dns.RR {
+	rrs := []dns.RR{}
+
+	if name == u.apex {
+		if typ == dns.TypeSOA || typ == dns.TypeANY {
+			rrs = append(rrs, u.zone.SOA.Convert(name)...)
+		}
+
+		if typ == dns.TypeNS || typ == dns.TypeANY {
+			rrs = append(rrs, u.zone.NS.Convert(name)...)
+		}
+	}
+
+	for key, set := range u.sets {
+		if key.name == name && (typ == dns.TypeANY || key.typ == typ) {
+			rrs = append(rrs, set...)
+		}
+	}
+
+	return rrs
+}
+
+// inUse reports whether a name has any records, border's own included.
+func (u *zoneUpdate) inUse(name string) bool {
+	if len(u.rrset(name, dns.TypeANY)) != 0 {
+		return true
+	}
+
+	for _, rec := range u.zone.Records {
+		if owned(rec) && dns.CanonicalName(rec.Name) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameRR compares the data of two RRs, ignoring class and TTL, which differ
+// between the sections of an update.
+func sameRR(a, b dns.RR) bool {
+	a = dns.Copy(a)
+	b = dns.Copy(b)
+	a.Header().Class = dns.ClassINET
+	b.Header().Class = dns.ClassINET
+
+	return dns.IsDuplicate(a, b)
+}
+
+// prerequisites checks the prerequisite section; see RFC 2136 section 3.2.
+func (u *zoneUpdate) prerequisites(rrs []dns.RR) (int, error) {
+	expected := map[rrsetKey][]dns.RR{}
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		name := dns.CanonicalName(hdr.Name)
+
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError, fmt.Errorf("prerequisite for %q has a TTL", name)
+		}
+
+		if !dns.IsSubDomain(u.apex, name) {
+			return dns.RcodeNotZone, fmt.Errorf("prerequisite for %q is outside of the zone", name)
+		}
+
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError, fmt.Errorf("prerequisite for %q has data", name)
+			}
+
+			if hdr.Rrtype == dns.TypeANY {
+				if !u.inUse(name) {
+					return dns.RcodeNameError, fmt.Errorf("%q is not in use", name)
+				}
+			} else if len(u.rrset(name, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset, fmt.Errorf("%q has no %s records", name, dns.TypeToString[hdr.Rrtype])
+			}
+		case dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError, fmt.Errorf("prerequisite for %q has data", name)
+			}
+
+			if hdr.Rrtype == dns.TypeANY {
+				if u.inUse(name) {
+					return dns.RcodeYXDomain, fmt.Errorf("%q is in use", name)
+				}
+			} else if len(u.rrset(name, hdr.Rrtype)) != 0 {
+				return dns.RcodeYXRrset, fmt.Errorf("%q has %s records", name, dns.TypeToString[hdr.Rrtype])
+			}
+		case dns.ClassINET:
+			key := rrsetKey{name: name, typ: hdr.Rrtype}
+			expected[key] = append(expected[key], rr)
+		default:
+			return dns.RcodeFormatError, fmt.Errorf("prerequisite for %q has an invalid class", name)
+		}
+	}
+
+	// value dependent prerequisites must match the whole set.
+	for key, want := range expected {
+		have := u.rrset(key.name, key.typ)
+
+		if !sameSet(want, have) {
+			return dns.RcodeNXRrset, fmt.Errorf("%s records of %q differ", dns.TypeToString[key.typ], key.name)
+		}
+	}
+
+	return dns.RcodeSuccess, nil
+}
+
+func sameSet(a, b []dns.RR) bool {
+	contains := func(set []dns.RR, rr dns.RR) bool {
+		for _, item := range set {
+			if sameRR(item, rr) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// prescan checks the update section before anything is changed; see RFC 2136
+// section 3.4.1.
+func (u *zoneUpdate) prescan(rrs []dns.RR) (int, error) {
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		name := dns.CanonicalName(hdr.Name)
+
+		if !dns.IsSubDomain(u.apex, name) {
+			return dns.RcodeNotZone, fmt.Errorf("update for %q is outside of the zone", name)
+		}
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			switch hdr.Rrtype {
+			case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError, fmt.Errorf("cannot add %s records", dns.TypeToString[hdr.Rrtype])
+			case dns.TypeSOA, dns.TypeNS:
+				if name != u.apex {
+					return dns.RcodeRefused, fmt.Errorf("%s records for %q are only allowed at the apex", dns.TypeToString[hdr.Rrtype], name)
+				}
+			default:
+				if typ, _ := importValue(rr); typ == "" {
+					return dns.RcodeRefused, fmt.Errorf("%s records are not supported", dns.TypeToString[hdr.Rrtype])
+				}
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError, fmt.Errorf("deletion of %q has a TTL or data", name)
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError, fmt.Errorf("deletion of %q has a TTL", name)
+			}
+		default:
+			return dns.RcodeFormatError, fmt.Errorf("update for %q has an invalid class", name)
+		}
+	}
+
+	return dns.RcodeSuccess, nil
+}
+
+// apply makes one change of the update section, reporting whether anything
+// changed. Changes that make no sense, such as adding data next to a CNAME,
+// are silently ignored, as RFC 2136 says.
+func (u *zoneUpdate) apply(rr dns.RR) bool {
+	hdr := rr.Header()
+	name := dns.CanonicalName(hdr.Name)
+	key := rrsetKey{name: name, typ: hdr.Rrtype}
+
+	switch hdr.Class {
+	case dns.ClassINET:
+		return u.add(key, rr)
+	case dns.ClassANY:
+		if hdr.Rrtype != dns.TypeANY {
+			return u.remove(key, nil)
+		}
+
+		var changed bool
+
+		for key := range u.sets {
+			if key.name == name && u.remove(key, nil) {
+				changed = true
+			}
+		}
+
+		return changed
+	case dns.ClassNONE:
+		return u.remove(key, rr)
+	}
+
+	return false
+}
+
+func (u *zoneUpdate) add(key rrsetKey, rr dns.RR) bool {
+	rr = dns.Copy(rr)
+	rr.Header().Name = key.name
+
+	switch rr := rr.(type) {
+	case *dns.SOA:
+		// only newer serials replace the SOA.
+		if rr.Serial <= u.zone.SOA.Serial {
+			return false
+		}
+
+		u.zone.SOA = &dnsconfig.SOA{
+			Domain:  rr.Ns,
+			Admin:   rr.Mbox,
+			MinTTL:  rr.Minttl,
+			Serial:  rr.Serial,
+			Refresh: rr.Refresh,
+			Retry:   rr.Retry,
+			Expire:  rr.Expire,
+		}
+
+		u.soaChanged = true
+		return true
+	case *dns.NS:
+		for _, server := range u.zone.NS.Servers {
+			if dns.CanonicalName(server) == dns.CanonicalName(rr.Ns) {
+				return false
+			}
+		}
+
+		ns := *u.zone.NS
+		ns.Servers = append(append([]string{}, ns.Servers...), rr.Ns)
+		u.zone.NS = &ns
+
+		return true
+	case *dns.CNAME:
+		// a CNAME cannot live alongside anything else, including the apex.
+		if key.name == u.apex {
+			return false
+		}
+
+		for other := range u.sets {
+			if other.name == key.name && other.typ != dns.TypeCNAME && len(u.sets[other]) != 0 {
+				return false
+			}
+		}
+
+		for _, rec := range u.zone.Records {
+			if owned(rec) && dns.CanonicalName(rec.Name) == key.name {
+				return false
+			}
+		}
+
+		if set := u.sets[key]; len(set) == 1 && sameRR(set[0], rr) && set[0].Header().Ttl == rr.Header().Ttl {
+			return false
+		}
+
+		u.set(key, []dns.RR{rr})
+		return true
+	}
+
+	if len(u.sets[rrsetKey{name: key.name, typ: dns.TypeCNAME}]) != 0 {
+		return false
+	}
+
+	set := []dns.RR{}
+	changed := true
+
+	// the set shares the TTL of the newest record.
+	for _, item := range u.sets[key] {
+		if sameRR(item, rr) && item.Header().Ttl == rr.Header().Ttl {
+			changed = false
+		}
+
+		if !sameRR(item, rr) {
+			item = dns.Copy(item)
+			if item.Header().Ttl != rr.Header().Ttl {
+				item.Header().Ttl = rr.Header().Ttl
+				changed = true
+			}
+
+			set = append(set, item)
+		}
+	}
+
+	if !changed {
+		return false
+	}
+
+	u.set(key, append(set, rr))
+	return true
+}
+
+// remove deletes a single RR from a set, or the whole set if rr is nil. The
+// SOA and NS records at the apex may not be deleted wholesale; the last NS
+// record is never removed.
+func (u *zoneUpdate) remove(key rrsetKey, rr dns.RR) bool {
+	if key.name == u.apex {
+		switch key.typ {
+		case dns.TypeSOA:
+			return false
+		case dns.TypeNS:
+			if rr == nil || len(u.zone.NS.Servers) < 2 {
+				return false
+			}
+
+			servers := []string{}
+
+			for _, server := range u.zone.NS.Servers {
+				if dns.CanonicalName(server) != dns.CanonicalName(rr.(*dns.NS).Ns) {
+					servers = append(servers, server)
+				}
+			}
+
+			if len(servers) == len(u.zone.NS.Servers) {
+				return false
+			}
+
+			ns := *u.zone.NS
+			ns.Servers = servers
+			u.zone.NS = &ns
+
+			return true
+		}
+	}
+
+	if len(u.sets[key]) == 0 {
+		return false
+	}
+
+	if rr == nil {
+		u.set(key, nil)
+		return true
+	}
+
+	set := []dns.RR{}
+
+	for _, item := range u.sets[key] {
+		if !sameRR(item, rr) {
+			set = append(set, item)
+		}
+	}
+
+	if len(set) == len(u.sets[key]) {
+		return false
+	}
+
+	u.set(key, set)
+	return true
+}
+
+func (u *zoneUpdate) set(key rrsetKey, rrs []dns.RR) {
+	if _, ok := u.sets[key]; !ok {
+		u.added = append(u.added, key)
+	}
+
+	u.sets[key] = rrs
+}
+
+// rebuild turns the sets back into the records of the zone, in place of the
+// records they came from. Empty sets are dropped.
+func (u *zoneUpdate) rebuild() {
+	records := []*Record{}
+	seen := map[rrsetKey]bool{}
+
+	emit := func(key rrsetKey) {
+		if seen[key] {
+			return
+		}
+
+		seen[key] = true
+
+		set := u.sets[key]
+		if len(set) == 0 {
+			return
+		}
+
+		typ, _ := importValue(set[0])
+
+		records = append(records, &Record{
+			Type:         typ,
+			Name:         key.name,
+			LiteralValue: literal(typ, set, u.bases[key]),
+		})
+	}
+
+	for _, rec := range u.zone.Records {
+		key := rrsetKey{name: dns.CanonicalName(rec.Name), typ: recordTypes[rec.Type]}
+
+		// records that yield no RRs are kept as they are.
+		if _, ok := u.sets[key]; owned(rec) || !ok {
+			records = append(records, rec)
+			continue
+		}
+
+		emit(key)
+	}
+
+	for _, key := range u.added {
+		emit(key)
+	}
+
+	u.zone.Records = records
+}
+
+// recordTypes maps the record types that updates may touch to their RR
+// type.
+var recordTypes = map[string]uint16{
+	dnsconfig.TypeA:     dns.TypeA,
+	dnsconfig.TypeAAAA:  dns.TypeAAAA,
+	dnsconfig.TypeCNAME: dns.TypeCNAME,
+	dnsconfig.TypeMX:    dns.TypeMX,
+	dnsconfig.TypeTXT:   dns.TypeTXT,
+	dnsconfig.TypeSRV:   dns.TypeSRV,
+	dnsconfig.TypeCAA:   dns.TypeCAA,
+}
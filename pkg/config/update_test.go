@@ -0,0 +1,259 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const updateZone = `$TTL 60
+@	IN SOA ns.example.com. admin.example.com. 1 60 60 60 60
+@	IN NS ns.example.com.
+ns	IN A 192.0.2.1
+www	IN A 192.0.2.2
+	IN A 192.0.2.3
+ftp	IN CNAME www
+`
+
+func makeUpdateZones(t *testing.T) map[string]*Zone {
+	zone, _, err := ImportZone("example.com", strings.NewReader(updateZone), "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{Zones: map[string]*Zone{"example.com": zone}}
+	c.decorateZones()
+
+	return c.Zones
+}
+
+// updateRR parses a record of an update. The zone parser cannot read records
+// without data, which are used to name sets, so those are built by hand.
+func updateRR(t *testing.T, s string) dns.RR {
+	if fields := strings.Fields(s); len(fields) == 4 {
+		return &dns.ANY{Hdr: dns.RR_Header{
+			Name:   fields[0],
+			Class:  dns.StringToClass[fields[2]],
+			Rrtype: dns.StringToType[fields[3]],
+		}}
+	}
+
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rr
+}
+
+func makeUpdate(t *testing.T, prereqs []string, updates []string) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetUpdate("example.com.")
+
+	for _, prereq := range prereqs {
+		m.Answer = append(m.Answer, updateRR(t, prereq))
+	}
+
+	for _, update := range updates {
+		m.Ns = append(m.Ns, updateRR(t, update))
+	}
+
+	return m
+}
+
+func TestUpdateZone(t *testing.T) {
+	table := map[string]struct {
+		prereqs []string
+		updates []string
+		rcode   int
+		// the records expected at a name afterwards.
+		name    string
+		typ     uint16
+		records []string
+		serial  uint32
+	}{
+		"add": {
+			updates: []string{"host.example.com. 30 IN A 192.0.2.10"},
+			name:    "host.example.com.",
+			typ:     dns.TypeA,
+			records: []string{"host.example.com.\t30\tIN\tA\t192.0.2.10"},
+			serial:  2,
+		},
+		"add to set": {
+			updates: []string{"www.example.com. 30 IN A 192.0.2.4"},
+			name:    "www.example.com.",
+			typ:     dns.TypeA,
+			records: []string{
+				"www.example.com.\t30\tIN\tA\t192.0.2.2",
+				"www.example.com.\t30\tIN\tA\t192.0.2.3",
+				"www.example.com.\t30\tIN\tA\t192.0.2.4",
+			},
+			serial: 2,
+		},
+		"add duplicate": {
+			updates: []string{"www.example.com. 60 IN A 192.0.2.2"},
+			name:    "www.example.com.",
+			typ:     dns.TypeA,
+			records: []string{
+				"www.example.com.\t60\tIN\tA\t192.0.2.2",
+				"www.example.com.\t60\tIN\tA\t192.0.2.3",
+			},
+			serial: 1,
+		},
+		"add next to CNAME": {
+			updates: []string{"ftp.example.com. 60 IN TXT \"ignored\""},
+			name:    "ftp.example.com.",
+			typ:     dns.TypeTXT,
+			records: []string{},
+			serial:  1,
+		},
+		"delete RR": {
+			updates: []string{"www.example.com. 0 NONE A 192.0.2.2"},
+			name:    "www.example.com.",
+			typ:     dns.TypeA,
+			records: []string{"www.example.com.\t60\tIN\tA\t192.0.2.3"},
+			serial:  2,
+		},
+		"delete RRset": {
+			updates: []string{"www.example.com. 0 ANY A"},
+			name:    "www.example.com.",
+			typ:     dns.TypeA,
+			records: []string{},
+			serial:  2,
+		},
+		"delete name": {
+			updates: []string{"ftp.example.com. 0 ANY ANY"},
+			name:    "ftp.example.com.",
+			typ:     dns.TypeCNAME,
+			records: []string{},
+			serial:  2,
+		},
+		"apex is kept": {
+			updates: []string{"example.com. 0 ANY ANY", "example.com. 0 NONE NS ns.example.com."},
+			name:    "example.com.",
+			typ:     dns.TypeNS,
+			records: []string{"example.com.\t60\tIN\tNS\tns.example.com."},
+			serial:  1,
+		},
+		"add NS": {
+			updates: []string{"example.com. 60 IN NS ns2.example.com."},
+			name:    "example.com.",
+			typ:     dns.TypeNS,
+			records: []string{
+				"example.com.\t60\tIN\tNS\tns.example.com.",
+				"example.com.\t60\tIN\tNS\tns2.example.com.",
+			},
+			serial: 2,
+		},
+		"replace SOA": {
+			updates: []string{"example.com. 60 IN SOA ns.example.com. admin.example.com. 10 120 60 60 60"},
+			name:    "example.com.",
+			typ:     dns.TypeSOA,
+			records: []string{"example.com.\t60\tIN\tSOA\tns.example.com. admin.example.com. 10 120 60 60 60"},
+			serial:  10,
+		},
+		"name in use": {
+			prereqs: []string{"www.example.com. 0 ANY ANY"},
+			updates: []string{"www.example.com. 0 ANY A"},
+			name:    "www.example.com.",
+			typ:     dns.TypeA,
+			records: []string{},
+			serial:  2,
+		},
+		"name not in use": {
+			prereqs: []string{"missing.example.com. 0 ANY ANY"},
+			updates: []string{"missing.example.com. 60 IN A 192.0.2.10"},
+			rcode:   dns.RcodeNameError,
+		},
+		"name is in use": {
+			prereqs: []string{"www.example.com. 0 NONE ANY"},
+			updates: []string{"www.example.com. 60 IN A 192.0.2.10"},
+			rcode:   dns.RcodeYXDomain,
+		},
+		"RRset exists": {
+			prereqs: []string{"www.example.com. 0 NONE A"},
+			updates: []string{"www.example.com. 60 IN A 192.0.2.10"},
+			rcode:   dns.RcodeYXRrset,
+		},
+		"RRset does not exist": {
+			prereqs: []string{"www.example.com. 0 ANY TXT"},
+			updates: []string{"www.example.com. 60 IN TXT \"hello\""},
+			rcode:   dns.RcodeNXRrset,
+		},
+		"RRset matches": {
+			prereqs: []string{"www.example.com. 0 IN A 192.0.2.2", "www.example.com. 0 IN A 192.0.2.3"},
+			updates: []string{"www.example.com. 60 IN TXT \"hello\""},
+			name:    "www.example.com.",
+			typ:     dns.TypeTXT,
+			records: []string{"www.example.com.\t60\tIN\tTXT\t\"hello\""},
+			serial:  2,
+		},
+		"RRset differs": {
+			prereqs: []string{"www.example.com. 0 IN A 192.0.2.2"},
+			updates: []string{"www.example.com. 60 IN TXT \"hello\""},
+			rcode:   dns.RcodeNXRrset,
+		},
+		"outside of zone": {
+			updates: []string{"www.example.org. 60 IN A 192.0.2.10"},
+			rcode:   dns.RcodeNotZone,
+		},
+		"unsupported type": {
+			updates: []string{"www.example.com. 60 IN PTR example.com."},
+			rcode:   dns.RcodeRefused,
+		},
+		"delegation": {
+			updates: []string{"sub.example.com. 60 IN NS ns.example.com."},
+			rcode:   dns.RcodeRefused,
+		},
+	}
+
+	for name, test := range table {
+		zones := makeUpdateZones(t)
+
+		rcode, err := UpdateZone(zones, makeUpdate(t, test.prereqs, test.updates))
+		if rcode != test.rcode {
+			t.Fatalf("%q: unexpected rcode %s: %v", name, dns.RcodeToString[rcode], err)
+		}
+
+		if rcode != dns.RcodeSuccess {
+			if err == nil {
+				t.Fatalf("%q: failed without an error", name)
+			}
+
+			continue
+		}
+
+		zone := zones["example.com."]
+
+		if zone.SOA.Serial != test.serial {
+			t.Fatalf("%q: unexpected serial %d", name, zone.SOA.Serial)
+		}
+
+		records := []string{}
+		for _, rr := range newZoneUpdate("example.com.", zone).rrset(test.name, test.typ) {
+			records = append(records, rr.String())
+		}
+
+		if strings.Join(records, "\n") != strings.Join(test.records, "\n") {
+			t.Fatalf("%q: unexpected records:\n%s", name, strings.Join(records, "\n"))
+		}
+	}
+}
+
+func TestUpdateZoneErrors(t *testing.T) {
+	zones := makeUpdateZones(t)
+
+	m := makeUpdate(t, nil, []string{"www.example.org. 60 IN A 192.0.2.10"})
+	m.SetUpdate("example.org.")
+
+	if rcode, _ := UpdateZone(zones, m); rcode != dns.RcodeNotAuth {
+		t.Fatalf("Update of a zone we do not have yielded %s", dns.RcodeToString[rcode])
+	}
+
+	m = makeUpdate(t, []string{"www.example.com. 60 IN A 192.0.2.2"}, nil)
+
+	if rcode, _ := UpdateZone(zones, m); rcode != dns.RcodeFormatError {
+		t.Fatalf("Prerequisite with a TTL yielded %s", dns.RcodeToString[rcode])
+	}
+}
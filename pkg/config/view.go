@@ -0,0 +1,234 @@
+package config
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+)
+
+// View gives clients in some networks their own version of zones: its records
+// replace the records of the same name and type in the zone, and the rest are
+// added to it. This is split-horizon DNS, e.g. giving internal clients the
+// private addresses of names the internet sees public addresses for.
+type View struct {
+	// Networks are the IPs and networks in CIDR notation of the clients the
+	// view is for. When several views match a client, the one with the most
+	// specific network wins.
+	Networks []string `json:"networks"`
+	// ClientSubnet matches the EDNS Client Subnet option of queries carrying
+	// one, instead of the address they came from. Only enable it if the
+	// resolvers sending it are trusted to tell the truth.
+	ClientSubnet bool `json:"client_subnet,omitempty"`
+	// Zones maps the names of zones in the configuration to the records
+	// overriding theirs.
+	Zones map[string]*ViewZone `json:"zones"`
+}
+
+type ViewZone struct {
+	Records []*Record `json:"records"`
+}
+
+// Match yields the prefix length of the most specific of the view's networks
+// holding the address, or -1 if none do.
+func (v *View) Match(ip net.IP) int {
+	best := -1
+
+	for _, network := range v.Networks {
+		var ones int
+
+		if _, ipnet, err := net.ParseCIDR(network); err == nil {
+			if !ipnet.Contains(ip) {
+				continue
+			}
+
+			ones, _ = ipnet.Mask.Size()
+		} else if addr := net.ParseIP(network); addr != nil && addr.Equal(ip) {
+			ones = 8 * len(addr.To16())
+			if addr.To4() != nil {
+				ones = 8 * net.IPv4len
+			}
+		} else {
+			continue
+		}
+
+		if ones > best {
+			best = ones
+		}
+	}
+
+	return best
+}
+
+// Apply yields the zones as the view sees them. Zones the view does not
+// override are shared with the ones given; the rest are copies with the
+// records merged.
+func (v *View) Apply(zones map[string]*Zone) map[string]*Zone {
+	overrides := map[string]*ViewZone{}
+	for name, vz := range v.Zones {
+		overrides[addDot(name)] = vz
+	}
+
+	viewed := map[string]*Zone{}
+
+	for name, zone := range zones {
+		vz, ok := overrides[addDot(name)]
+		if !ok {
+			viewed[name] = zone
+			continue
+		}
+
+		replaced := map[string]struct{}{}
+		for _, rec := range vz.Records {
+			replaced[addDot(rec.Name)+"/"+rec.Type] = struct{}{}
+		}
+
+		newZone := *zone
+		newZone.Records = []*Record{}
+
+		for _, rec := range zone.Records {
+			if _, ok := replaced[addDot(rec.Name)+"/"+rec.Type]; !ok {
+				newZone.Records = append(newZone.Records, rec)
+			}
+		}
+
+		newZone.Records = append(newZone.Records, vz.Records...)
+		viewed[name] = &newZone
+	}
+
+	return viewed
+}
+
+// validateViews parses the records of the views, and checks that they make
+// sense alongside the records of the zones they override.
+func (c *Config) validateViews() error {
+	zones := map[string]*Zone{}
+	for name, zone := range c.Zones {
+		zones[addDot(name)] = zone
+	}
+
+	for name, view := range c.Views {
+		if len(view.Networks) == 0 {
+			return fmt.Errorf("View %q has no networks", name)
+		}
+
+		if err := validateAllowList(view.Networks); err != nil {
+			return fmt.Errorf("View %q: %w", name, err)
+		}
+
+		for zoneName, vz := range view.Zones {
+			zone, ok := zones[addDot(zoneName)]
+			if !ok {
+				return fmt.Errorf("View %q overrides zone %q, which is not configured", name, zoneName)
+			}
+
+			for _, r := range vz.Records {
+				if !dns.IsSubDomain(addDot(zoneName), addDot(r.Name)) {
+					return fmt.Errorf("Record %q in view %q is not in zone %q", r.Name, name, zoneName)
+				}
+
+				if err := r.convert(zone); err != nil {
+					return fmt.Errorf("In view %q: %w", name, err)
+				}
+			}
+		}
+
+		for zoneName, zone := range view.Apply(c.Zones) {
+			if err := validateCNAMEs(zoneName, zone); err != nil {
+				return fmt.Errorf("In view %q: %w", name, err)
+			}
+		}
+	}
+
+	return c.validateListeners()
+}
+
+// validateListeners checks that no two LB records, in zones or views, share a
+// listener. A balancer is started for each listener, and only one can have it.
+func (c *Config) validateListeners() error {
+	listeners := map[string]string{}
+
+	check := func(where string, records []*Record) error {
+		for _, r := range records {
+			lb, ok := r.Value.(*dnsconfig.LB)
+			if !ok {
+				continue
+			}
+
+			for _, listener := range lb.Listeners {
+				record := fmt.Sprintf("%q in %s", r.Name, where)
+
+				for _, addr := range c.listenerAddrs(listener) {
+					if other, ok := listeners[addr]; ok {
+						return fmt.Errorf("LB records %s and %s both listen on %q; each needs listeners of its own", other, record, addr)
+					}
+
+					listeners[addr] = record
+				}
+			}
+		}
+
+		return nil
+	}
+
+	for name, zone := range c.Zones {
+		if err := check(fmt.Sprintf("zone %q", name), zone.Records); err != nil {
+			return err
+		}
+	}
+
+	for name, view := range c.Views {
+		for zoneName, vz := range view.Zones {
+			if err := check(fmt.Sprintf("view %q of zone %q", name, zoneName), vz.Records); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Records yields the records of every zone and view.
+func (c *Config) Records() []*Record {
+	records := []*Record{}
+
+	for _, zone := range c.Zones {
+		records = append(records, zone.Records...)
+	}
+
+	for _, view := range c.Views {
+		for _, vz := range view.Zones {
+			records = append(records, vz.Records...)
+		}
+	}
+
+	return records
+}
+
+// listenerAddrs yields the addresses a listener is bound to: one for each IP
+// of the peer it names, or the IP it is given. Listeners that are neither are
+// taken as they are.
+func (c *Config) listenerAddrs(listener string) []string {
+	host, port, err := net.SplitHostPort(listener)
+	if err != nil {
+		return []string{listener}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{net.JoinHostPort(ip.String(), port)}
+	}
+
+	peer, err := c.FindPeer(host)
+	if err != nil {
+		return []string{listener}
+	}
+
+	addrs := []string{}
+
+	for _, ip := range peer.IPs {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+
+	return addrs
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"net"
+	"testing"
+
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/go-jose/go-jose/v3"
+)
+
+func makeViewConfig(view *View) Config {
+	return Config{
+		Zones: map[string]*Zone{
+			"test.home.arpa": {
+				SOA: &dnsconfig.SOA{Domain: "test.home.arpa", MinTTL: 60},
+				NS:  &dnsconfig.NS{Servers: []string{"test.home.arpa"}},
+				Records: []*Record{
+					{Type: dnsconfig.TypeA, Name: "foo.test.home.arpa", LiteralValue: map[string]any{"addresses": []string{"192.0.2.1"}}},
+					{Type: dnsconfig.TypeAAAA, Name: "foo.test.home.arpa", LiteralValue: map[string]any{"addresses": []string{"2001:db8::1"}}},
+					{Type: dnsconfig.TypeA, Name: "bar.test.home.arpa", LiteralValue: map[string]any{"addresses": []string{"192.0.2.2"}}},
+				},
+			},
+		},
+		Views: map[string]*View{"internal": view},
+	}
+}
+
+func TestViewValidation(t *testing.T) {
+	records := func(records ...*Record) map[string]*ViewZone {
+		return map[string]*ViewZone{"test.home.arpa": {Records: records}}
+	}
+
+	table := map[string]struct {
+		view  *View
+		valid bool
+	}{
+		"override": {
+			view: &View{
+				Networks: []string{"10.0.0.0/8", "::1"},
+				Zones:    records(&Record{Type: dnsconfig.TypeA, Name: "foo.test.home.arpa", LiteralValue: map[string]any{"addresses": []string{"10.0.0.1"}}}),
+			},
+			valid: true,
+		},
+		"no networks": {
+			view: &View{
+				Zones: records(&Record{Type: dnsconfig.TypeA, Name: "foo.test.home.arpa", LiteralValue: map[string]any{"addresses": []string{"10.0.0.1"}}}),
+			},
+		},
+		"bad network": {
+			view: &View{
+				Networks: []string{"internal"},
+				Zones:    records(&Record{Type: dnsconfig.TypeA, Name: "foo.test.home.arpa", LiteralValue: map[string]any{"addresses": []string{"10.0.0.1"}}}),
+			},
+		},
+		"unknown zone": {
+			view: &View{
+				Networks: []string{"10.0.0.0/8"},
+				Zones:    map[string]*ViewZone{"other.home.arpa": {Records: []*Record{}}},
+			},
+		},
+		"record outside of zone": {
+			view: &View{
+				Networks: []string{"10.0.0.0/8"},
+				Zones:    records(&Record{Type: dnsconfig.TypeA, Name: "foo.other.home.arpa", LiteralValue: map[string]any{"addresses": []string{"10.0.0.1"}}}),
+			},
+		},
+		"bad record": {
+			view: &View{
+				Networks: []string{"10.0.0.0/8"},
+				Zones:    records(&Record{Type: dnsconfig.TypeA, Name: "foo.test.home.arpa", LiteralValue: map[string]any{}}),
+			},
+		},
+		"LB on a listener of the zone": {
+			view: &View{
+				Networks: []string{"10.0.0.0/8"},
+				Zones:    records(&Record{Type: dnsconfig.TypeLB, Name: "lb.test.home.arpa", LiteralValue: map[string]any{"listeners": []string{"peer:8080"}, "kind": "tcp", "backends": []string{"10.0.0.2:80"}}}),
+			},
+		},
+		"LB on the address of a listener of the zone": {
+			view: &View{
+				Networks: []string{"10.0.0.0/8"},
+				Zones:    records(&Record{Type: dnsconfig.TypeLB, Name: "lb.test.home.arpa", LiteralValue: map[string]any{"listeners": []string{"127.0.0.1:8080"}, "kind": "tcp", "backends": []string{"10.0.0.2:80"}}}),
+			},
+		},
+		"LB on a listener of its own": {
+			view: &View{
+				Networks: []string{"10.0.0.0/8"},
+				Zones:    records(&Record{Type: dnsconfig.TypeLB, Name: "lb.test.home.arpa", LiteralValue: map[string]any{"listeners": []string{"peer:8081"}, "kind": "tcp", "backends": []string{"10.0.0.2:80"}}}),
+			},
+			valid: true,
+		},
+		"CNAME next to zone records": {
+			view: &View{
+				Networks: []string{"10.0.0.0/8"},
+				Zones:    records(&Record{Type: dnsconfig.TypeCNAME, Name: "foo.test.home.arpa", LiteralValue: map[string]any{"target": "bar.test.home.arpa"}}),
+			},
+		},
+	}
+
+	for name, test := range table {
+		config := makeViewConfig(test.view)
+		config.Peers = []*Peer{{Key: &jose.JSONWebKey{KeyID: "peer"}, IPs: []net.IP{net.ParseIP("127.0.0.1")}}}
+		// only one LB record may have a listener, whether in a zone or a view,
+		// and whether it is given by the peer's name or its address.
+		zone := config.Zones["test.home.arpa"]
+		zone.Records = append(zone.Records, &Record{Type: dnsconfig.TypeLB, Name: "lb.test.home.arpa", LiteralValue: map[string]any{"listeners": []string{"peer:8080"}, "kind": "tcp", "backends": []string{"192.0.2.3:80"}}})
+
+		err := config.convertLiterals()
+		if test.valid && err != nil {
+			t.Fatalf("%q should be valid: %v", name, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%q should not be valid", name)
+		}
+	}
+}
+
+func TestViewApply(t *testing.T) {
+	view := &View{
+		Networks: []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3"},
+		Zones: map[string]*ViewZone{"test.home.arpa": {Records: []*Record{
+			{Type: dnsconfig.TypeA, Name: "foo.test.home.arpa", LiteralValue: map[string]any{"addresses": []string{"10.0.0.1"}}},
+			{Type: dnsconfig.TypeA, Name: "internal.test.home.arpa", LiteralValue: map[string]any{"addresses": []string{"10.0.0.2"}}},
+		}}},
+	}
+
+	config := makeViewConfig(view)
+
+	if err := config.convertLiterals(); err != nil {
+		t.Fatal(err)
+	}
+
+	config.decorateZones()
+
+	zones := view.Apply(config.Zones)
+	zone := zones["test.home.arpa."]
+
+	if zone == config.Zones["test.home.arpa."] {
+		t.Fatal("Zone was changed in place")
+	}
+
+	records := map[string]string{}
+	for _, rec := range zone.Records {
+		records[rec.Name+"/"+rec.Type] = rec.Value.Convert(rec.Name)[0].String()
+	}
+
+	expected := map[string]string{
+		"foo.test.home.arpa./A":      "foo.test.home.arpa.\t60\tIN\tA\t10.0.0.1",
+		"foo.test.home.arpa./AAAA":   "foo.test.home.arpa.\t60\tIN\tAAAA\t2001:db8::1",
+		"bar.test.home.arpa./A":      "bar.test.home.arpa.\t60\tIN\tA\t192.0.2.2",
+		"internal.test.home.arpa./A": "internal.test.home.arpa.\t60\tIN\tA\t10.0.0.2",
+	}
+
+	if len(records) != len(expected) {
+		t.Fatalf("Unexpected records in view: %v", records)
+	}
+
+	for key, rr := range expected {
+		if records[key] != rr {
+			t.Fatalf("Unexpected record for %q in view: %q", key, records[key])
+		}
+	}
+
+	matches := map[string]int{
+		"10.1.2.3":  32,
+		"10.1.2.4":  16,
+		"10.2.0.1":  8,
+		"192.0.2.1": -1,
+	}
+
+	for ip, expected := range matches {
+		if match := view.Match(net.ParseIP(ip)); match != expected {
+			t.Fatalf("%q matched with a prefix of %d, expected %d", ip, match, expected)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package controlserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/erikh/border/pkg/dnsserver"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// ACMEChallengeTTL is the TTL of the TXT records published for DNS-01
+// challenges. They only live as long as the validation, so resolvers should
+// not hold on to them.
+const ACMEChallengeTTL = 60
+
+// ACMEChallengeLifetime is how long challenge tokens added by dynamic updates
+// are kept, should the ACME client never clear them.
+const ACMEChallengeLifetime = time.Hour
+
+// how often the publisher looks for expired challenge tokens.
+const acmePruneInterval = time.Minute
+
+const acmeChallengeLabel = "_acme-challenge."
+
+// ACMEChallenge publishes a DNS-01 challenge token for the name, or removes it
+// if remove is set. The change is made as a dynamic update, so it is applied by
+// the publisher and reaches every peer with the next configuration. This
+// returns once every peer's DNS server serves the change, as the ACME server
+// may ask any of them once it is told to look for it.
+func (s *Server) ACMEChallenge(name, token string, remove bool) error {
+	name = dns.CanonicalName(name)
+	if !strings.HasPrefix(name, acmeChallengeLabel) {
+		name = acmeChallengeLabel + name
+	}
+
+	zones, err := s.config.ConfiguredZones()
+	if err != nil {
+		return fmt.Errorf("Error parsing configured zones: %w", err)
+	}
+
+	var (
+		apex    string
+		longest = -1
+	)
+
+	for zone := range zones {
+		if labels := dns.CountLabel(zone); labels > longest && dns.IsSubDomain(zone, name) {
+			apex = zone
+			longest = labels
+		}
+	}
+
+	if apex == "" {
+		return fmt.Errorf("No zone holds %q", name)
+	}
+
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ACMEChallengeTTL},
+		Txt: []string{token},
+	}
+
+	update := &dns.Msg{}
+	update.SetUpdate(apex)
+
+	if remove {
+		update.Remove([]dns.RR{rr})
+	} else {
+		update.Insert([]dns.RR{rr})
+	}
+
+	rcode, serial, err := s.sendUpdate(update)
+	if err != nil {
+		return fmt.Errorf("Could not update challenge for %q: %w", name, err)
+	}
+
+	if rcode != dns.RcodeSuccess {
+		return fmt.Errorf("Could not update challenge for %q: %s", name, dns.RcodeToString[rcode])
+	}
+
+	s.configMutex.RLock()
+	addrs, err := peerDNSAddrs(s.config.Listen.DNS, s.config.Peers)
+	s.configMutex.RUnlock()
+
+	if err != nil {
+		return fmt.Errorf("Challenge for %q was updated, but its DNS servers are unknown: %w", name, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsserver.NotifyTimeout)
+	defer cancel()
+
+	// followers take the configuration in their own time, so each of them
+	// is asked until it has caught up.
+	for _, addr := range addrs {
+		if err := dnsserver.WaitForSerial(ctx, addr, apex, serial, s.notifyInterval); err != nil {
+			return fmt.Errorf("Challenge for %q was updated, but is not served yet: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// peerDNSAddrs lists the addresses the peers answer DNS on, one for each of
+// their IPs on the port of the listen spec they share.
+func peerDNSAddrs(listenSpec string, peers []*config.Peer) ([]string, error) {
+	_, port, err := net.SplitHostPort(listenSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []string{}
+
+	for _, peer := range peers {
+		for _, ip := range peer.IPs {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	return addrs, nil
+}
+
+// acmeChallengeKey identifies a challenge token published for a name.
+func acmeChallengeKey(name, token string) string {
+	return dns.CanonicalName(name) + " " + token
+}
+
+// acmeChallenges collects the challenge tokens published in a zone.
+func acmeChallenges(zone *config.Zone) map[string]bool {
+	ret := map[string]bool{}
+
+	for _, rec := range zone.Records {
+		txt, ok := rec.Value.(*dnsconfig.TXT)
+		if !ok || !strings.HasPrefix(dns.CanonicalName(rec.Name), acmeChallengeLabel) {
+			continue
+		}
+
+		for _, token := range txt.Values {
+			ret[acmeChallengeKey(rec.Name, token)] = true
+		}
+	}
+
+	return ret
+}
+
+// trackACMEChallenges gives the challenge tokens added to the zones since
+// oldZones a deadline, and forgets the deadlines of tokens that are gone.
+// Tokens that were already there, e.g. from the configuration, are left alone.
+func trackACMEChallenges(oldZones, zones map[string]*config.Zone, now time.Time) {
+	for name, zone := range zones {
+		tokens := acmeChallenges(zone)
+
+		old := map[string]bool{}
+		if oldZone, ok := oldZones[name]; ok {
+			old = acmeChallenges(oldZone)
+		}
+
+		tracked := []*config.ACMEChallenge{}
+
+		for _, challenge := range zone.ACMEChallenges {
+			key := acmeChallengeKey(challenge.Name, challenge.Token)
+			if tokens[key] {
+				tracked = append(tracked, challenge)
+				delete(tokens, key)
+			}
+		}
+
+		for _, rec := range zone.Records {
+			txt, ok := rec.Value.(*dnsconfig.TXT)
+			if !ok {
+				continue
+			}
+
+			for _, token := range txt.Values {
+				key := acmeChallengeKey(rec.Name, token)
+				if tokens[key] && !old[key] {
+					tracked = append(tracked, &config.ACMEChallenge{Name: dns.CanonicalName(rec.Name), Token: token, Expires: now.Add(ACMEChallengeLifetime)})
+					delete(tokens, key)
+				}
+			}
+		}
+
+		if len(tracked) == 0 {
+			tracked = nil
+		}
+
+		zone.ACMEChallenges = tracked
+	}
+}
+
+// pruneACMEChallenges removes the challenge tokens whose deadline has passed
+// from the zones, the same way a dynamic update clearing them would.
+func pruneACMEChallenges(zones map[string]*config.Zone, now time.Time) error {
+	for name, zone := range zones {
+		update := &dns.Msg{}
+		update.SetUpdate(dns.CanonicalName(name))
+
+		for _, challenge := range zone.ACMEChallenges {
+			if now.Before(challenge.Expires) {
+				continue
+			}
+
+			update.Remove([]dns.RR{&dns.TXT{
+				Hdr: dns.RR_Header{Name: challenge.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ACMEChallengeTTL},
+				Txt: []string{challenge.Token},
+			}})
+		}
+
+		if len(update.Ns) == 0 {
+			continue
+		}
+
+		if _, err := config.UpdateZone(zones, update); err != nil {
+			return fmt.Errorf("Could not remove expired challenges from %q: %w", name, err)
+		}
+
+		logrus.Infof("Removed %d expired ACME challenge(s) from %q", len(update.Ns), name)
+	}
+
+	return nil
+}
+
+// expireACMEChallenges periodically removes expired challenge tokens, for when
+// no other update comes along to do it. Only the publisher changes zones.
+func (s *Server) expireACMEChallenges(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(acmePruneInterval):
+		}
+
+		if publisher := s.config.GetPublisher(); publisher == nil || publisher.Name() != s.me.Name() {
+			continue
+		}
+
+		if _, err := s.changeZones(func(map[string]*config.Zone) (int, error) { return dns.RcodeSuccess, nil }); err != nil {
+			logrus.Errorf("While expiring ACME challenges: %v", err)
+		}
+	}
+}
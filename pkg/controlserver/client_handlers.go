@@ -1,10 +1,13 @@
 package controlserver
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/erikh/border/pkg/api"
 	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsserver"
+	"github.com/miekg/dns"
 )
 
 func (s *Server) handleAuthCheck(req api.Request) (api.Message, error) {
@@ -53,3 +56,62 @@ func (s *Server) handleIdentifyPublisher(req api.Request) (api.Message, error) {
 	resp.Publisher = publisher.Name()
 	return resp, nil
 }
+
+func (s *Server) handleExportZone(req api.Request) (api.Message, error) {
+	ezr := req.(*api.ExportZoneRequest)
+
+	var zones map[string]*config.Zone
+
+	if ezr.Configured {
+		var err error
+
+		zones, err = s.config.ConfiguredZones()
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing configured zones: %w", err)
+		}
+	} else {
+		// dynamic updates and reloads replace the zones as we go, so the zone
+		// is copied while they wait.
+		zones = map[string]*config.Zone{}
+
+		name := dns.CanonicalName(ezr.Zone)
+		if zone := s.config.Zone(name); zone != nil {
+			zones[name] = zone
+		}
+	}
+
+	ds := &dnsserver.DNSServer{Zones: zones, Config: s.config}
+
+	zone, err := ds.Export(ezr.Zone)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := req.Response().(*api.ExportZoneResponse)
+	resp.Zone = zone
+	return resp, nil
+}
+
+func (s *Server) handleACMEChallenge(req api.Request) (api.Message, error) {
+	acr := req.(*api.ACMEChallengeRequest)
+
+	if acr.Name == "" || acr.Token == "" {
+		return nil, errors.New("A name and token are required")
+	}
+
+	return req.Response(), s.ACMEChallenge(acr.Name, acr.Token, acr.Clear)
+}
+
+func (s *Server) handleRRLCounters(req api.Request) (api.Message, error) {
+	resp := req.Response().(*api.RRLCountersResponse)
+
+	if s.rrlStats != nil {
+		counters := s.rrlStats.Counters()
+
+		resp.Responses = counters.Responses
+		resp.Dropped = counters.Dropped
+		resp.Slipped = counters.Slipped
+	}
+
+	return resp, nil
+}
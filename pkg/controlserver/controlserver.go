@@ -13,8 +13,10 @@ import (
 
 	"github.com/erikh/border/pkg/api"
 	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsserver"
 	"github.com/erikh/go-hashchain"
 	"github.com/go-jose/go-jose/v3"
+	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
@@ -40,6 +42,13 @@ type Server struct {
 	expireTime  time.Duration
 	nonceMutex  sync.RWMutex
 	configMutex sync.RWMutex
+	// dynamic updates are applied one at a time.
+	updateMutex sync.Mutex
+	// how often to retry NOTIFY messages to secondaries; like expireTime, this
+	// is only changed in tests.
+	notifyInterval time.Duration
+	// counters of the DNS server's rate limiting, which outlive it.
+	rrlStats *dnsserver.RRLStats
 
 	cancelSupervision context.CancelFunc
 }
@@ -74,6 +83,7 @@ func Start(config *config.Config, me *config.Peer, listenSpec string, expireTime
 		config:            config,
 		cancelSupervision: cancel,
 		expireTime:        expireTime,
+		notifyInterval:    dnsserver.NotifyInterval,
 		bootTime:          time.Now(),
 		me:                me,
 		debugPayload:      debug && os.Getenv("DEBUG_LOG_PAYLOAD") != "",
@@ -82,6 +92,7 @@ func Start(config *config.Config, me *config.Peer, listenSpec string, expireTime
 	s := &http.Server{Handler: server.configureMux()}
 
 	go server.expireNonces(ctx)
+	go server.expireACMEChallenges(ctx)
 	go func() {
 		errChan <- s.Serve(l)
 	}()
@@ -178,6 +189,9 @@ func (s *Server) configureMux() *http.ServeMux {
 	s.makeHandlerFunc(mux, http.MethodPut, &api.ConfigReloadRequest{}, s.config.AuthKey, s.handleConfigReload)
 	s.makeHandlerFunc(mux, http.MethodPut, &api.PeerRegistrationRequest{}, s.config.AuthKey, s.handlePeerRegister)
 	s.makeHandlerFunc(mux, http.MethodPut, &api.IdentifyPublisherRequest{}, s.config.AuthKey, s.handleIdentifyPublisher)
+	s.makeHandlerFunc(mux, http.MethodPut, &api.ExportZoneRequest{}, s.config.AuthKey, s.handleExportZone)
+	s.makeHandlerFunc(mux, http.MethodPut, &api.ACMEChallengeRequest{}, s.config.AuthKey, s.handleACMEChallenge)
+	s.makeHandlerFunc(mux, http.MethodPut, &api.RRLCountersRequest{}, s.config.AuthKey, s.handleRRLCounters)
 
 	// peer to peer client methods
 	s.makeHandlerFunc(mux, http.MethodGet, &api.PeerNonceRequest{}, s.me.Key, s.handleNonce)
@@ -185,17 +199,89 @@ func (s *Server) configureMux() *http.ServeMux {
 	s.makeHandlerFunc(mux, http.MethodPut, &api.PingRequest{}, s.me.Key, s.handlePing)
 	s.makeHandlerFunc(mux, http.MethodPut, &api.ConfigChainRequest{}, s.me.Key, s.handleConfigChain)
 	s.makeHandlerFunc(mux, http.MethodPut, &api.ConfigFetchRequest{}, s.me.Key, s.handleConfigFetch)
+	s.makeHandlerFunc(mux, http.MethodPut, &api.ZoneUpdateRequest{}, s.me.Key, s.handleZoneUpdate)
 
 	return mux
 }
 
+// SetRRLStats gives the server the counters of the DNS server's rate limiting,
+// to report through the control API.
+func (s *Server) SetRRLStats(stats *dnsserver.RRLStats) {
+	s.rrlStats = stats
+}
+
+// ReplaceConfig takes on a new configuration, with the chain of generations it
+// belongs to. The publisher makes any DNSSEC keys the configuration lacks, and
+// adds the result to the chain as a new generation for the other peers to
+// fetch. The others take the configuration exactly as it was published, so
+// that it matches its generation, and serve zones without keys unsigned until
+// the publisher's keys reach them.
 func (s *Server) ReplaceConfig(newConfig *config.Config, newChain *hashchain.Chain) error {
+	s.updateMutex.Lock()
+	defer s.updateMutex.Unlock()
+
+	publisher := s.config.GetPublisher()
+	publishing := publisher != nil && publisher.Name() == s.me.Name()
+
 	s.configMutex.Lock()
-	newConfig.SetChain(newChain)
+	oldZones := s.config.Zones
+
+	// keys left out of the new configuration are carried over, or made.
+	if publishing {
+		if _, err := newConfig.GenerateDNSSECKeys(oldZones); err != nil {
+			s.configMutex.Unlock()
+			return err
+		}
+	}
+
 	s.config.CopyFrom(newConfig)
+	s.config.SetChain(newChain)
+
+	// saving changes the zones in place, so take what notifying needs now.
+	notify := notifications(newConfig.Zones, config.ChangedZones(oldZones, newConfig.Zones))
+	listen := newConfig.Listen.DNS
 	s.configMutex.Unlock()
 
-	return s.saveConfig()
+	if err := s.config.Save(); err != nil {
+		return fmt.Errorf("Could not save configuration: %v", err)
+	}
+
+	if publishing {
+		if err := s.config.AddGeneration(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.config.Reload(); err != nil {
+		return fmt.Errorf("While reloading configuration: %v", err)
+	}
+
+	// every peer takes the publisher's configuration, so only the publisher
+	// notifies, or secondaries would transfer once for each peer.
+	if publishing {
+		s.notify(listen, notify)
+	}
+
+	return nil
+}
+
+// GenerateDNSSECKeys makes the keys of zones signed with DNSSEC which have none
+// yet, and publishes them as a new generation of the configuration. Only the
+// publisher makes keys, so that every peer signs with the same ones.
+func (s *Server) GenerateDNSSECKeys() error {
+	if publisher := s.config.GetPublisher(); publisher == nil || publisher.Name() != s.me.Name() {
+		return errors.New("Only the publisher may generate DNSSEC keys")
+	}
+
+	_, err := s.changeZones(func(zones map[string]*config.Zone) (int, error) {
+		if _, err := (&config.Config{Zones: zones}).GenerateDNSSECKeys(nil); err != nil {
+			return dns.RcodeServerFailure, err
+		}
+
+		return dns.RcodeSuccess, nil
+	})
+
+	return err
 }
 
 func (s *Server) saveConfig() error {
@@ -9,15 +9,20 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/erikh/border/pkg/api"
 	"github.com/erikh/border/pkg/config"
 	"github.com/erikh/border/pkg/controlclient"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/erikh/border/pkg/dnsserver"
 	"github.com/erikh/border/pkg/josekit"
 	"github.com/erikh/go-hashchain"
 	"github.com/go-jose/go-jose/v3"
+	"github.com/miekg/dns"
 )
 
 func makeConfig(t *testing.T) *config.Config {
@@ -274,3 +279,550 @@ func TestPeerRegistration(t *testing.T) {
 		t.Fatal("never found peer")
 	}
 }
+
+func TestExportZone(t *testing.T) {
+	c := makeConfig(t)
+	c.Zones = map[string]*config.Zone{
+		"test.home.arpa.": {
+			SOA: &dnsconfig.SOA{
+				Domain:  "test.home.arpa.",
+				Admin:   "administrator.test.home.arpa.",
+				MinTTL:  60,
+				Serial:  1,
+				Refresh: 60,
+				Retry:   60,
+				Expire:  60,
+			},
+			NS: &dnsconfig.NS{
+				Servers: []string{"test.home.arpa."},
+				TTL:     60,
+			},
+			Records: []*config.Record{
+				{
+					Name:         "foo.test.home.arpa.",
+					Type:         dnsconfig.TypeA,
+					LiteralValue: map[string]any{"addresses": []string{"127.0.0.1", "127.0.0.2"}},
+					// as a health check would leave it
+					Value: &dnsconfig.A{
+						Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+						TTL:       60,
+					},
+				},
+			},
+		},
+	}
+
+	server, err := Start(c, c.Peers[0], ":0", 10*time.Millisecond, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx) // nolint:errcheck
+	})
+
+	client := makeClient(server.listener.Addr().String(), c.AuthKey)
+
+	table := map[bool][]string{
+		false: {"127.0.0.1"},
+		true:  {"127.0.0.1", "127.0.0.2"},
+	}
+
+	for configured, expected := range table {
+		resp, err := client.Exchange(&api.ExportZoneRequest{Zone: "test.home.arpa", Configured: configured}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		zone, unsupported, err := config.ImportZone("test.home.arpa", strings.NewReader(resp.(*api.ExportZoneResponse).Zone), "export")
+		if err != nil {
+			t.Fatalf("Exported zone could not be read back: %v", err)
+		}
+
+		if len(unsupported) != 0 {
+			t.Fatalf("Unexpected records in exported zone: %v", unsupported)
+		}
+
+		addresses := []string{}
+		for _, ip := range zone.Records[0].Value.(*dnsconfig.A).Addresses {
+			addresses = append(addresses, ip.String())
+		}
+
+		if !reflect.DeepEqual(addresses, expected) {
+			t.Fatalf("Unexpected addresses (configured: %v): %v", configured, addresses)
+		}
+	}
+
+	if _, err := client.Exchange(&api.ExportZoneRequest{Zone: "other.home.arpa"}, false); err == nil {
+		t.Fatal("Exporting an unknown zone did not fail")
+	}
+}
+
+// startPublisher starts a server, which is the publisher, with a zone that
+// takes dynamic updates.
+func startPublisher(t *testing.T) (*config.Config, *Server) {
+	c := makeConfig(t)
+	c.Zones = map[string]*config.Zone{
+		"test.home.arpa.": {
+			SOA: &dnsconfig.SOA{
+				Domain:  "test.home.arpa.",
+				Admin:   "administrator.test.home.arpa.",
+				MinTTL:  60,
+				Serial:  1,
+				Refresh: 60,
+				Retry:   60,
+				Expire:  60,
+			},
+			NS: &dnsconfig.NS{
+				Servers: []string{"test.home.arpa."},
+				TTL:     60,
+			},
+			Update:  &config.Update{TSIG: map[string]string{"update.": "c2VjcmV0"}},
+			Records: []*config.Record{},
+		},
+	}
+
+	c.SetPublisher(c.Peers[0])
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := Start(c, c.Peers[0], ":0", 10*time.Millisecond, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx) // nolint:errcheck
+	})
+
+	return c, server
+}
+
+func waitReload(t *testing.T, server *Server) {
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Reload was never triggered")
+	case <-server.config.ReloadChan():
+	}
+}
+
+func TestZoneUpdate(t *testing.T) {
+	c, server := startPublisher(t)
+
+	update := &dns.Msg{}
+	update.SetUpdate("test.home.arpa.")
+	update.Insert([]dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "foo.test.home.arpa.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("127.0.0.1"),
+	}})
+
+	packed, err := update.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := makeClient(server.listener.Addr().String(), c.AuthKey)
+
+	resp, err := client.Exchange(&api.ZoneUpdateRequest{Update: packed}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zur := resp.(*api.ZoneUpdateResponse); zur.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Update failed with %s: %v", dns.RcodeToString[zur.Rcode], zur.Error)
+	}
+
+	waitReload(t, server)
+
+	zone := server.config.Zones["test.home.arpa."]
+
+	if zone.SOA.Serial != 2 {
+		t.Fatalf("Serial was not incremented: %d", zone.SOA.Serial)
+	}
+
+	if len(zone.Records) != 1 || zone.Records[0].Name != "foo.test.home.arpa." {
+		t.Fatalf("Record was not added: %v", zone.Records)
+	}
+
+	if len(server.config.Chain().AllSums()) != 1 {
+		t.Fatal("Update was not added to the chain")
+	}
+}
+
+func TestSendUpdate(t *testing.T) {
+	c, publisher := startPublisher(t)
+	c.Peers[0].ControlServer = publisher.listener.Addr().String()
+
+	jwk, err := josekit.MakeKey("follower")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	followerConfig := makeConfig(t)
+	followerConfig.Peers = []*config.Peer{c.Peers[0], {Key: jwk, IPs: []net.IP{net.ParseIP("127.0.0.1")}}}
+	followerConfig.SetPublisher(c.Peers[0])
+
+	follower, err := Start(followerConfig, followerConfig.Peers[1], ":0", 10*time.Millisecond, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		follower.Shutdown(ctx) // nolint:errcheck
+	})
+
+	update := &dns.Msg{}
+	update.SetUpdate("test.home.arpa.")
+	update.Insert([]dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "foo.test.home.arpa.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("127.0.0.1"),
+	}})
+
+	// only the publisher changes the configuration, so the follower sends it
+	// there.
+	rcode, err := follower.SendUpdate(update)
+	if err != nil || rcode != dns.RcodeSuccess {
+		t.Fatalf("Update failed with %s: %v", dns.RcodeToString[rcode], err)
+	}
+
+	waitReload(t, publisher)
+
+	if zone := publisher.config.Zones["test.home.arpa."]; len(zone.Records) != 1 || zone.Records[0].Name != "foo.test.home.arpa." {
+		t.Fatalf("Record was not added on the publisher: %v", zone.Records)
+	}
+}
+
+func TestACMEChallenge(t *testing.T) {
+	c, server := startPublisher(t)
+	client := makeClient(server.listener.Addr().String(), c.AuthKey)
+
+	// stand in for the DNS servers the launchers would restart after each
+	// reload, which challenges wait for. The follower serves the zones it had
+	// when it last caught up with the publisher.
+	dnsAddr := freeAddr(t)
+	_, port, err := net.SplitHostPort(dnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	followerZones, err := server.config.ConfiguredZones()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		followerMutex sync.Mutex
+		following     bool
+	)
+
+	catchUp := func() {
+		followerMutex.Lock()
+		defer followerMutex.Unlock()
+
+		zones, err := server.config.ConfiguredZones()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		followerZones = zones
+	}
+
+	startSOAServer(t, dnsAddr, server.config.ConfiguredZones)
+	startSOAServer(t, net.JoinHostPort("127.0.0.2", port), func() (map[string]*config.Zone, error) {
+		followerMutex.Lock()
+		defer followerMutex.Unlock()
+
+		if following {
+			return server.config.ConfiguredZones()
+		}
+
+		return followerZones, nil
+	})
+
+	jwk, err := josekit.MakeKey("bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.notifyInterval = 10 * time.Millisecond
+
+	c.Listen.DNS = dnsAddr
+	c.Peers = append(c.Peers, &config.Peer{Key: jwk, IPs: []net.IP{net.ParseIP("127.0.0.2")}})
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a wildcard and its base name share the challenge name.
+	for _, token := range []string{"token1", "token2"} {
+		errChan := make(chan error, 1)
+
+		go func() {
+			_, err := client.Exchange(&api.ACMEChallengeRequest{Name: "www.test.home.arpa", Token: token}, false)
+			errChan <- err
+		}()
+
+		waitReload(t, server)
+
+		select {
+		case err := <-errChan:
+			t.Fatalf("Challenge returned before the follower served it: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		catchUp()
+
+		select {
+		case err := <-errChan:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Challenge did not return once every peer served it")
+		}
+	}
+
+	// from here on the follower keeps up.
+	followerMutex.Lock()
+	following = true
+	followerMutex.Unlock()
+
+	// stands in for the ACME server, which looks the challenge up in DNS.
+	challenge := func() []string {
+		addr := freeAddr(t)
+
+		ds := &dnsserver.DNSServer{Zones: server.config.Zones}
+		if err := ds.Start(addr); err != nil {
+			t.Fatal(err)
+		}
+		defer ds.Shutdown() // nolint:errcheck
+
+		m := &dns.Msg{}
+		m.SetQuestion("_acme-challenge.www.test.home.arpa.", dns.TypeTXT)
+
+		client := &dns.Client{Net: "tcp", Timeout: time.Second}
+
+		r, _, err := client.Exchange(m, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tokens := []string{}
+		for _, rr := range r.Answer {
+			tokens = append(tokens, rr.(*dns.TXT).Txt...)
+		}
+
+		return tokens
+	}
+
+	if tokens := challenge(); !reflect.DeepEqual(tokens, []string{"token1", "token2"}) {
+		t.Fatalf("Unexpected challenge tokens: %v", tokens)
+	}
+
+	challenges := server.config.Zones["test.home.arpa."].ACMEChallenges
+	if len(challenges) != 2 || time.Until(challenges[0].Expires) <= 0 || time.Until(challenges[0].Expires) > ACMEChallengeLifetime {
+		t.Fatalf("Challenges were not given a deadline: %v", challenges)
+	}
+
+	if _, err := client.Exchange(&api.ACMEChallengeRequest{Name: "_acme-challenge.www.test.home.arpa.", Token: "token1", Clear: true}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	waitReload(t, server)
+
+	if tokens := challenge(); !reflect.DeepEqual(tokens, []string{"token2"}) {
+		t.Fatalf("Unexpected challenge tokens after clearing one: %v", tokens)
+	}
+
+	if challenges := server.config.Zones["test.home.arpa."].ACMEChallenges; len(challenges) != 1 || challenges[0].Token != "token2" {
+		t.Fatalf("Deadline of a cleared challenge was kept: %v", challenges)
+	}
+
+	// a token that is never cleared is removed once its deadline passes.
+	server.config.Zones["test.home.arpa."].ACMEChallenges[0].Expires = time.Now().Add(-time.Second)
+
+	if _, err := server.changeZones(func(map[string]*config.Zone) (int, error) { return dns.RcodeSuccess, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	waitReload(t, server)
+
+	if tokens := challenge(); len(tokens) != 0 {
+		t.Fatalf("Expired challenge tokens were not removed: %v", tokens)
+	}
+
+	if challenges := server.config.Zones["test.home.arpa."].ACMEChallenges; len(challenges) != 0 {
+		t.Fatalf("Deadline of an expired challenge was kept: %v", challenges)
+	}
+
+	if _, err := client.Exchange(&api.ACMEChallengeRequest{Name: "www.other.arpa", Token: "token1"}, false); err == nil {
+		t.Fatal("Challenge for a name outside of our zones did not fail")
+	}
+}
+
+// startSOAServer answers SOA queries for the zones on the address.
+func startSOAServer(t *testing.T, addr string, configured func() (map[string]*config.Zone, error)) {
+	soaServer := &dns.Server{Addr: addr, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetReply(r)
+
+		if zones, err := configured(); err == nil {
+			if zone, ok := zones[r.Question[0].Name]; ok {
+				m.Answer = zone.SOA.Convert(r.Question[0].Name)
+			}
+		}
+
+		w.WriteMsg(m) // nolint:errcheck
+	})}
+
+	started := make(chan struct{})
+	soaServer.NotifyStartedFunc = func() { close(started) }
+
+	go soaServer.ListenAndServe() // nolint:errcheck
+	<-started
+
+	t.Cleanup(func() {
+		soaServer.Shutdown() // nolint:errcheck
+	})
+}
+
+func TestReplaceConfigDNSSEC(t *testing.T) {
+	signedZone := func() *config.Zone {
+		zone := makeZone(1, "")
+		zone.Transfer = nil
+		zone.DNSSEC = &config.DNSSEC{}
+
+		return zone
+	}
+
+	c := makeConfig(t)
+	c.Zones = map[string]*config.Zone{"test.home.arpa.": signedZone()}
+	c.SetPublisher(c.Peers[0])
+
+	server, err := Start(c, c.Peers[0], ":0", 10*time.Millisecond, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx) // nolint:errcheck
+	})
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the publisher makes the keys, and publishes them as a new generation.
+	if err := server.GenerateDNSSECKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitReload(t, server)
+
+	dnssec := server.config.Zones["test.home.arpa."].DNSSEC
+	if !dnssec.Ready() || len(server.config.Chain().AllSums()) != 1 {
+		t.Fatal("Keys were not generated and published")
+	}
+
+	ds := dnssec.DS("test.home.arpa.", 60)
+
+	// a configuration without the keys must not change them, or the DS record
+	// in the parent zone would no longer match.
+	newConfig := makeConfig(t)
+	newConfig.Zones = map[string]*config.Zone{"test.home.arpa.": signedZone()}
+
+	if err := server.ReplaceConfig(newConfig, server.config.Chain()); err != nil {
+		t.Fatal(err)
+	}
+
+	waitReload(t, server)
+
+	dnssec = server.config.Zones["test.home.arpa."].DNSSEC
+	if !dnssec.Ready() || dnssec.DS("test.home.arpa.", 60).Digest != ds.Digest {
+		t.Fatal("Keys were not carried over to the new configuration")
+	}
+
+	if len(server.config.Chain().AllSums()) != 2 {
+		t.Fatal("New configuration was not added to the chain")
+	}
+
+	// other peers take the configuration as it was published, keys or not.
+	c.SetPublisher(&config.Peer{Key: &jose.JSONWebKey{KeyID: "publisher"}})
+
+	if err := server.GenerateDNSSECKeys(); err == nil {
+		t.Fatal("Peer other than the publisher generated keys")
+	}
+
+	chain := server.config.Chain()
+
+	newConfig = makeConfig(t)
+	newConfig.Zones = map[string]*config.Zone{"test.home.arpa.": signedZone()}
+
+	if err := server.ReplaceConfig(newConfig, chain); err != nil {
+		t.Fatal(err)
+	}
+
+	waitReload(t, server)
+
+	if server.config.Zones["test.home.arpa."].DNSSEC.Ready() {
+		t.Fatal("Peer other than the publisher made keys of its own")
+	}
+
+	if server.config.Chain() != chain {
+		t.Fatal("Configuration was not given the chain it was published with")
+	}
+}
+
+func TestRRLCounters(t *testing.T) {
+	c, server := startPublisher(t)
+
+	slip := uint(0)
+	stats := &dnsserver.RRLStats{}
+
+	ds := &dnsserver.DNSServer{
+		Zones:    c.Zones,
+		RRL:      &config.RRL{ResponsesPerSecond: 1, Slip: &slip},
+		RRLStats: stats,
+	}
+
+	dnsAddr := freeAddr(t)
+
+	if err := ds.Start(dnsAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	server.SetRRLStats(stats)
+
+	m := &dns.Msg{}
+	m.SetQuestion("test.home.arpa.", dns.TypeSOA)
+
+	dnsClient := &dns.Client{Net: "udp", Timeout: 100 * time.Millisecond}
+
+	for i := 0; i < 3; i++ {
+		dnsClient.Exchange(m, dnsAddr) // nolint:errcheck
+	}
+
+	client := makeClient(server.listener.Addr().String(), c.AuthKey)
+
+	resp, err := client.Exchange(&api.RRLCountersRequest{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counters := resp.(*api.RRLCountersResponse); counters.Responses != 3 || counters.Dropped != 2 || counters.Slipped != 0 {
+		t.Fatalf("Unexpected counters: %+v", counters)
+	}
+}
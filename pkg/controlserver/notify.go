@@ -0,0 +1,74 @@
+package controlserver
+
+import (
+	"context"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/erikh/border/pkg/dnsserver"
+	"github.com/sirupsen/logrus"
+)
+
+// zoneNotify is what it takes to tell the secondaries of a zone that it
+// changed, copied out of the configuration so that it can be sent after the
+// configuration is unlocked.
+type zoneNotify struct {
+	name    string
+	soa     dnsconfig.SOA
+	targets []string
+}
+
+// notifications collects the changed zones which have secondaries to notify.
+// The zones must not change while this runs, so they are either held under
+// configMutex, or not shared yet.
+func notifications(zones map[string]*config.Zone, changed []string) []zoneNotify {
+	ret := []zoneNotify{}
+
+	for _, name := range changed {
+		zone := zones[name]
+		if zone.Transfer == nil || len(zone.Transfer.Notify) == 0 {
+			continue
+		}
+
+		ret = append(ret, zoneNotify{name: name, soa: *zone.SOA, targets: zone.Transfer.Notify})
+	}
+
+	return ret
+}
+
+// notify tells the secondaries of the zones that they changed. This happens in
+// the background: the DNS server is restarted with the new zones after the
+// configuration is reloaded, and we must wait for that before secondaries ask
+// us for the new serial, which is served on listen.
+func (s *Server) notify(listen string, zones []zoneNotify) {
+	for _, zn := range zones {
+		zn := zn
+		interval := s.notifyInterval
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), dnsserver.NotifyTimeout)
+			defer cancel()
+
+			if err := dnsserver.WaitForSerial(ctx, listen, zn.name, zn.soa.Serial, interval); err != nil {
+				logrus.Errorf("Not notifying secondaries of %q: %v", zn.name, err)
+				return
+			}
+
+			for _, target := range zn.targets {
+				target := target
+
+				go func() {
+					ctx, cancel := context.WithTimeout(context.Background(), dnsserver.NotifyTimeout)
+					defer cancel()
+
+					if err := dnsserver.Notify(ctx, zn.name, &zn.soa, target, interval); err != nil {
+						logrus.Error(err)
+						return
+					}
+
+					logrus.Infof("Notified %q of changes to %q", target, zn.name)
+				}()
+			}
+		}()
+	}
+}
@@ -0,0 +1,182 @@
+package controlserver
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/erikh/border/pkg/dnsserver"
+	"github.com/erikh/border/pkg/josekit"
+	"github.com/miekg/dns"
+)
+
+func makeZone(serial uint32, secondary string) *config.Zone {
+	return &config.Zone{
+		SOA: &dnsconfig.SOA{
+			Domain:  "test.home.arpa.",
+			Admin:   "administrator.test.home.arpa.",
+			MinTTL:  60,
+			Serial:  serial,
+			Refresh: 60,
+			Retry:   60,
+			Expire:  60,
+		},
+		NS: &dnsconfig.NS{
+			Servers: []string{"test.home.arpa."},
+			TTL:     60,
+		},
+		Records:  []*config.Record{},
+		Transfer: &config.Transfer{Notify: []string{secondary}},
+	}
+}
+
+func TestNotify(t *testing.T) {
+	notifies := make(chan uint32, 10)
+
+	// the secondary fails the first notify, so that it is retried.
+	var seen atomic.Bool
+
+	secondary := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetReply(r)
+
+		if !seen.Swap(true) {
+			m.Rcode = dns.RcodeServerFailure
+		} else if r.Opcode == dns.OpcodeNotify && len(r.Answer) != 0 {
+			notifies <- r.Answer[0].(*dns.SOA).Serial
+		}
+
+		w.WriteMsg(m) // nolint:errcheck
+	})}
+
+	started := make(chan struct{})
+	secondary.NotifyStartedFunc = func() { close(started) }
+
+	go secondary.ListenAndServe() // nolint:errcheck
+	<-started
+
+	t.Cleanup(func() {
+		secondary.Shutdown() // nolint:errcheck
+	})
+
+	secondaryAddr := secondary.PacketConn.LocalAddr().String()
+
+	// stands in for the DNS server the launcher would restart after the
+	// reload, which has since moved on to a later change.
+	dnsAddr := freeAddr(t)
+
+	ds := &dnsserver.DNSServer{Zones: map[string]*config.Zone{"test.home.arpa.": makeZone(3, secondaryAddr)}}
+	if err := ds.Start(dnsAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	c := makeConfig(t)
+	c.Zones = map[string]*config.Zone{"test.home.arpa.": makeZone(1, secondaryAddr)}
+	c.SetPublisher(c.Peers[0])
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := Start(c, c.Peers[0], ":0", 10*time.Millisecond, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx) // nolint:errcheck
+	})
+
+	server.notifyInterval = 10 * time.Millisecond
+
+	newConfig := makeConfig(t)
+	newConfig.Listen.DNS = dnsAddr
+	newConfig.Zones = map[string]*config.Zone{"test.home.arpa.": makeZone(2, secondaryAddr)}
+
+	if err := server.ReplaceConfig(newConfig, c.Chain()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case serial := <-notifies:
+		if serial != 2 {
+			t.Fatalf("Unexpected serial in notify: %d", serial)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Secondary was never notified")
+	}
+
+	// nothing changed, so nothing should be sent.
+	<-server.config.ReloadChan()
+
+	newConfig = makeConfig(t)
+	newConfig.Listen.DNS = dnsAddr
+	newConfig.Zones = map[string]*config.Zone{"test.home.arpa.": makeZone(2, secondaryAddr)}
+
+	if err := server.ReplaceConfig(newConfig, c.Chain()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-notifies:
+		t.Fatal("Secondary was notified for an unchanged zone")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// followers take the same changes from the publisher, which notifies the
+	// secondaries for all of them.
+	<-server.config.ReloadChan()
+
+	jwk, err := josekit.MakeKey("bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.config.SetPublisher(&config.Peer{Key: jwk, IPs: []net.IP{net.ParseIP("127.0.0.2")}})
+
+	newConfig = makeConfig(t)
+	newConfig.Listen.DNS = dnsAddr
+	newConfig.Zones = map[string]*config.Zone{"test.home.arpa.": makeZone(3, secondaryAddr)}
+
+	if err := server.ReplaceConfig(newConfig, c.Chain()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-notifies:
+		t.Fatal("Secondary was notified by a follower")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// freeAddr finds a port that is free for both TCP and UDP, so the DNS server
+// can be queried on a single address.
+func freeAddr(t *testing.T) string {
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := l.Addr().String()
+		l.Close()
+
+		if pc, err := net.ListenPacket("udp", addr); err == nil {
+			pc.Close()
+			return addr
+		}
+	}
+
+	t.Fatal("could not find a free port")
+	return ""
+}
@@ -1,9 +1,12 @@
 package controlserver
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/erikh/border/pkg/api"
+	"github.com/miekg/dns"
 )
 
 func (s *Server) handlePing(req api.Request) (api.Message, error) {
@@ -29,3 +32,27 @@ func (s *Server) handleConfigFetch(req api.Request) (api.Message, error) {
 
 	return resp, nil
 }
+
+func (s *Server) handleZoneUpdate(req api.Request) (api.Message, error) {
+	zur := req.(*api.ZoneUpdateRequest)
+
+	if publisher := s.config.GetPublisher(); publisher == nil || publisher.Name() != s.me.Name() {
+		return nil, errors.New("Updates must be sent to the publisher")
+	}
+
+	update := &dns.Msg{}
+	if err := update.Unpack(zur.Update); err != nil {
+		return nil, fmt.Errorf("Could not unpack update: %w", err)
+	}
+
+	resp := req.Response().(*api.ZoneUpdateResponse)
+
+	rcode, serial, err := s.updateZone(update)
+	resp.Rcode = rcode
+	resp.Serial = serial
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	return resp, nil
+}
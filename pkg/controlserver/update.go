@@ -0,0 +1,145 @@
+package controlserver
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/erikh/border/pkg/api"
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/controlclient"
+	"github.com/miekg/dns"
+)
+
+// SendUpdate applies a dynamic update. Only the publisher may change the
+// configuration, so other peers send it there, and pick up the result with
+// the next generation of the configuration.
+func (s *Server) SendUpdate(update *dns.Msg) (int, error) {
+	rcode, _, err := s.sendUpdate(update)
+	return rcode, err
+}
+
+// sendUpdate is SendUpdate, which also yields the serial of the zone after the
+// update.
+func (s *Server) sendUpdate(update *dns.Msg) (int, uint32, error) {
+	publisher := s.config.GetPublisher()
+	if publisher == nil {
+		return dns.RcodeServerFailure, 0, errors.New("No publisher has been elected yet")
+	}
+
+	if publisher.Name() == s.me.Name() {
+		return s.updateZone(update)
+	}
+
+	byt, err := update.Pack()
+	if err != nil {
+		return dns.RcodeServerFailure, 0, fmt.Errorf("Could not pack update: %w", err)
+	}
+
+	client := controlclient.FromPeer(publisher)
+	resp, err := client.Exchange(&api.ZoneUpdateRequest{Update: byt}, true)
+	if err != nil {
+		return dns.RcodeServerFailure, 0, fmt.Errorf("Could not send update to publisher %q: %w", publisher.Name(), err)
+	}
+
+	zur := resp.(*api.ZoneUpdateResponse)
+	if zur.Error != "" {
+		return zur.Rcode, 0, errors.New(zur.Error)
+	}
+
+	return zur.Rcode, zur.Serial, nil
+}
+
+// UpdateZone applies a dynamic update to the configuration. The result is
+// saved and added to the chain as a new generation, which the other peers
+// fetch from us, so this should only be called on the publisher.
+func (s *Server) UpdateZone(update *dns.Msg) (int, error) {
+	rcode, _, err := s.updateZone(update)
+	return rcode, err
+}
+
+// updateZone is UpdateZone, which also yields the serial of the zone after the
+// update.
+func (s *Server) updateZone(update *dns.Msg) (int, uint32, error) {
+	var serial uint32
+
+	rcode, err := s.changeZones(func(zones map[string]*config.Zone) (int, error) {
+		rcode, err := config.UpdateZone(zones, update)
+		if err != nil {
+			return rcode, err
+		}
+
+		for name, zone := range zones {
+			if dns.CanonicalName(name) == dns.CanonicalName(update.Question[0].Name) {
+				serial = zone.SOA.Serial
+			}
+		}
+
+		return rcode, nil
+	})
+
+	return rcode, serial, err
+}
+
+// changeZones makes a change to the configured zones, then saves the result
+// and adds it to the chain if anything changed. Challenge tokens past their
+// deadline are removed along with it.
+func (s *Server) changeZones(change func(zones map[string]*config.Zone) (int, error)) (int, error) {
+	s.updateMutex.Lock()
+	defer s.updateMutex.Unlock()
+
+	// the zones being served may have failed health checks pruned from them,
+	// so start from the configured ones.
+	oldZones, err := s.config.ConfiguredZones()
+	if err != nil {
+		return dns.RcodeServerFailure, fmt.Errorf("Error parsing configured zones: %w", err)
+	}
+
+	zones, err := s.config.ConfiguredZones()
+	if err != nil {
+		return dns.RcodeServerFailure, fmt.Errorf("Error parsing configured zones: %w", err)
+	}
+
+	now := time.Now()
+
+	if err := pruneACMEChallenges(zones, now); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+
+	rcode, err := change(zones)
+	if err != nil {
+		return rcode, err
+	}
+
+	trackACMEChallenges(oldZones, zones, now)
+
+	changed := config.ChangedZones(oldZones, zones)
+	if len(changed) == 0 {
+		return rcode, nil
+	}
+
+	s.configMutex.RLock()
+	listen := s.config.Listen.DNS
+	s.configMutex.RUnlock()
+
+	// saving changes the zones in place, so take what notifying needs now.
+	notify := notifications(zones, changed)
+
+	s.config.SetZones(zones)
+
+	if err := s.config.Save(); err != nil {
+		return dns.RcodeServerFailure, fmt.Errorf("Could not save configuration: %w", err)
+	}
+
+	if err := s.config.AddGeneration(); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+
+	if err := s.config.Reload(); err != nil {
+		return dns.RcodeServerFailure, fmt.Errorf("While reloading configuration: %w", err)
+	}
+
+	s.notify(listen, notify)
+
+	return rcode, nil
+}
@@ -2,6 +2,7 @@ package dnsconfig
 
 import (
 	"net"
+	"strings"
 	"time"
 
 	"github.com/erikh/border/pkg/healthcheck"
@@ -10,8 +11,15 @@ import (
 )
 
 const (
-	TypeA  = "A"
-	TypeLB = "LB"
+	TypeA     = "A"
+	TypeAAAA  = "AAAA"
+	TypeCNAME = "CNAME"
+	TypeLB    = "LB"
+	TypeMX    = "MX"
+	TypeTXT   = "TXT"
+	TypeSRV   = "SRV"
+	TypeCAA   = "CAA"
+	TypeALIAS = "ALIAS"
 )
 
 // An attempt to normalize record management so it can be addressed in a
@@ -23,6 +31,29 @@ type Record interface {
 	Convert(string) []dns.RR
 }
 
+// Orderings for records with several addresses. Fixed, which gives the
+// addresses in the order they are configured, is the default.
+const (
+	OrderingFixed      = "fixed"
+	OrderingRoundRobin = "round-robin"
+	OrderingRandom     = "random"
+)
+
+// Ordered records may have their answers reordered, and capped in number, by
+// the server. Ordering yields the ordering and the cap, which is 0 for none.
+type Ordered interface {
+	Record
+	Ordering() (string, int)
+}
+
+// Weighted records answer with addresses picked at random, in proportion to
+// their weights. Weighting yields the weights, keyed by address, or by
+// listener for LB records; it is empty if the record has none.
+type Weighted interface {
+	Record
+	Weighting() map[string]float64
+}
+
 type SOA struct {
 	Domain  string `record:"domain"`
 	Admin   string `record:"admin"`
@@ -55,11 +86,27 @@ type A struct {
 	Addresses   []net.IP                   `record:"addresses"`
 	TTL         uint32                     `record:"ttl,optional"`
 	HealthCheck []*healthcheck.HealthCheck `record:"healthcheck,optional"`
+	Order       string                     `record:"ordering,optional"`
+	MaxAnswers  int                        `record:"max_answers,optional"`
+	Weights     map[string]float64         `record:"weights,optional"`
+}
+
+func (a *A) Ordering() (string, int) {
+	return a.Order, a.MaxAnswers
+}
+
+func (a *A) Weighting() map[string]float64 {
+	return a.Weights
 }
 
 func (a *A) Convert(name string) []dns.RR {
 	ret := []dns.RR{}
 	for _, rec := range a.Addresses {
+		// v6 addresses belong in AAAA records; don't mangle them into A records.
+		if rec.To4() == nil {
+			continue
+		}
+
 		ret = append(ret, dns.RR(&dns.A{
 			Hdr: dns.RR_Header{
 				Name:   name,
@@ -74,6 +121,215 @@ func (a *A) Convert(name string) []dns.RR {
 	return ret
 }
 
+type AAAA struct {
+	Addresses   []net.IP                   `record:"addresses"`
+	TTL         uint32                     `record:"ttl,optional"`
+	HealthCheck []*healthcheck.HealthCheck `record:"healthcheck,optional"`
+	Order       string                     `record:"ordering,optional"`
+	MaxAnswers  int                        `record:"max_answers,optional"`
+	Weights     map[string]float64         `record:"weights,optional"`
+}
+
+func (aaaa *AAAA) Ordering() (string, int) {
+	return aaaa.Order, aaaa.MaxAnswers
+}
+
+func (aaaa *AAAA) Weighting() map[string]float64 {
+	return aaaa.Weights
+}
+
+func (aaaa *AAAA) Convert(name string) []dns.RR {
+	ret := []dns.RR{}
+	for _, rec := range aaaa.Addresses {
+		// likewise, v4 addresses do not belong in AAAA records.
+		if rec.To4() != nil {
+			continue
+		}
+
+		ret = append(ret, dns.RR(&dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    aaaa.TTL,
+			},
+			AAAA: rec,
+		}))
+	}
+
+	return ret
+}
+
+type CNAME struct {
+	Target string `record:"target"`
+	TTL    uint32 `record:"ttl,optional"`
+}
+
+func (cname *CNAME) Convert(name string) []dns.RR {
+	return []dns.RR{&dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    cname.TTL,
+		},
+		Target: cname.Target,
+	}}
+}
+
+// ALIAS records are flattened into A and AAAA answers for the target at query
+// time. They are useful at the apex, where a CNAME cannot live.
+type ALIAS struct {
+	Target string `record:"target"`
+	// Resolver is the upstream ("host:port") used for targets outside of border's
+	// zones. The first nameserver in /etc/resolv.conf is used if empty.
+	Resolver string `record:"resolver,optional"`
+	TTL      uint32 `record:"ttl,optional"`
+}
+
+// Convert yields nothing; the answers depend on the target, which is only known
+// while serving.
+func (alias *ALIAS) Convert(name string) []dns.RR {
+	return []dns.RR{}
+}
+
+type MXExchanger struct {
+	Preference uint16 `record:"preference"`
+	Exchange   string `record:"exchange"`
+}
+
+type MX struct {
+	Exchangers []*MXExchanger `record:"exchangers"`
+	TTL        uint32         `record:"ttl,optional"`
+}
+
+func (mx *MX) Convert(name string) []dns.RR {
+	ret := []dns.RR{}
+	for _, exchanger := range mx.Exchangers {
+		ret = append(ret, dns.RR(&dns.MX{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeMX,
+				Class:  dns.ClassINET,
+				Ttl:    mx.TTL,
+			},
+			Preference: exchanger.Preference,
+			Mx:         exchanger.Exchange,
+		}))
+	}
+
+	return ret
+}
+
+// TXTChunkSize is the largest character-string allowed in a TXT record. Longer
+// values are split across several character-strings in the same record.
+const TXTChunkSize = 255
+
+type TXT struct {
+	Values []string `record:"values"`
+	TTL    uint32   `record:"ttl,optional"`
+}
+
+func (txt *TXT) Convert(name string) []dns.RR {
+	ret := []dns.RR{}
+	for _, value := range txt.Values {
+		ret = append(ret, dns.RR(&dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    txt.TTL,
+			},
+			Txt: splitTXT(value),
+		}))
+	}
+
+	return ret
+}
+
+// splitTXT chunks a value into character-strings. The dns package treats
+// backslashes as escapes when packing, so they are escaped after the split to
+// keep each chunk within TXTChunkSize on the wire.
+func splitTXT(value string) []string {
+	chunks := []string{}
+
+	for len(value) > TXTChunkSize {
+		chunks = append(chunks, value[:TXTChunkSize])
+		value = value[TXTChunkSize:]
+	}
+
+	chunks = append(chunks, value)
+
+	for i, chunk := range chunks {
+		chunks[i] = strings.ReplaceAll(chunk, `\`, `\\`)
+	}
+
+	return chunks
+}
+
+type SRVTarget struct {
+	Priority    uint16                     `record:"priority"`
+	Weight      uint16                     `record:"weight"`
+	Port        uint16                     `record:"port"`
+	Target      string                     `record:"target"`
+	HealthCheck []*healthcheck.HealthCheck `record:"healthcheck,optional"`
+}
+
+type SRV struct {
+	Targets []*SRVTarget `record:"targets"`
+	TTL     uint32       `record:"ttl,optional"`
+}
+
+func (srv *SRV) Convert(name string) []dns.RR {
+	ret := []dns.RR{}
+	for _, target := range srv.Targets {
+		ret = append(ret, dns.RR(&dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+				Ttl:    srv.TTL,
+			},
+			Priority: target.Priority,
+			Weight:   target.Weight,
+			Port:     target.Port,
+			Target:   target.Target,
+		}))
+	}
+
+	return ret
+}
+
+type CAAPolicy struct {
+	Flag  uint8  `record:"flag,optional"`
+	Tag   string `record:"tag"`
+	Value string `record:"value"`
+}
+
+type CAA struct {
+	Policies []*CAAPolicy `record:"policies"`
+	TTL      uint32       `record:"ttl,optional"`
+}
+
+func (caa *CAA) Convert(name string) []dns.RR {
+	ret := []dns.RR{}
+	for _, policy := range caa.Policies {
+		ret = append(ret, dns.RR(&dns.CAA{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeCAA,
+				Class:  dns.ClassINET,
+				Ttl:    caa.TTL,
+			},
+			Flag:  policy.Flag,
+			Tag:   policy.Tag,
+			Value: policy.Value,
+		}))
+	}
+
+	return ret
+}
+
 type NS struct {
 	Servers []string `record:"servers"`
 	TTL     uint32   `record:"ttl,optional"`
@@ -117,6 +373,17 @@ type LB struct {
 	TTL                      uint32                     `record:"ttl,optional"`
 	TLS                      *TLSLB                     `record:"tls,optional"`
 	HealthCheck              []*healthcheck.HealthCheck `record:"healthcheck,optional"`
+	Order                    string                     `record:"ordering,optional"`
+	MaxAnswers               int                        `record:"max_answers,optional"`
+	Weights                  map[string]float64         `record:"weights,optional"`
+}
+
+func (lb *LB) Ordering() (string, int) {
+	return lb.Order, lb.MaxAnswers
+}
+
+func (lb *LB) Weighting() map[string]float64 {
+	return lb.Weights
 }
 
 func (lb *LB) Convert(name string) []dns.RR {
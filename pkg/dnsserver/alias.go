@@ -0,0 +1,186 @@
+package dnsserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+)
+
+const (
+	// ResolvConf is where the default upstream for ALIAS targets is found.
+	ResolvConf = "/etc/resolv.conf"
+	// AliasNegativeTTL is how long an empty upstream answer is cached.
+	AliasNegativeTTL = 30 * time.Second
+	// AliasTimeout bounds the time spent talking to the upstream.
+	AliasTimeout = 2 * time.Second
+)
+
+var ErrUpstream = errors.New("upstream resolution failed")
+
+type aliasCacheEntry struct {
+	answers []dns.RR
+	expires time.Time
+}
+
+type aliasCache struct {
+	entries map[string]*aliasCacheEntry
+	mutex   sync.Mutex
+}
+
+func (ac *aliasCache) get(key string) ([]dns.RR, bool) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	entry, ok := ac.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(ac.entries, key)
+		return nil, false
+	}
+
+	return entry.answers, true
+}
+
+func (ac *aliasCache) set(key string, answers []dns.RR, ttl time.Duration) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	if ac.entries == nil {
+		ac.entries = map[string]*aliasCacheEntry{}
+	}
+
+	ac.entries[key] = &aliasCacheEntry{answers: answers, expires: time.Now().Add(ttl)}
+}
+
+func (ds *DNSServer) findALIAS(zone *config.Zone, name string) *dnsconfig.ALIAS {
+	owner := ds.owner(zone, name)
+
+	for _, rec := range zone.Records {
+		if rec.Name == owner && rec.Type == dnsconfig.TypeALIAS {
+			return rec.Value.(*dnsconfig.ALIAS)
+		}
+	}
+
+	return nil
+}
+
+func defaultResolver() (string, error) {
+	conf, err := dns.ClientConfigFromFile(ResolvConf)
+	if err != nil {
+		return "", err
+	}
+
+	if len(conf.Servers) == 0 {
+		return "", fmt.Errorf("no nameservers in %q", ResolvConf)
+	}
+
+	return net.JoinHostPort(conf.Servers[0], conf.Port), nil
+}
+
+// aliasResolver yields the upstream an ALIAS record's target is resolved
+// through.
+func aliasResolver(alias *dnsconfig.ALIAS) (string, error) {
+	if alias.Resolver != "" {
+		return alias.Resolver, nil
+	}
+
+	return defaultResolver()
+}
+
+func aliasCacheKey(resolver, name string, typ uint16) string {
+	return fmt.Sprintf("%s/%s/%d", resolver, name, typ)
+}
+
+// cachedUpstream yields the cached upstream answers for the target of an
+// ALIAS record, if there are any, without resolving it.
+func (ds *DNSServer) cachedUpstream(alias *dnsconfig.ALIAS, name string, typ uint16) ([]dns.RR, bool) {
+	resolver, err := aliasResolver(alias)
+	if err != nil {
+		return nil, false
+	}
+
+	return ds.aliasCache.get(aliasCacheKey(resolver, name, typ))
+}
+
+// upstream resolves a name outside of our zones on behalf of an ALIAS record.
+// Answers are cached for their TTL.
+func (ds *DNSServer) upstream(alias *dnsconfig.ALIAS, name string, typ uint16) ([]dns.RR, error) {
+	resolver, err := aliasResolver(alias)
+	if err != nil {
+		return nil, errors.Join(ErrUpstream, err)
+	}
+
+	key := aliasCacheKey(resolver, name, typ)
+
+	if answers, ok := ds.aliasCache.get(key); ok {
+		return answers, nil
+	}
+
+	m := &dns.Msg{}
+	m.SetQuestion(name, typ)
+
+	client := &dns.Client{Timeout: AliasTimeout}
+
+	r, _, err := client.Exchange(m, resolver)
+	if err != nil {
+		return nil, errors.Join(ErrUpstream, err)
+	}
+
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, fmt.Errorf("%w: %q yielded %s for %q", ErrUpstream, resolver, dns.RcodeToString[r.Rcode], name)
+	}
+
+	answers := []dns.RR{}
+	ttl := AliasNegativeTTL
+
+	// the upstream may hand us a CNAME chain as well; only the addresses matter.
+	for _, answer := range r.Answer {
+		if answer.Header().Rrtype == typ {
+			answers = append(answers, answer)
+
+			if answerTTL := time.Duration(answer.Header().Ttl) * time.Second; len(answers) == 1 || answerTTL < ttl {
+				ttl = answerTTL
+			}
+		}
+	}
+
+	ds.aliasCache.set(key, answers, ttl)
+
+	return answers, nil
+}
+
+// flatten rewrites address records to be owned by the ALIAS, never exceeding
+// its TTL.
+func flatten(records []dns.RR, owner string, alias *dnsconfig.ALIAS) []dns.RR {
+	ret := []dns.RR{}
+
+	for _, record := range records {
+		switch record.(type) {
+		case *dns.A, *dns.AAAA:
+		default:
+			continue
+		}
+
+		rr := dns.Copy(record)
+		rr.Header().Name = owner
+
+		if rr.Header().Ttl > alias.TTL {
+			rr.Header().Ttl = alias.TTL
+		}
+
+		ret = append(ret, rr)
+	}
+
+	return ret
+}
@@ -0,0 +1,380 @@
+package dnsserver
+
+import (
+	"encoding/base32"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// signatures are back-dated for validators with clocks behind ours.
+	signatureSkew     = time.Hour
+	signatureValidity = 7 * 24 * time.Hour
+)
+
+// dnssecOK reports whether the client asked for DNSSEC records.
+func dnssecOK(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// parentZone finds the zone the apex of another was delegated from, if we
+// serve it.
+func (ds *DNSServer) parentZone(apex string) *config.Zone {
+	i, end := dns.NextLabel(apex, 0)
+	if end {
+		return nil
+	}
+
+	return ds.findZone(apex[i:])
+}
+
+// signingZone finds the zone whose keys sign an RRset, if it is signed at
+// all. DS records are signed by the parent of the zone they are for.
+func (ds *DNSServer) signingZone(rr dns.RR) (*config.Zone, string) {
+	name := rr.Header().Name
+
+	zone := ds.findZone(name)
+	if zone != nil && rr.Header().Rrtype == dns.TypeDS && ds.Zones[name] == zone {
+		zone = ds.parentZone(name)
+	}
+
+	if zone == nil || !zone.DNSSEC.Ready() {
+		return nil, ""
+	}
+
+	return zone, ds.apex(zone)
+}
+
+// signatures signs the RRsets of a section with the keys of their zones,
+// yielding the RRSIG records to add to it.
+func (ds *DNSServer) signatures(section []dns.RR, now time.Time) []dns.RR {
+	type rrsetKey struct {
+		name string
+		typ  uint16
+	}
+
+	keys := []rrsetKey{}
+	rrsets := map[rrsetKey][]dns.RR{}
+
+	for _, rr := range section {
+		key := rrsetKey{name: strings.ToLower(rr.Header().Name), typ: rr.Header().Rrtype}
+
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	sigs := []dns.RR{}
+
+	for _, key := range keys {
+		rrset := rrsets[key]
+
+		zone, apex := ds.signingZone(rrset[0])
+		if zone == nil {
+			continue
+		}
+
+		sig, err := ds.rrsig(zone, apex, rrset, now)
+		if err != nil {
+			logrus.Errorf("While signing %q (type %s): %v", key.name, dns.TypeToString[key.typ], err)
+			continue
+		}
+
+		sigs = append(sigs, sig)
+	}
+
+	return sigs
+}
+
+// rrsig signs an RRset. The DNSKEY records are signed by the KSK, the rest by
+// the ZSK. Records synthesized from a wildcard are signed as the wildcard,
+// which validators find from the label count of the signature (RFC 4035,
+// section 5.3.2).
+func (ds *DNSServer) rrsig(zone *config.Zone, apex string, rrset []dns.RR, now time.Time) (*dns.RRSIG, error) {
+	hdr := rrset[0].Header()
+
+	key := zone.DNSSEC.ZSK
+	if hdr.Rrtype == dns.TypeDNSKEY {
+		key = zone.DNSSEC.KSK
+	}
+
+	if hdr.Rrtype != dns.TypeNSEC3 && hdr.Rrtype != dns.TypeDS {
+		if owner := ds.owner(zone, hdr.Name); owner != hdr.Name && strings.HasPrefix(owner, "*.") {
+			wildcard := []dns.RR{}
+
+			for _, rr := range rrset {
+				rr = dns.Copy(rr)
+				rr.Header().Name = owner
+				wildcard = append(wildcard, rr)
+			}
+
+			rrset = wildcard
+		}
+	}
+
+	dnskey := key.DNSKEY(apex, 0)
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+		KeyTag:     dnskey.KeyTag(),
+		SignerName: apex,
+		Algorithm:  dnskey.Algorithm,
+		Inception:  uint32(now.Add(-signatureSkew).Unix()),
+		Expiration: uint32(now.Add(signatureValidity).Unix()),
+	}
+
+	if err := sig.Sign(key.Signer(), rrset); err != nil {
+		return nil, err
+	}
+
+	// signing names the signature after the records signed.
+	sig.Hdr.Name = hdr.Name
+
+	return sig, nil
+}
+
+// nsec3Hash hashes a name for NSEC3, with neither a salt nor extra
+// iterations, as RFC 9276 recommends.
+func nsec3Hash(name string) string {
+	return dns.HashName(name, dns.SHA1, 0, "")
+}
+
+// nsec3Step yields the hash right after another, or right before it for a
+// step of -1.
+func nsec3Step(hash string, step int) string {
+	b, err := base32.HexEncoding.DecodeString(hash)
+	if err != nil {
+		return hash
+	}
+
+	for i := len(b) - 1; i >= 0; i-- {
+		if step > 0 {
+			b[i]++
+			if b[i] != 0 {
+				break
+			}
+		} else {
+			b[i]--
+			if b[i] != 0xff {
+				break
+			}
+		}
+	}
+
+	return base32.HexEncoding.EncodeToString(b)
+}
+
+// nsec3param yields the NSEC3 parameters of a zone, which are the same for
+// every zone.
+func nsec3param(zone *config.Zone, apex string) dns.RR {
+	return &dns.NSEC3PARAM{
+		Hdr:  dns.RR_Header{Name: apex, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: zone.NS.TTL},
+		Hash: dns.SHA1,
+	}
+}
+
+func nsec3(zone *config.Zone, apex string, hash string, next string, types []uint16) dns.RR {
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + apex, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: zone.SOA.MinTTL},
+		Hash:       dns.SHA1,
+		HashLength: 20,
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// nsec3Match yields the NSEC3 record for a name which exists, listing the
+// types it has.
+func (ds *DNSServer) nsec3Match(zone *config.Zone, apex string, name string) dns.RR {
+	hash := nsec3Hash(name)
+	return nsec3(zone, apex, hash, nsec3Step(hash, 1), ds.types(zone, apex, name))
+}
+
+// nsec3Cover yields an NSEC3 record covering the hash of a name which does
+// not exist, and nothing else.
+func (ds *DNSServer) nsec3Cover(zone *config.Zone, apex string, name string) dns.RR {
+	hash := nsec3Hash(name)
+	return nsec3(zone, apex, nsec3Step(hash, -1), nsec3Step(hash, 1), nil)
+}
+
+// types yields the types a name has records of, for the type bitmap of its
+// NSEC3 record. Records pruned by health checks are left out, as they are
+// from answers.
+func (ds *DNSServer) types(zone *config.Zone, apex string, name string) []uint16 {
+	set := map[uint16]struct{}{}
+
+	if name == apex {
+		for _, typ := range []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC3PARAM} {
+			set[typ] = struct{}{}
+		}
+	} else if child, ok := ds.Zones[name]; ok {
+		// a zone of ours delegated from this one.
+		set[dns.TypeNS] = struct{}{}
+
+		if child.DNSSEC.Ready() {
+			set[dns.TypeDS] = struct{}{}
+		}
+	}
+
+	if zone.Auto && len(ds.reverse(zone, name)) != 0 {
+		set[dns.TypePTR] = struct{}{}
+	}
+
+	for _, rec := range zone.Records {
+		if rec.Name != name {
+			continue
+		}
+
+		// ALIAS names have the addresses of their target, which may not have
+		// both kinds, so list what the name is answered with.
+		if rec.Type == dnsconfig.TypeALIAS {
+			for _, typ := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				if ds.aliasAnswers(zone, name, typ) {
+					set[typ] = struct{}{}
+				}
+			}
+
+			continue
+		}
+
+		if lb, ok := rec.Value.(*dnsconfig.LB); ok {
+			for _, ip := range ds.listenerIPs(lb) {
+				set[addressRecord(name, ip, lb.TTL).Header().Rrtype] = struct{}{}
+			}
+
+			continue
+		}
+
+		for _, rr := range rec.Value.Convert(name) {
+			set[rr.Header().Rrtype] = struct{}{}
+		}
+	}
+
+	if len(set) == 0 {
+		return nil
+	}
+
+	set[dns.TypeRRSIG] = struct{}{}
+
+	types := []uint16{}
+	for typ := range set {
+		types = append(types, typ)
+	}
+
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return types
+}
+
+// aliasAnswers reports whether an ALIAS name is answered with addresses of the
+// type, without resolving anything: denials are given often, and must not
+// wait on the upstream or change with its failures. Targets in our zones are
+// followed through their records, and those outside of them are looked up in
+// the cache of upstream answers, which the query being denied has usually
+// just filled. Targets which are not cached are taken to have addresses.
+func (ds *DNSServer) aliasAnswers(zone *config.Zone, name string, typ uint16) bool {
+	seen := map[string]struct{}{}
+
+	var alias *dnsconfig.ALIAS
+
+	for zone != nil {
+		// loops and long chains are never answered with anything.
+		if _, ok := seen[name]; ok || len(seen) >= MaxCNAMEChain {
+			return false
+		}
+
+		seen[name] = struct{}{}
+
+		if len(ds.lookup(zone, name, typ)) != 0 {
+			return true
+		}
+
+		if cname := ds.findCNAME(zone, name); cname != nil {
+			name = cname.Target
+		} else if a := ds.findALIAS(zone, name); a != nil {
+			if alias == nil {
+				alias = a
+			}
+
+			name = a.Target
+		} else {
+			return false
+		}
+
+		zone = ds.findZone(name)
+	}
+
+	answers, ok := ds.cachedUpstream(alias, name, typ)
+
+	return !ok || len(answers) != 0
+}
+
+// closestEncloser yields the closest ancestor of a name which does not exist,
+// and the "next closer" name, which is one label longer (RFC 5155, section
+// 7.2.1).
+func (ds *DNSServer) closestEncloser(zone *config.Zone, name string) (string, string) {
+	labels := dns.SplitDomainName(name)
+
+	// the apex always exists, so this will never walk out of the zone.
+	for i := 1; i < len(labels); i++ {
+		if encloser := strings.Join(labels[i:], ".") + "."; ds.exists(zone, encloser) {
+			return encloser, strings.Join(labels[i-1:], ".") + "."
+		}
+	}
+
+	return ds.apex(zone), name
+}
+
+// denial proves a negative answer with NSEC3 records (RFC 5155, section 7.2).
+// They are "white lies" (RFC 7129, appendix B): made up for each answer, they
+// match or barely cover the names in question, so the zone cannot be walked
+// with them.
+func (ds *DNSServer) denial(zone *config.Zone, name string) []dns.RR {
+	apex := ds.apex(zone)
+
+	if ds.exists(zone, name) {
+		return []dns.RR{ds.nsec3Match(zone, apex, name)}
+	}
+
+	encloser, next := ds.closestEncloser(zone, name)
+	proof := []dns.RR{ds.nsec3Match(zone, apex, encloser), ds.nsec3Cover(zone, apex, next)}
+
+	// the wildcard exists, but not with the type asked for.
+	if wildcard := "*." + encloser; ds.exists(zone, wildcard) {
+		return append(proof, ds.nsec3Match(zone, apex, wildcard))
+	}
+
+	return append(proof, ds.nsec3Cover(zone, apex, "*."+encloser))
+}
+
+// secure adds what validators need to a response: proof of the negative or
+// wildcard answers of signed zones, and signatures for every RRset in them.
+// Negative answers are proven for end and endName, which is where a CNAME
+// chain from the name ended without records; end is nil for positive answers.
+func (ds *DNSServer) secure(m *dns.Msg, zone *config.Zone, name string, end *config.Zone, endName string) {
+	if len(m.Answer) != 0 && zone.DNSSEC.Ready() && !ds.exists(zone, name) {
+		// the answer was synthesized from a wildcard, so prove there was
+		// nothing closer to the name to answer with.
+		_, next := ds.closestEncloser(zone, name)
+		m.Ns = append(m.Ns, ds.nsec3Cover(zone, ds.apex(zone), next))
+	}
+
+	if end != nil && end.DNSSEC.Ready() {
+		m.Ns = append(m.Ns, ds.denial(end, endName)...)
+	}
+
+	now := time.Now()
+
+	m.Answer = append(m.Answer, ds.signatures(m.Answer, now)...)
+	m.Ns = append(m.Ns, ds.signatures(m.Ns, now)...)
+	m.Extra = append(m.Extra, ds.signatures(m.Extra, now)...)
+}
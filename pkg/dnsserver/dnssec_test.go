@@ -0,0 +1,424 @@
+package dnsserver
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/erikh/border/pkg/josekit"
+	"github.com/erikh/go-hashchain"
+	"github.com/miekg/dns"
+)
+
+func makeSignedZones(t *testing.T) map[string]*config.Zone {
+	zones := makeZones()
+	zones["test.home.arpa."].DNSSEC = &config.DNSSEC{}
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "foo.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")},
+				TTL:       60,
+			},
+		},
+		{
+			Name: "*.apps.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("192.0.2.3")},
+				TTL:       60,
+			},
+		},
+	}
+
+	zones["sub.test.home.arpa."] = &config.Zone{
+		SOA: &dnsconfig.SOA{
+			Domain:  "sub.test.home.arpa.",
+			Admin:   "administrator.test.home.arpa.",
+			MinTTL:  60,
+			Serial:  1,
+			Refresh: 60,
+			Retry:   60,
+			Expire:  60,
+		},
+		NS: &dnsconfig.NS{
+			Servers: []string{"test.home.arpa."},
+			TTL:     60,
+		},
+		Records: []*config.Record{},
+		DNSSEC:  &config.DNSSEC{Algorithm: "ED25519"},
+	}
+
+	if _, err := (&config.Config{Zones: zones}).GenerateDNSSECKeys(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return zones
+}
+
+func querySigned(t *testing.T, ds *DNSServer, name string, typ uint16) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion(name, typ)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+
+	client := &dns.Client{Net: "tcp", Timeout: time.Second}
+	r, _, err := client.Exchange(m, ds.tcpServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error querying %q (type %s): %v", name, dns.TypeToString[typ], err)
+	}
+
+	if opt := r.IsEdns0(); opt == nil || !opt.Do() {
+		t.Fatalf("Response for %q (type %s) does not have the DO bit set: %v", name, dns.TypeToString[typ], r)
+	}
+
+	return r
+}
+
+// verify checks that every RRset of the section is signed by one of the keys.
+func verify(t *testing.T, section []dns.RR, keys []*dns.DNSKEY) {
+	rrsets := map[string][]dns.RR{}
+	sigs := map[string]*dns.RRSIG{}
+
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs[strings.ToLower(sig.Hdr.Name)+"/"+dns.TypeToString[sig.TypeCovered]] = sig
+			continue
+		}
+
+		key := strings.ToLower(rr.Header().Name) + "/" + dns.TypeToString[rr.Header().Rrtype]
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	for key, rrset := range rrsets {
+		sig, ok := sigs[key]
+		if !ok {
+			t.Fatalf("RRset %s is not signed", key)
+		}
+
+		if !sig.ValidityPeriod(time.Now()) {
+			t.Fatalf("Signature of RRset %s is not valid now", key)
+		}
+
+		var verified bool
+
+		for _, dnskey := range keys {
+			if dnskey.KeyTag() == sig.KeyTag && dnskey.Hdr.Name == sig.SignerName {
+				if err := sig.Verify(dnskey, rrset); err != nil {
+					t.Fatalf("Signature of RRset %s does not verify: %v", key, err)
+				}
+
+				verified = true
+			}
+		}
+
+		if !verified {
+			t.Fatalf("RRset %s is signed with an unknown key", key)
+		}
+	}
+}
+
+// dnskeys yields the keys a zone is served with.
+func dnskeys(t *testing.T, ds *DNSServer, apex string) []*dns.DNSKEY {
+	ret := []*dns.DNSKEY{}
+
+	for _, rr := range querySigned(t, ds, apex, dns.TypeDNSKEY).Answer {
+		if dnskey, ok := rr.(*dns.DNSKEY); ok {
+			ret = append(ret, dnskey)
+		}
+	}
+
+	return ret
+}
+
+func nsec3s(section []dns.RR) []*dns.NSEC3 {
+	ret := []*dns.NSEC3{}
+
+	for _, rr := range section {
+		if nsec3, ok := rr.(*dns.NSEC3); ok {
+			ret = append(ret, nsec3)
+		}
+	}
+
+	return ret
+}
+
+func matched(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			return nsec3
+		}
+	}
+
+	return nil
+}
+
+func covered(nsec3s []*dns.NSEC3, name string) bool {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestDNSSECALIAS(t *testing.T) {
+	upstream, queries := startUpstream(t, "example.com.", "192.0.2.1")
+
+	zones := makeSignedZones(t)
+	zones["test.home.arpa."].Records = append(zones["test.home.arpa."].Records,
+		&config.Record{
+			Name:  "alias.test.home.arpa.",
+			Type:  dnsconfig.TypeALIAS,
+			Value: &dnsconfig.ALIAS{Target: "foo.test.home.arpa.", TTL: 60},
+		},
+		&config.Record{
+			Name:  "external.test.home.arpa.",
+			Type:  dnsconfig.TypeALIAS,
+			Value: &dnsconfig.ALIAS{Target: "host.example.com.", Resolver: upstream, TTL: 60},
+		},
+	)
+
+	ds := startServer(t, zones)
+
+	// both targets only have IPv4 addresses, so the ALIAS has no AAAA records.
+	for _, name := range []string{"alias.test.home.arpa.", "external.test.home.arpa."} {
+		r := querySigned(t, ds, name, dns.TypeAAAA)
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+			t.Fatalf("Unexpected NODATA response for %q: %v", name, r)
+		}
+
+		verify(t, r.Ns, dnskeys(t, ds, "test.home.arpa."))
+
+		nsec3 := matched(nsec3s(r.Ns), name)
+		if nsec3 == nil {
+			t.Fatalf("Name %q was not matched in NODATA response: %v", name, r.Ns)
+		}
+
+		types := map[uint16]bool{}
+		for _, typ := range nsec3.TypeBitMap {
+			types[typ] = true
+		}
+
+		if !types[dns.TypeA] || types[dns.TypeAAAA] {
+			t.Fatalf("Unexpected types for ALIAS %q: %v", name, nsec3)
+		}
+	}
+
+	// the denial is built from what the AAAA query left in the cache; the
+	// upstream is not asked for the A records.
+	if count := queries.Load(); count != 1 {
+		t.Fatalf("Upstream was queried %d times for a single AAAA query", count)
+	}
+}
+
+func TestDNSSECLB(t *testing.T) {
+	key, err := josekit.MakeKey("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := config.New(hashchain.New(nil))
+	c.Peers = []*config.Peer{{Key: key, IPs: []net.IP{net.ParseIP("127.0.0.2")}}}
+
+	zones := makeSignedZones(t)
+	zones["test.home.arpa."].Records = append(zones["test.home.arpa."].Records, &config.Record{
+		Name:  "balancer.test.home.arpa.",
+		Type:  dnsconfig.TypeLB,
+		Value: &dnsconfig.LB{Listeners: []string{"peer:80"}, TTL: 60},
+	})
+
+	ds := &DNSServer{Zones: zones, Config: c}
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	// the listener names a peer, which is answered with its addresses.
+	r := querySigned(t, ds, "balancer.test.home.arpa.", dns.TypeA)
+	if len(r.Answer) == 0 || !r.Answer[0].(*dns.A).A.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("Unexpected answer for an LB record: %v", r)
+	}
+
+	r = querySigned(t, ds, "balancer.test.home.arpa.", dns.TypeAAAA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatalf("Unexpected NODATA response: %v", r)
+	}
+
+	nsec3 := matched(nsec3s(r.Ns), "balancer.test.home.arpa.")
+	if nsec3 == nil {
+		t.Fatalf("Name was not matched in NODATA response: %v", r.Ns)
+	}
+
+	types := map[uint16]bool{}
+	for _, typ := range nsec3.TypeBitMap {
+		types[typ] = true
+	}
+
+	if !types[dns.TypeA] || types[dns.TypeAAAA] {
+		t.Fatalf("Unexpected types for an LB record: %v", nsec3)
+	}
+}
+
+func TestDNSSEC(t *testing.T) {
+	zones := makeSignedZones(t)
+	ds := startServer(t, zones)
+
+	keys := []*dns.DNSKEY{}
+
+	for _, apex := range []string{"test.home.arpa.", "sub.test.home.arpa."} {
+		r := querySigned(t, ds, apex, dns.TypeDNSKEY)
+		if len(r.Answer) != 3 {
+			t.Fatalf("Unexpected DNSKEY response: %v", r)
+		}
+
+		zoneKeys := []*dns.DNSKEY{}
+		for _, rr := range r.Answer {
+			if dnskey, ok := rr.(*dns.DNSKEY); ok {
+				zoneKeys = append(zoneKeys, dnskey)
+			}
+		}
+
+		// only the KSK may sign the keys.
+		verify(t, r.Answer, zoneKeys[:1])
+
+		if zoneKeys[0].Flags != dns.ZONE|dns.SEP || zoneKeys[1].Flags != dns.ZONE {
+			t.Fatalf("Unexpected key flags: %v", zoneKeys)
+		}
+
+		keys = append(keys, zoneKeys...)
+	}
+
+	// unsigned queries get unsigned answers.
+	r := query(t, ds, "foo.test.home.arpa.", dns.TypeA)
+	if len(r.Answer) != 2 {
+		t.Fatalf("Query without DO was answered with signatures: %v", r)
+	}
+
+	r = querySigned(t, ds, "foo.test.home.arpa.", dns.TypeA)
+	if len(r.Answer) != 3 || !r.Authoritative {
+		t.Fatalf("Unexpected signed response: %v", r)
+	}
+
+	verify(t, r.Answer, keys)
+
+	if r.Answer[2].(*dns.RRSIG).SignerName != "test.home.arpa." {
+		t.Fatalf("Answer was signed by the wrong zone: %v", r.Answer[2])
+	}
+
+	r = querySigned(t, ds, "test.home.arpa.", dns.TypeNSEC3PARAM)
+	if len(r.Answer) != 2 || r.Answer[0].(*dns.NSEC3PARAM).Iterations != 0 {
+		t.Fatalf("Unexpected NSEC3PARAM response: %v", r)
+	}
+
+	verify(t, r.Answer, keys)
+
+	// NXDOMAIN: the closest encloser matches, and the next closer name and the
+	// wildcard are covered.
+	r = querySigned(t, ds, "missing.test.home.arpa.", dns.TypeA)
+	if r.Rcode != dns.RcodeNameError {
+		t.Fatalf("Unexpected response for a missing name: %v", r)
+	}
+
+	verify(t, r.Ns, keys)
+
+	denial := nsec3s(r.Ns)
+	if matched(denial, "test.home.arpa.") == nil || !covered(denial, "missing.test.home.arpa.") || !covered(denial, "*.test.home.arpa.") {
+		t.Fatalf("Missing name was not proven not to exist: %v", r.Ns)
+	}
+
+	// white lies cover the names in question, and nothing else.
+	for _, nsec3 := range denial {
+		if nsec3.Cover("foo.test.home.arpa.") {
+			t.Fatalf("NSEC3 record covers an existing name: %v", nsec3)
+		}
+	}
+
+	// NODATA: the name matches, without the type.
+	r = querySigned(t, ds, "foo.test.home.arpa.", dns.TypeTXT)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatalf("Unexpected NODATA response: %v", r)
+	}
+
+	verify(t, r.Ns, keys)
+
+	nsec3 := matched(nsec3s(r.Ns), "foo.test.home.arpa.")
+	if nsec3 == nil {
+		t.Fatalf("Name was not matched in NODATA response: %v", r.Ns)
+	}
+
+	types := map[uint16]bool{}
+	for _, typ := range nsec3.TypeBitMap {
+		types[typ] = true
+	}
+
+	if !types[dns.TypeA] || !types[dns.TypeRRSIG] || types[dns.TypeTXT] {
+		t.Fatalf("Unexpected types in NODATA response: %v", nsec3)
+	}
+
+	// wildcard answers are signed as the wildcard, with proof that the name
+	// itself does not exist.
+	r = querySigned(t, ds, "host.apps.test.home.arpa.", dns.TypeA)
+	if len(r.Answer) != 2 {
+		t.Fatalf("Unexpected wildcard response: %v", r)
+	}
+
+	verify(t, r.Answer, keys)
+	verify(t, r.Ns, keys)
+
+	if sig := r.Answer[1].(*dns.RRSIG); sig.Labels != 4 || sig.Hdr.Name != "host.apps.test.home.arpa." {
+		t.Fatalf("Wildcard answer was not signed as the wildcard: %v", sig)
+	}
+
+	if !covered(nsec3s(r.Ns), "host.apps.test.home.arpa.") {
+		t.Fatalf("Wildcard answer was not proven: %v", r.Ns)
+	}
+
+	// the DS of a zone beneath another of ours is answered, and signed, by the
+	// parent.
+	r = querySigned(t, ds, "sub.test.home.arpa.", dns.TypeDS)
+	if len(r.Answer) != 2 {
+		t.Fatalf("Unexpected DS response: %v", r)
+	}
+
+	verify(t, r.Answer, keys)
+
+	expected := zones["sub.test.home.arpa."].DNSSEC.KSK.DNSKEY("sub.test.home.arpa.", 60).ToDS(dns.SHA256)
+	if ds := r.Answer[0].(*dns.DS); ds.Digest != expected.Digest || ds.KeyTag != expected.KeyTag {
+		t.Fatalf("Unexpected DS record: %v", ds)
+	}
+
+	if sig := r.Answer[1].(*dns.RRSIG); sig.SignerName != "test.home.arpa." {
+		t.Fatalf("DS record was not signed by the parent zone: %v", sig)
+	}
+
+	// zones without DNSSEC are not signed, even when asked.
+	zones = makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "foo.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("192.0.2.1")},
+				TTL:       60,
+			},
+		},
+	}
+
+	ds = startServer(t, zones)
+
+	if r := querySigned(t, ds, "foo.test.home.arpa.", dns.TypeA); len(r.Answer) != 1 {
+		t.Fatalf("Unsigned zone was answered with signatures: %v", r)
+	}
+
+	if r := querySigned(t, ds, "test.home.arpa.", dns.TypeDNSKEY); len(r.Answer) != 0 {
+		t.Fatalf("Unsigned zone was answered with keys: %v", r)
+	}
+}
@@ -1,36 +1,108 @@
 package dnsserver
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/erikh/border/pkg/config"
 	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/sirupsen/logrus"
 
 	"github.com/miekg/dns"
 )
 
+// MaxCNAMEChain is the longest chain of names we will follow while chasing
+// CNAMEs before giving up.
+const MaxCNAMEChain = 8
+
+var (
+	ErrCNAMELoop         = errors.New("CNAME loop detected")
+	ErrCNAMEChainTooLong = errors.New("CNAME chain too long")
+)
+
 type DNSServer struct {
-	Zones     map[string]*config.Zone
-	udpServer *dns.Server
-	tcpServer *dns.Server
+	Zones map[string]*config.Zone
+	// Config is optional, and used to resolve peer names, e.g. in LB listeners.
+	Config *config.Config
+	// Journal keeps previous versions of the zones for IXFR. One is created if
+	// it is not provided.
+	Journal *Journal
+	// DoT and DoH are the optional listen specs for DNS-over-TLS and
+	// DNS-over-HTTPS. TLS must be set with either.
+	DoT string
+	DoH string
+	TLS *tls.Config
+	// RRL is the response rate limiting for zones without their own.
+	RRL *config.RRL
+	// RRLStats counts what rate limiting did. One is created if it is not
+	// provided.
+	RRLStats *RRLStats
+	// Forward is optional, and forwards queries for names outside of the zones
+	// to upstream resolvers.
+	Forward *config.Forward
+	// Update is optional, and applies dynamic updates to zones that allow them.
+	// Without it, all updates are refused.
+	Update UpdateFunc
+	// Views are optional, and give clients in their networks their own version
+	// of the zones.
+	Views map[string]*config.View
+
+	udpServer    *dns.Server
+	tcpServer    *dns.Server
+	dotServer    *dns.Server
+	dohServer    *http.Server
+	dohListener  net.Listener
+	aliasCache   aliasCache
+	forwardCache forwardCache
+	rateLimiter  rateLimiter
+	rotation     rotation
+	views        []*view
+	done         chan struct{}
 }
 
 // Start returns after the servers have started, and launches a UDP and TCP
-// server in the background on the network specification.
+// server in the background on the network specification. DNS-over-TLS and
+// DNS-over-HTTPS servers are launched too if DoT and DoH are set.
 func (ds *DNSServer) Start(listenSpec string) error {
-	// the only reason this is 4 is because if the goroutine listens terminate
+	if (ds.DoT != "" || ds.DoH != "") && ds.TLS == nil {
+		return errors.New("encrypted DNS requires a TLS configuration")
+	}
+
+	// the only reason this is 6 is because if the goroutine listens terminate
 	// prematurely after starting, they may yield an error, which would deadlock
 	// the channel, so fill the buffer pointlessly, but at least nothing locks
 	// up. Shutdown() will catch the real error. There's probably a good argument
 	// for just returning the channel here instead.
-	done := make(chan error, 4)
+	done := make(chan error, 6)
 	startFunc := func() {
 		done <- nil
 	}
 
-	ds.udpServer = &dns.Server{Addr: listenSpec, Net: "udp", Handler: ds, NotifyStartedFunc: startFunc, ReusePort: true}
-	ds.tcpServer = &dns.Server{Addr: listenSpec, Net: "tcp", Handler: ds, NotifyStartedFunc: startFunc}
+	if ds.Journal == nil {
+		ds.Journal = &Journal{}
+	}
+
+	if ds.RRLStats == nil {
+		ds.RRLStats = &RRLStats{}
+	}
+
+	ds.rateLimiter.stats = ds.RRLStats
+
+	ds.journalZones()
+	ds.buildViews()
+
+	secrets := ds.tsigSecrets()
+
+	ds.done = make(chan struct{})
+	go ds.logRRL(ds.done)
+
+	ds.udpServer = &dns.Server{Addr: listenSpec, Net: "udp", Handler: ds, MsgAcceptFunc: acceptMsg, NotifyStartedFunc: startFunc, ReusePort: true, TsigSecret: secrets}
+	ds.tcpServer = &dns.Server{Addr: listenSpec, Net: "tcp", Handler: ds, MsgAcceptFunc: acceptMsg, NotifyStartedFunc: startFunc, TsigSecret: secrets}
 
 	go func() {
 		switch err := ds.udpServer.ListenAndServe(); err {
@@ -48,12 +120,50 @@ func (ds *DNSServer) Start(listenSpec string) error {
 		}
 	}()
 
-	for i := 0; i < 2; i++ {
+	servers := 2
+
+	if ds.DoT != "" {
+		ds.dotServer = &dns.Server{Addr: ds.DoT, Net: "tcp-tls", TLSConfig: ds.TLS, Handler: ds, MsgAcceptFunc: acceptMsg, NotifyStartedFunc: startFunc, TsigSecret: secrets}
+		servers++
+
+		go func() {
+			switch err := ds.dotServer.ListenAndServe(); err {
+			case nil:
+			default:
+				done <- err
+			}
+		}()
+	}
+
+	for i := 0; i < servers; i++ {
 		if err := <-done; err != nil {
 			return err
 		}
 	}
 
+	if ds.DoH != "" {
+		var err error
+
+		// RFC 8484 recommends HTTP/2, which net/http only serves when it is
+		// offered. The configuration is shared with DoT, which must not offer it.
+		dohTLS := ds.TLS.Clone()
+		dohTLS.NextProtos = []string{"h2", "http/1.1"}
+
+		// net/http has no notification of startup, so listen first; Serve cannot
+		// fail for any other reason until the server is shut down.
+		ds.dohListener, err = tls.Listen("tcp", ds.DoH, dohTLS)
+		if err != nil {
+			return err
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(DoHPath, ds)
+
+		ds.dohServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+		go ds.dohServer.Serve(ds.dohListener) // nolint:errcheck
+	}
+
 	return nil
 }
 
@@ -64,6 +174,12 @@ func (ds *DNSServer) Shutdown() error {
 		return errors.New("cannot shutdown server; never started")
 	}
 
+	select {
+	case <-ds.done:
+	default:
+		close(ds.done)
+	}
+
 	if err := ds.udpServer.Shutdown(); err != nil {
 		return errors.Join(err, errors.New("unable to shutdown UDP server"))
 	}
@@ -72,89 +188,559 @@ func (ds *DNSServer) Shutdown() error {
 		return errors.Join(err, errors.New("unable to shutdown TCP server"))
 	}
 
+	if ds.dotServer != nil {
+		if err := ds.dotServer.Shutdown(); err != nil {
+			return errors.Join(err, errors.New("unable to shutdown DNS-over-TLS server"))
+		}
+	}
+
+	if ds.dohServer != nil {
+		if err := ds.dohServer.Close(); err != nil {
+			return errors.Join(err, errors.New("unable to shutdown DNS-over-HTTPS server"))
+		}
+	}
+
 	return nil
 }
 
-func (ds *DNSServer) findZone(name string) *config.Zone {
+// findApex yields the name of the zone holding a name, or "" if none of ours
+// does.
+func (ds *DNSServer) findApex(name string) string {
 	names := dns.SplitDomainName(name)
 	// perform a greedy reverse search of the FQDN. If this code is working
 	// right, the longest match will be found first, finding the most local zone.
 	for i := len(names); i > 0; i-- {
 		potentialZone := strings.Join(names[len(names)-i:], ".") + "."
-		if zone, ok := ds.Zones[potentialZone]; ok {
-			return zone
+		if _, ok := ds.Zones[potentialZone]; ok {
+			return potentialZone
 		}
 	}
 
-	return nil
+	return ""
 }
 
-func (ds *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	m := &dns.Msg{}
-	m.SetReply(r)
+func (ds *DNSServer) findZone(name string) *config.Zone {
+	return ds.Zones[ds.findApex(name)]
+}
+
+// queryTypes maps the record types that are served verbatim to the query type
+// they answer. LB records are special, as they answer both A and AAAA queries.
+var queryTypes = map[string]uint16{
+	dnsconfig.TypeA:     dns.TypeA,
+	dnsconfig.TypeAAAA:  dns.TypeAAAA,
+	dnsconfig.TypeCNAME: dns.TypeCNAME,
+	dnsconfig.TypeMX:    dns.TypeMX,
+	dnsconfig.TypeTXT:   dns.TypeTXT,
+	dnsconfig.TypeSRV:   dns.TypeSRV,
+	dnsconfig.TypeCAA:   dns.TypeCAA,
+}
+
+// exists reports whether a name exists in the zone: the apex always does, as
+// does any name with records, or with records beneath it (an "empty
+// non-terminal"). Names with synthesized PTR records exist in auto reverse
+// zones. The apex of a zone of ours beneath this one exists as the point it
+// was delegated from.
+func (ds *DNSServer) exists(zone *config.Zone, name string) bool {
+	if _, ok := ds.Zones[name]; ok {
+		return true
+	}
+
+	if zone.Auto && len(ds.reverse(zone, name)) != 0 {
+		return true
+	}
+
+	for _, rec := range zone.Records {
+		if rec.Name == name || strings.HasSuffix(rec.Name, "."+name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// owner yields the name whose records answer for the query name. This is the
+// name itself if it exists, otherwise the wildcard at its closest encloser,
+// if there is one. See RFC 4592.
+func (ds *DNSServer) owner(zone *config.Zone, name string) string {
+	if ds.exists(zone, name) {
+		return name
+	}
+
+	labels := dns.SplitDomainName(name)
 
+	// the apex always exists, so this will never walk out of the zone.
+	for i := 1; i < len(labels); i++ {
+		encloser := strings.Join(labels[i:], ".") + "."
+		if ds.exists(zone, encloser) {
+			if wildcard := "*." + encloser; ds.exists(zone, wildcard) {
+				return wildcard
+			}
+
+			break
+		}
+	}
+
+	return name
+}
+
+// lookup finds the records for a name in the zone that answer the query type.
+// Records synthesized from wildcards are returned with the query name as
+// their owner.
+func (ds *DNSServer) lookup(zone *config.Zone, name string, typ uint16) []dns.RR {
 	answers := []dns.RR{}
+	owner := ds.owner(zone, name)
 
-	if len(r.Question) != 0 {
-		// NOTE: according to the docs for Questions, practically, only the first
-		// question matters. DNS the specced protocol supports multiple questions,
-		// but most servers only honor the first one. So we are going to avoid
-		// caring about any others and save ourselves some trouble.
-		name := r.Question[0].Name
-		zone := ds.findZone(name)
-
-		if zone != nil {
-			typ := r.Question[0].Qtype
-			switch typ {
-			// SOA and NS are special because they are special records.
-			case dns.TypeSOA:
-				answers = zone.SOA.Convert(name)
-			case dns.TypeNS:
-				answers = zone.NS.Convert(name)
-			default:
-				for _, rec := range zone.Records {
-					if rec.Name == name {
-						switch rec.Type {
-						case dnsconfig.TypeA:
-							// we don't want to deliver answers for non-A queries for these records.
-							if typ == dns.TypeA {
-								answers = rec.Value.Convert(name)
-							}
-						case dnsconfig.TypeLB:
-							values := rec.Value.Convert(name)
-
-							for _, answer := range values {
-								switch a := answer.(type) {
-								// filter the right records for the query type
-								case *dns.A:
-									if a.Hdr.Rrtype == typ {
-										answers = append(answers, answer)
-									}
-								case *dns.AAAA:
-									if a.Hdr.Rrtype == typ {
-										answers = append(answers, answer)
-									}
-								}
-							}
-						}
-
-						break
+	if zone.Auto && typ == dns.TypePTR {
+		answers = append(answers, ds.reverse(zone, name)...)
+	}
+
+	// a name may carry several records (e.g., an A and an AAAA record for a
+	// dual-stack service), so walk all of them instead of stopping at the first
+	// name match.
+	for _, rec := range zone.Records {
+		if rec.Name == owner {
+			values := []dns.RR{}
+
+			switch rec.Type {
+			case dnsconfig.TypeLB:
+				// listeners may name peers, which are answered with their
+				// addresses.
+				lb := rec.Value.(*dnsconfig.LB)
+
+				for _, ip := range ds.listenerIPs(lb) {
+					// filter the right records for the query type
+					if answer := addressRecord(name, ip, lb.TTL); answer.Header().Rrtype == typ {
+						values = append(values, answer)
 					}
 				}
+			default:
+				// we don't want to deliver answers for other query types for these records.
+				if queryTypes[rec.Type] == typ {
+					values = rec.Value.Convert(name)
+				}
+			}
+
+			answers = append(answers, ds.order(rec, values)...)
+		}
+	}
+
+	return answers
+}
+
+func (ds *DNSServer) findCNAME(zone *config.Zone, name string) *dnsconfig.CNAME {
+	owner := ds.owner(zone, name)
+
+	for _, rec := range zone.Records {
+		if rec.Name == owner && rec.Type == dnsconfig.TypeCNAME {
+			return rec.Value.(*dnsconfig.CNAME)
+		}
+	}
+
+	return nil
+}
+
+// resolve answers the query, chasing CNAMEs as long as their targets live in
+// a zone we are authoritative for. Once a target leaves our zones, the chain
+// so far is returned and the resolver is left to do the rest.
+//
+// ALIAS records are chased the same way, but the chain is hidden from the
+// client: the addresses found at the end are flattened into records owned by
+// the ALIAS. Targets outside of our zones are resolved through the upstream.
+//
+// If the chain ends in one of our zones without records of the type, that
+// zone and the name it ended at are returned too, which is what a negative
+// answer is given for. For ALIAS records, that is the ALIAS itself.
+func (ds *DNSServer) resolve(zone *config.Zone, name string, typ uint16) ([]dns.RR, *config.Zone, string, error) {
+	answers := []dns.RR{}
+	seen := map[string]struct{}{}
+
+	var (
+		alias      *dnsconfig.ALIAS
+		aliasOwner string
+		aliasZone  *config.Zone
+	)
+
+	for {
+		if _, ok := seen[name]; ok {
+			return nil, nil, "", fmt.Errorf("%w: %q was visited twice", ErrCNAMELoop, name)
+		}
+
+		seen[name] = struct{}{}
+
+		if len(seen) > MaxCNAMEChain {
+			return nil, nil, "", fmt.Errorf("%w: chain exceeded %d names at %q", ErrCNAMEChainTooLong, MaxCNAMEChain, name)
+		}
+
+		records := ds.lookup(zone, name, typ)
+		if len(records) != 0 {
+			if alias != nil {
+				records = flatten(records, aliasOwner, alias)
 			}
+
+			return append(answers, records...), nil, "", nil
+		}
+
+		if cname := ds.findCNAME(zone, name); cname != nil {
+			if alias == nil {
+				answers = append(answers, cname.Convert(name)...)
+			}
+
+			name = cname.Target
+		} else if a := ds.findALIAS(zone, name); a != nil && (typ == dns.TypeA || typ == dns.TypeAAAA) {
+			if alias == nil {
+				alias = a
+				aliasOwner = name
+				aliasZone = zone
+			}
+
+			name = a.Target
+		} else if alias != nil {
+			return answers, aliasZone, aliasOwner, nil
+		} else {
+			return answers, zone, name, nil
+		}
+
+		zone = ds.findZone(name)
+		if zone == nil {
+			if alias == nil {
+				return answers, nil, "", nil
+			}
+
+			records, err := ds.upstream(alias, name, typ)
+			if err != nil {
+				return nil, nil, "", err
+			}
+
+			if len(records) == 0 {
+				return answers, aliasZone, aliasOwner, nil
+			}
+
+			return append(answers, flatten(records, aliasOwner, alias)...), nil, "", nil
 		}
 	}
+}
+
+// addresses yields the A and AAAA records for a name, if it is a name we hold
+// records for. The boolean is false when the name is not ours, in which case
+// nothing can be said about its addresses.
+func (ds *DNSServer) addresses(name string) ([]dns.RR, bool) {
+	zone := ds.findZone(name)
+	if zone == nil {
+		return nil, false
+	}
+
+	var found bool
 
-	if len(answers) == 0 {
-		m.SetRcode(r, dns.RcodeNameError)
-		w.WriteMsg(m) // nolint:errcheck
+	owner := ds.owner(zone, name)
+
+	for _, rec := range zone.Records {
+		if rec.Name == owner {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return nil, false
+	}
+
+	ret := []dns.RR{}
+
+	for _, typ := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answers, _, _, err := ds.resolve(zone, name, typ)
+		if err != nil {
+			logrus.Errorf("While resolving addresses for %q: %v", name, err)
+			return nil, false
+		}
+
+		for _, answer := range answers {
+			switch answer.(type) {
+			case *dns.A, *dns.AAAA:
+				ret = append(ret, answer)
+			}
+		}
+	}
+
+	return ret, true
+}
+
+// exchangers filters MX answers for exchangers we know have no addresses left,
+// which happens when the health checker has pruned all of them.
+func (ds *DNSServer) exchangers(answers []dns.RR) []dns.RR {
+	filtered := []dns.RR{}
+
+	for _, answer := range answers {
+		mx, ok := answer.(*dns.MX)
+		if !ok {
+			filtered = append(filtered, answer)
+			continue
+		}
+
+		addresses, ok := ds.addresses(mx.Mx)
+		if ok && len(addresses) == 0 {
+			logrus.Debugf("Exchanger %q for %q has no live addresses: omitting", mx.Mx, mx.Hdr.Name)
+			continue
+		}
+
+		filtered = append(filtered, answer)
+	}
+
+	// if every exchanger is dead, hand them all out anyway; senders will queue
+	// and retry, which beats them falling back to the A record for the name.
+	for _, rr := range filtered {
+		if _, ok := rr.(*dns.MX); ok {
+			return filtered
+		}
+	}
+
+	return answers
+}
+
+// peerGlue yields addresses for a nameserver of the zone at apex from the
+// peer list. Only servers inside the zone get glue, and a server matches a
+// peer when its whole name, either fully qualified or relative to the apex, is
+// the name of the peer: both "ns1" and "ns1.example.com" match
+// "ns1.example.com." in example.com, but nothing matches "ns1.example.net.".
+func (ds *DNSServer) peerGlue(apex string, server string, ttl uint32) []dns.RR {
+	if ds.Config == nil || !dns.IsSubDomain(apex, server) {
+		return nil
+	}
+
+	peer, err := ds.Config.FindPeer(strings.TrimSuffix(server, "."))
+	if err != nil {
+		relative := strings.TrimSuffix(server, "."+apex)
+		if relative == server {
+			return nil
+		}
+
+		peer, err = ds.Config.FindPeer(relative)
+		if err != nil {
+			return nil
+		}
+	}
+
+	glue := []dns.RR{}
+
+	for _, ip := range peer.IPs {
+		glue = append(glue, addressRecord(server, ip, ttl))
+	}
+
+	return glue
+}
+
+// additional yields the addresses of names referenced by the answers: NS
+// servers, MX exchangers, SRV targets and CNAME targets. Only names we have
+// records for are included, except for nameservers, which may also be glued
+// to the IPs of the peer they name. This saves resolvers a round trip.
+func (ds *DNSServer) additional(answers []dns.RR) []dns.RR {
+	extra := []dns.RR{}
+	seen := map[string]struct{}{}
+
+	// don't repeat anything already in the answer, such as a chased CNAME.
+	for _, answer := range answers {
+		seen[answer.Header().Name] = struct{}{}
+	}
+
+	for _, answer := range answers {
+		var target string
+
+		switch rr := answer.(type) {
+		case *dns.NS:
+			target = rr.Ns
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		case *dns.CNAME:
+			target = rr.Target
+		default:
+			continue
+		}
+
+		if _, ok := seen[target]; ok {
+			continue
+		}
+
+		seen[target] = struct{}{}
+
+		addresses, _ := ds.addresses(target)
+		// NS records are only answered at the apex, so their owner is the zone.
+		if ns, ok := answer.(*dns.NS); ok && len(addresses) == 0 {
+			addresses = ds.peerGlue(ns.Hdr.Name, target, ns.Hdr.Ttl)
+		}
+
+		extra = append(extra, addresses...)
+	}
+
+	return extra
+}
+
+// writeMsg delivers the response, truncating it to fit the client's buffer
+// when answering over UDP. The TC bit will be set when this happens, which
+// tells the client to retry over TCP. Responses may also be dropped or
+// truncated by rate limiting, which accounts for them in the zone at apex.
+func (ds *DNSServer) writeMsg(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, apex string) {
+	if !ds.rateLimit(w, r, m, apex) {
 		return
 	}
 
+	if w.LocalAddr().Network() == "udp" {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+
+		m.Truncate(size)
+	}
+
+	w.WriteMsg(m) // nolint:errcheck
+}
+
+// apex finds the name of a zone.
+func (ds *DNSServer) apex(zone *config.Zone) string {
+	for name, z := range ds.Zones {
+		if z == zone {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// negative fills in a response with no answers: NXDOMAIN if the name does not
+// exist, NODATA (NOERROR with no answers) if it does but has nothing of the
+// type requested. Either way, the SOA goes in the authority section so that
+// resolvers know how long to cache the result for (RFC 2308).
+func (ds *DNSServer) negative(m *dns.Msg, zone *config.Zone, name string) {
+	if !ds.exists(zone, ds.owner(zone, name)) {
+		m.Rcode = dns.RcodeNameError
+	}
+
+	m.Ns = zone.SOA.Convert(ds.apex(zone))
+}
+
+func (ds *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetReply(r)
+
+	if len(r.Question) == 0 {
+		m.SetRcode(r, dns.RcodeFormatError)
+		ds.writeMsg(w, r, m, "")
+		return
+	}
+
+	if r.Opcode == dns.OpcodeUpdate {
+		ds.serveUpdate(w, r)
+		return
+	}
+
+	// NOTE: according to the docs for Questions, practically, only the first
+	// question matters. DNS the specced protocol supports multiple questions,
+	// but most servers only honor the first one. So we are going to avoid
+	// caring about any others and save ourselves some trouble.
+	name := r.Question[0].Name
+	typ := r.Question[0].Qtype
+
+	recursion := ds.recursionAllowed(w)
+
+	apex := ds.findApex(name)
+
+	zone := ds.Zones[apex]
+	if zone == nil {
+		if recursion && typ != dns.TypeAXFR && typ != dns.TypeIXFR {
+			ds.forward(w, r)
+			return
+		}
+
+		// not ours, so we have no business answering for it.
+		m.SetRcode(r, dns.RcodeRefused)
+		ds.writeMsg(w, r, m, "")
+		return
+	}
+
+	if typ == dns.TypeAXFR || typ == dns.TypeIXFR {
+		ds.serveTransfer(w, r, apex, zone)
+		return
+	}
+
+	// clients of a view are answered from the zones as the view sees them.
+	vs, ecs := ds.viewFor(w, r)
+	zone = vs.findZone(name)
+
+	answers := []dns.RR{}
+
+	// the zone and name to give a negative answer for, if there is nothing to
+	// answer with. A CNAME chain may have ended in another zone.
+	var (
+		end     *config.Zone
+		endName = name
+	)
+
+	switch {
+	// SOA and NS are special because they are special records, and only live at
+	// the apex.
+	case typ == dns.TypeSOA && vs.Zones[name] == zone:
+		answers = zone.SOA.Convert(name)
+	case typ == dns.TypeNS && vs.Zones[name] == zone:
+		answers = zone.NS.Convert(name)
+	case typ == dns.TypeDNSKEY && vs.Zones[name] == zone && zone.DNSSEC.Ready():
+		answers = zone.DNSSEC.DNSKEYs(name, zone.NS.TTL)
+	case typ == dns.TypeNSEC3PARAM && vs.Zones[name] == zone && zone.DNSSEC.Ready():
+		answers = []dns.RR{nsec3param(zone, name)}
+	case typ == dns.TypeDS && vs.Zones[name] == zone:
+		// DS records belong to the parent zone, so answer from there if it is
+		// ours.
+		if parent := vs.parentZone(name); parent != nil {
+			if zone.DNSSEC.Ready() {
+				answers = []dns.RR{zone.DNSSEC.DS(name, parent.NS.TTL)}
+			}
+
+			zone = parent
+		}
+	default:
+		var err error
+
+		answers, end, endName, err = vs.resolve(zone, name, typ)
+		if err != nil {
+			logrus.Errorf("While resolving %q: %v", name, err)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			ds.writeMsg(w, r, m, apex)
+			return
+		}
+
+		if typ == dns.TypeMX {
+			answers = vs.exchangers(answers)
+		}
+	}
+
+	extra := vs.additional(answers)
+
 	m.Authoritative = true
-	// NOTE we should verify if this setting is absolutely necessary, I cargo culted it from some old code.
-	m.RecursionAvailable = true
+	m.RecursionAvailable = recursion
+
+	if len(answers) == 0 && end == nil {
+		end, endName = zone, name
+	}
+
+	if end != nil {
+		vs.negative(m, end, endName)
+	}
+
 	m.Answer = answers
+	m.Extra = extra
 
-	w.WriteMsg(m) // nolint:errcheck
+	do := dnssecOK(r)
+	if do {
+		vs.secure(m, zone, name, end, endName)
+	}
+
+	if ecs != nil || do {
+		m.SetEdns0(r.IsEdns0().UDPSize(), do)
+
+		if ecs != nil {
+			m.IsEdns0().Option = append(m.IsEdns0().Option, ecs)
+		}
+	}
+
+	ds.writeMsg(w, r, m, apex)
 }
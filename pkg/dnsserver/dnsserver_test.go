@@ -2,13 +2,19 @@ package dnsserver
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
 	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/erikh/border/pkg/config"
 	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/erikh/border/pkg/josekit"
+	"github.com/erikh/go-hashchain"
 	"github.com/miekg/dns"
 )
 
@@ -215,3 +221,1298 @@ func TestFindZone(t *testing.T) {
 		}
 	}
 }
+
+func makeZones() map[string]*config.Zone {
+	return map[string]*config.Zone{
+		"test.home.arpa.": {
+			SOA: &dnsconfig.SOA{
+				Domain:  "test.home.arpa.",
+				Admin:   "administrator.test.home.arpa.",
+				MinTTL:  60,
+				Serial:  1,
+				Refresh: 60,
+				Retry:   60,
+				Expire:  60,
+			},
+			NS: &dnsconfig.NS{
+				Servers: []string{"test.home.arpa."},
+				TTL:     60,
+			},
+			Records: []*config.Record{},
+		},
+	}
+}
+
+func startServer(t *testing.T, zones map[string]*config.Zone) *DNSServer {
+	ds := &DNSServer{Zones: zones}
+
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	return ds
+}
+
+func query(t *testing.T, ds *DNSServer, name string, typ uint16) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion(name, typ)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	r, _, err := client.Exchange(m, ds.udpServer.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error querying %q (type %s): %v", name, dns.TypeToString[typ], err)
+	}
+
+	return r
+}
+
+func TestAAAA(t *testing.T) {
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "foo.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+				TTL:       60,
+			},
+		},
+		{
+			Name: "foo.test.home.arpa.",
+			Type: dnsconfig.TypeAAAA,
+			Value: &dnsconfig.AAAA{
+				Addresses: []net.IP{net.ParseIP("::1"), net.ParseIP("fe80::1")},
+				TTL:       60,
+			},
+		},
+	}
+
+	ds := startServer(t, zones)
+
+	r := query(t, ds, "foo.test.home.arpa.", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Unexpected rcode for A query: %d", r.Rcode)
+	}
+
+	// the v6 address in the A record must not leak into the answer
+	if len(r.Answer) != 1 {
+		t.Fatalf("Invalid number of answers for A query: %d", len(r.Answer))
+	}
+
+	if a, ok := r.Answer[0].(*dns.A); !ok || a.A.String() != "127.0.0.1" {
+		t.Fatalf("Unexpected answer for A query: %v", r.Answer[0])
+	}
+
+	r = query(t, ds, "foo.test.home.arpa.", dns.TypeAAAA)
+	if r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Unexpected rcode for AAAA query: %d", r.Rcode)
+	}
+
+	if len(r.Answer) != 2 {
+		t.Fatalf("Invalid number of answers for AAAA query: %d", len(r.Answer))
+	}
+
+	for i, expected := range []string{"::1", "fe80::1"} {
+		aaaa, ok := r.Answer[i].(*dns.AAAA)
+		if !ok {
+			t.Fatalf("Answer was not AAAA record: %v", r.Answer[i])
+		}
+
+		if aaaa.AAAA.String() != expected {
+			t.Fatalf("Unexpected result in AAAA record: %q (expected: %q)", aaaa.AAAA, expected)
+		}
+	}
+}
+
+func TestCNAME(t *testing.T) {
+	zones := makeZones()
+	zones["other.home.arpa."] = &config.Zone{
+		SOA: &dnsconfig.SOA{Domain: "other.home.arpa.", Admin: "administrator.other.home.arpa.", MinTTL: 60},
+		NS:  &dnsconfig.NS{Servers: []string{"other.home.arpa."}, TTL: 60},
+		Records: []*config.Record{
+			{
+				Name:  "www.other.home.arpa.",
+				Type:  dnsconfig.TypeCNAME,
+				Value: &dnsconfig.CNAME{Target: "balancer.test.home.arpa.", TTL: 60},
+			},
+		},
+	}
+
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "foo.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+				TTL:       60,
+			},
+		},
+		{
+			Name: "balancer.test.home.arpa.",
+			Type: dnsconfig.TypeLB,
+			Value: &dnsconfig.LB{
+				Listeners: []string{"127.0.0.2:80"},
+				TTL:       60,
+			},
+		},
+		{
+			Name:  "bar.test.home.arpa.",
+			Type:  dnsconfig.TypeCNAME,
+			Value: &dnsconfig.CNAME{Target: "baz.test.home.arpa.", TTL: 60},
+		},
+		{
+			Name:  "baz.test.home.arpa.",
+			Type:  dnsconfig.TypeCNAME,
+			Value: &dnsconfig.CNAME{Target: "foo.test.home.arpa.", TTL: 60},
+		},
+		{
+			Name:  "external.test.home.arpa.",
+			Type:  dnsconfig.TypeCNAME,
+			Value: &dnsconfig.CNAME{Target: "example.com.", TTL: 60},
+		},
+		{
+			Name:  "loop1.test.home.arpa.",
+			Type:  dnsconfig.TypeCNAME,
+			Value: &dnsconfig.CNAME{Target: "loop2.test.home.arpa.", TTL: 60},
+		},
+		{
+			Name:  "loop2.test.home.arpa.",
+			Type:  dnsconfig.TypeCNAME,
+			Value: &dnsconfig.CNAME{Target: "loop1.test.home.arpa.", TTL: 60},
+		},
+	}
+
+	// build a chain one longer than we're willing to follow
+	for i := 0; i < MaxCNAMEChain; i++ {
+		zones["test.home.arpa."].Records = append(zones["test.home.arpa."].Records, &config.Record{
+			Name:  fmt.Sprintf("long%d.test.home.arpa.", i),
+			Type:  dnsconfig.TypeCNAME,
+			Value: &dnsconfig.CNAME{Target: fmt.Sprintf("long%d.test.home.arpa.", i+1), TTL: 60},
+		})
+	}
+
+	ds := startServer(t, zones)
+
+	table := map[string]struct {
+		name    string
+		typ     uint16
+		targets []string
+		rcode   int
+	}{
+		"chain": {
+			name:    "bar.test.home.arpa.",
+			typ:     dns.TypeA,
+			targets: []string{"baz.test.home.arpa.", "foo.test.home.arpa.", "127.0.0.1"},
+		},
+		"cross-zone lb": {
+			name:    "www.other.home.arpa.",
+			typ:     dns.TypeA,
+			targets: []string{"balancer.test.home.arpa.", "127.0.0.2"},
+		},
+		"cname query": {
+			name:    "bar.test.home.arpa.",
+			typ:     dns.TypeCNAME,
+			targets: []string{"baz.test.home.arpa."},
+		},
+		"external": {
+			name:    "external.test.home.arpa.",
+			typ:     dns.TypeA,
+			targets: []string{"example.com."},
+		},
+		"loop": {
+			name:  "loop1.test.home.arpa.",
+			typ:   dns.TypeA,
+			rcode: dns.RcodeServerFailure,
+		},
+		"too long": {
+			name:  "long0.test.home.arpa.",
+			typ:   dns.TypeA,
+			rcode: dns.RcodeServerFailure,
+		},
+	}
+
+	for testName, test := range table {
+		r := query(t, ds, test.name, test.typ)
+		if r.Rcode != test.rcode {
+			t.Fatalf("Unexpected rcode for %q: %d (expected: %d)", testName, r.Rcode, test.rcode)
+		}
+
+		if len(r.Answer) != len(test.targets) {
+			t.Fatalf("Invalid number of answers for %q: %d (expected: %d)", testName, len(r.Answer), len(test.targets))
+		}
+
+		for i, target := range test.targets {
+			var value string
+
+			switch rr := r.Answer[i].(type) {
+			case *dns.CNAME:
+				value = rr.Target
+			case *dns.A:
+				value = rr.A.String()
+			default:
+				t.Fatalf("Unexpected record type in answer for %q: %v", testName, rr)
+			}
+
+			if value != target {
+				t.Fatalf("Unexpected answer %d for %q: %q (expected: %q)", i, testName, value, target)
+			}
+		}
+	}
+}
+
+func TestMX(t *testing.T) {
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "mail.test.home.arpa.",
+			Type: dnsconfig.TypeMX,
+			Value: &dnsconfig.MX{
+				Exchangers: []*dnsconfig.MXExchanger{
+					{Preference: 10, Exchange: "mx1.test.home.arpa."},
+					{Preference: 20, Exchange: "mx2.test.home.arpa."},
+					{Preference: 30, Exchange: "mx.example.com."},
+				},
+				TTL: 60,
+			},
+		},
+		{
+			Name: "dead.test.home.arpa.",
+			Type: dnsconfig.TypeMX,
+			Value: &dnsconfig.MX{
+				Exchangers: []*dnsconfig.MXExchanger{
+					{Preference: 10, Exchange: "mx2.test.home.arpa."},
+				},
+				TTL: 60,
+			},
+		},
+		{
+			Name: "mx1.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+				TTL:       60,
+			},
+		},
+		{
+			// all addresses have been pruned by the health checker
+			Name: "mx2.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{},
+				TTL:       60,
+			},
+		},
+	}
+
+	ds := startServer(t, zones)
+
+	r := query(t, ds, "mail.test.home.arpa.", dns.TypeMX)
+	if r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Unexpected rcode for MX query: %d", r.Rcode)
+	}
+
+	if len(r.Answer) != 2 {
+		t.Fatalf("Invalid number of answers for MX query: %d", len(r.Answer))
+	}
+
+	for i, expected := range []string{"mx1.test.home.arpa.", "mx.example.com."} {
+		mx, ok := r.Answer[i].(*dns.MX)
+		if !ok {
+			t.Fatalf("Answer was not MX record: %v", r.Answer[i])
+		}
+
+		if mx.Mx != expected {
+			t.Fatalf("Unexpected exchanger in MX answer: %q (expected: %q)", mx.Mx, expected)
+		}
+	}
+
+	if len(r.Extra) != 1 {
+		t.Fatalf("Invalid number of additional records for MX query: %d", len(r.Extra))
+	}
+
+	if a, ok := r.Extra[0].(*dns.A); !ok || a.Hdr.Name != "mx1.test.home.arpa." || a.A.String() != "127.0.0.1" {
+		t.Fatalf("Unexpected additional record for MX query: %v", r.Extra[0])
+	}
+
+	// with every exchanger dead, the full set is returned
+	r = query(t, ds, "dead.test.home.arpa.", dns.TypeMX)
+	if len(r.Answer) != 1 {
+		t.Fatalf("Invalid number of answers for MX query with no live exchangers: %d", len(r.Answer))
+	}
+}
+
+func TestTXT(t *testing.T) {
+	long := strings.Repeat("0123456789", 60)
+
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "txt.test.home.arpa.",
+			Type: dnsconfig.TypeTXT,
+			Value: &dnsconfig.TXT{
+				Values: []string{long},
+				TTL:    60,
+			},
+		},
+		{
+			Name: "escaped.test.home.arpa.",
+			Type: dnsconfig.TypeTXT,
+			Value: &dnsconfig.TXT{
+				Values: []string{`a\b`},
+				TTL:    60,
+			},
+		},
+	}
+
+	ds := startServer(t, zones)
+
+	r := query(t, ds, "txt.test.home.arpa.", dns.TypeTXT)
+	if r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Unexpected rcode for TXT query: %d", r.Rcode)
+	}
+
+	if len(r.Answer) != 1 {
+		t.Fatalf("Invalid number of answers for TXT query: %d", len(r.Answer))
+	}
+
+	txt, ok := r.Answer[0].(*dns.TXT)
+	if !ok {
+		t.Fatalf("Answer was not TXT record: %v", r.Answer[0])
+	}
+
+	if len(txt.Txt) != 3 {
+		t.Fatalf("Unexpected number of character-strings in TXT record: %d", len(txt.Txt))
+	}
+
+	for _, chunk := range txt.Txt {
+		if len(chunk) > dnsconfig.TXTChunkSize {
+			t.Fatalf("character-string was larger than %d bytes: %d", dnsconfig.TXTChunkSize, len(chunk))
+		}
+	}
+
+	if strings.Join(txt.Txt, "") != long {
+		t.Fatal("TXT record did not reassemble into the original value")
+	}
+
+	// without EDNS the answer will not fit in a UDP packet, so it should be
+	// truncated.
+	m := &dns.Msg{}
+	m.SetQuestion("txt.test.home.arpa.", dns.TypeTXT)
+
+	r, _, err := (&dns.Client{Net: "udp", Timeout: time.Second}).Exchange(m, ds.udpServer.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !r.Truncated {
+		t.Fatal("Oversized UDP response was not truncated")
+	}
+
+	r = query(t, ds, "escaped.test.home.arpa.", dns.TypeTXT)
+	if len(r.Answer) != 1 {
+		t.Fatalf("Invalid number of answers for TXT query: %d", len(r.Answer))
+	}
+
+	// the dns package presents backslashes escaped
+	if txt := r.Answer[0].(*dns.TXT); len(txt.Txt) != 1 || txt.Txt[0] != `a\\b` {
+		t.Fatalf("Backslash did not survive the round trip: %v", txt.Txt)
+	}
+}
+
+func TestSRV(t *testing.T) {
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "_ldap._tcp.test.home.arpa.",
+			Type: dnsconfig.TypeSRV,
+			Value: &dnsconfig.SRV{
+				Targets: []*dnsconfig.SRVTarget{
+					{Priority: 0, Weight: 100, Port: 389, Target: "dc1.test.home.arpa."},
+					{Priority: 10, Weight: 50, Port: 389, Target: "dc2.test.home.arpa."},
+				},
+				TTL: 60,
+			},
+		},
+	}
+
+	ds := startServer(t, zones)
+
+	r := query(t, ds, "_ldap._tcp.test.home.arpa.", dns.TypeSRV)
+	if r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Unexpected rcode for SRV query: %d", r.Rcode)
+	}
+
+	if len(r.Answer) != 2 {
+		t.Fatalf("Invalid number of answers for SRV query: %d", len(r.Answer))
+	}
+
+	srv, ok := r.Answer[1].(*dns.SRV)
+	if !ok {
+		t.Fatalf("Answer was not SRV record: %v", r.Answer[1])
+	}
+
+	if srv.Priority != 10 || srv.Weight != 50 || srv.Port != 389 || srv.Target != "dc2.test.home.arpa." {
+		t.Fatalf("Unexpected result in SRV record: %v", srv)
+	}
+}
+
+func TestCAA(t *testing.T) {
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "test.home.arpa.",
+			Type: dnsconfig.TypeCAA,
+			Value: &dnsconfig.CAA{
+				Policies: []*dnsconfig.CAAPolicy{
+					{Tag: "issue", Value: "letsencrypt.org"},
+					{Flag: 128, Tag: "iodef", Value: "mailto:security@test.home.arpa"},
+				},
+				TTL: 60,
+			},
+		},
+	}
+
+	ds := startServer(t, zones)
+
+	r := query(t, ds, "test.home.arpa.", dns.TypeCAA)
+	if r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Unexpected rcode for CAA query: %d", r.Rcode)
+	}
+
+	if len(r.Answer) != 2 {
+		t.Fatalf("Invalid number of answers for CAA query: %d", len(r.Answer))
+	}
+
+	caa, ok := r.Answer[0].(*dns.CAA)
+	if !ok {
+		t.Fatalf("Answer was not CAA record: %v", r.Answer[0])
+	}
+
+	if caa.Flag != 0 || caa.Tag != "issue" || caa.Value != "letsencrypt.org" {
+		t.Fatalf("Unexpected result in CAA record: %v", caa)
+	}
+
+	caa = r.Answer[1].(*dns.CAA)
+	if caa.Flag != 128 || caa.Tag != "iodef" || caa.Value != "mailto:security@test.home.arpa" {
+		t.Fatalf("Unexpected result in CAA record: %v", caa)
+	}
+}
+
+func TestReverseIP(t *testing.T) {
+	table := map[string]string{
+		"1.0.0.127.in-addr.arpa.": "127.0.0.1",
+		"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.": "::2",
+		"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.IP6.ARPA.": "4321:0:1:2:3:4:567:89ab",
+		"0.0.127.in-addr.arpa.":     "",
+		"256.0.0.127.in-addr.arpa.": "",
+		"1.0.0.127.example.com.":    "",
+	}
+
+	for name, expected := range table {
+		ip := reverseIP(name)
+		if expected == "" {
+			if ip != nil {
+				t.Fatalf("%q should not have parsed, but yielded %v", name, ip)
+			}
+
+			continue
+		}
+
+		if ip == nil || !ip.Equal(net.ParseIP(expected)) {
+			t.Fatalf("%q did not parse to %q: %v", name, expected, ip)
+		}
+	}
+}
+
+func TestAutoReverse(t *testing.T) {
+	key, err := josekit.MakeKey("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := config.New(hashchain.New(nil))
+	c.Peers = []*config.Peer{{
+		Key: key,
+		IPs: []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("::2")},
+	}}
+
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "foo.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+				TTL:       60,
+			},
+		},
+		{
+			Name: "balancer.test.home.arpa.",
+			Type: dnsconfig.TypeLB,
+			Value: &dnsconfig.LB{
+				Listeners: []string{"peer:80"},
+				TTL:       60,
+			},
+		},
+		{
+			// wildcards are never PTR targets.
+			Name: "*.apps.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.3")},
+				TTL:       60,
+			},
+		},
+	}
+
+	for _, name := range []string{"0.0.127.in-addr.arpa.", "ip6.arpa."} {
+		zones[name] = &config.Zone{
+			SOA:     &dnsconfig.SOA{Domain: name, Admin: "administrator.test.home.arpa.", MinTTL: 30},
+			NS:      &dnsconfig.NS{Servers: []string{"test.home.arpa."}, TTL: 30},
+			Records: []*config.Record{},
+			Auto:    true,
+		}
+	}
+
+	ds := &DNSServer{Zones: zones, Config: c}
+
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	table := map[string]string{
+		"1.0.0.127.in-addr.arpa.": "foo.test.home.arpa.",
+		"2.0.0.127.in-addr.arpa.": "balancer.test.home.arpa.",
+		"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.": "balancer.test.home.arpa.",
+	}
+
+	for name, target := range table {
+		r := query(t, ds, name, dns.TypePTR)
+		if r.Rcode != dns.RcodeSuccess {
+			t.Fatalf("Unexpected rcode for PTR query %q: %d", name, r.Rcode)
+		}
+
+		if len(r.Answer) != 1 {
+			t.Fatalf("Invalid number of answers for PTR query %q: %d", name, len(r.Answer))
+		}
+
+		ptr, ok := r.Answer[0].(*dns.PTR)
+		if !ok {
+			t.Fatalf("Answer was not PTR record: %v", r.Answer[0])
+		}
+
+		if ptr.Ptr != target || ptr.Hdr.Ttl != 30 {
+			t.Fatalf("Unexpected result in PTR record for %q: %v", name, ptr)
+		}
+	}
+
+	r := query(t, ds, "3.0.0.127.in-addr.arpa.", dns.TypePTR)
+	if r.Rcode != dns.RcodeNameError || len(r.Answer) != 0 {
+		t.Fatalf("Address of a wildcard was given a PTR record: %v", r)
+	}
+
+	// simulate the health checker pruning the address
+	zones["test.home.arpa."].Records[0].Value.(*dnsconfig.A).Addresses = []net.IP{}
+
+	r = query(t, ds, "1.0.0.127.in-addr.arpa.", dns.TypePTR)
+	if len(r.Answer) != 0 {
+		t.Fatalf("PTR record for pruned address was still served: %v", r.Answer)
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "*.apps.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+				TTL:       60,
+			},
+		},
+		{
+			Name: "foo.apps.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.2")},
+				TTL:       60,
+			},
+		},
+		{
+			Name: "x.y.apps.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.3")},
+				TTL:       60,
+			},
+		},
+		{
+			Name: "*.preview.test.home.arpa.",
+			Type: dnsconfig.TypeLB,
+			Value: &dnsconfig.LB{
+				Listeners: []string{"127.0.0.4:80"},
+				TTL:       60,
+			},
+		},
+		{
+			Name:  "*.alias.test.home.arpa.",
+			Type:  dnsconfig.TypeCNAME,
+			Value: &dnsconfig.CNAME{Target: "foo.apps.test.home.arpa.", TTL: 60},
+		},
+	}
+
+	ds := startServer(t, zones)
+
+	table := map[string][]string{
+		"bar.apps.test.home.arpa.":        {"127.0.0.1"},
+		"a.b.apps.test.home.arpa.":        {"127.0.0.1"},
+		"foo.apps.test.home.arpa.":        {"127.0.0.2"},
+		"x.y.apps.test.home.arpa.":        {"127.0.0.3"},
+		"tenant1.preview.test.home.arpa.": {"127.0.0.4"},
+		"www.alias.test.home.arpa.":       {"foo.apps.test.home.arpa.", "127.0.0.2"},
+		// y.apps exists as an empty non-terminal, so neither it nor names
+		// below it match the wildcard.
+		"y.apps.test.home.arpa.":   {},
+		"z.y.apps.test.home.arpa.": {},
+		// the wildcard does not apply to the encloser itself
+		"apps.test.home.arpa.": {},
+	}
+
+	for name, expected := range table {
+		r := query(t, ds, name, dns.TypeA)
+
+		if len(r.Answer) != len(expected) {
+			t.Fatalf("Invalid number of answers for %q: %d (expected: %d)", name, len(r.Answer), len(expected))
+		}
+
+		for i, value := range expected {
+			switch rr := r.Answer[i].(type) {
+			case *dns.A:
+				if rr.A.String() != value {
+					t.Fatalf("Unexpected address for %q: %q (expected: %q)", name, rr.A, value)
+				}
+			case *dns.CNAME:
+				if rr.Target != value {
+					t.Fatalf("Unexpected target for %q: %q (expected: %q)", name, rr.Target, value)
+				}
+			}
+
+			// the first record is always owned by the query name, even when synthesized.
+			if i == 0 && r.Answer[i].Header().Name != name {
+				t.Fatalf("Owner of answer was not rewritten for %q: %q", name, r.Answer[i].Header().Name)
+			}
+		}
+	}
+}
+
+func TestALIAS(t *testing.T) {
+	var upstreamQueries atomic.Int32
+
+	upstream := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		upstreamQueries.Add(1)
+
+		m := &dns.Msg{}
+		m.SetReply(r)
+
+		if r.Question[0].Name == "external.example.com." && r.Question[0].Qtype == dns.TypeA {
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: "external.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+				A:   net.ParseIP("192.0.2.1"),
+			}}
+		}
+
+		w.WriteMsg(m) // nolint:errcheck
+	})}
+
+	started := make(chan struct{})
+	upstream.NotifyStartedFunc = func() { close(started) }
+
+	go upstream.ListenAndServe() // nolint:errcheck
+	<-started
+
+	t.Cleanup(func() {
+		upstream.Shutdown() // nolint:errcheck
+	})
+
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name:  "test.home.arpa.",
+			Type:  dnsconfig.TypeALIAS,
+			Value: &dnsconfig.ALIAS{Target: "balancer.test.home.arpa.", TTL: 60},
+		},
+		{
+			Name: "balancer.test.home.arpa.",
+			Type: dnsconfig.TypeLB,
+			Value: &dnsconfig.LB{
+				Listeners: []string{"127.0.0.2:80", "[::2]:80"},
+				TTL:       120,
+			},
+		},
+		{
+			Name: "external.test.home.arpa.",
+			Type: dnsconfig.TypeALIAS,
+			Value: &dnsconfig.ALIAS{
+				Target:   "external.example.com.",
+				Resolver: upstream.PacketConn.LocalAddr().String(),
+				TTL:      60,
+			},
+		},
+	}
+
+	ds := startServer(t, zones)
+
+	table := map[string]struct {
+		name    string
+		typ     uint16
+		address string
+		ttl     uint32
+	}{
+		"apex v4": {
+			name:    "test.home.arpa.",
+			typ:     dns.TypeA,
+			address: "127.0.0.2",
+			ttl:     60,
+		},
+		"apex v6": {
+			name:    "test.home.arpa.",
+			typ:     dns.TypeAAAA,
+			address: "::2",
+			ttl:     60,
+		},
+		"external": {
+			name:    "external.test.home.arpa.",
+			typ:     dns.TypeA,
+			address: "192.0.2.1",
+			ttl:     10,
+		},
+	}
+
+	for testName, test := range table {
+		r := query(t, ds, test.name, test.typ)
+		if r.Rcode != dns.RcodeSuccess {
+			t.Fatalf("Unexpected rcode for %q: %d", testName, r.Rcode)
+		}
+
+		if len(r.Answer) != 1 {
+			t.Fatalf("Invalid number of answers for %q: %d", testName, len(r.Answer))
+		}
+
+		hdr := r.Answer[0].Header()
+		if hdr.Name != test.name || hdr.Rrtype != test.typ || hdr.Ttl != test.ttl {
+			t.Fatalf("Unexpected header in answer for %q: %v", testName, r.Answer[0])
+		}
+
+		var address net.IP
+
+		switch rr := r.Answer[0].(type) {
+		case *dns.A:
+			address = rr.A
+		case *dns.AAAA:
+			address = rr.AAAA
+		}
+
+		if !address.Equal(net.ParseIP(test.address)) {
+			t.Fatalf("Unexpected address in answer for %q: %v", testName, address)
+		}
+	}
+
+	// the upstream answer should be cached now.
+	query(t, ds, "external.test.home.arpa.", dns.TypeA)
+
+	if count := upstreamQueries.Load(); count != 1 {
+		t.Fatalf("Upstream answer was not cached: %d queries were made", count)
+	}
+}
+
+func TestNegativeResponses(t *testing.T) {
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "foo.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+				TTL:       60,
+			},
+		},
+		{
+			Name: "x.y.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+				TTL:       60,
+			},
+		},
+		{
+			Name: "*.apps.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+				TTL:       60,
+			},
+		},
+	}
+
+	ds := startServer(t, zones)
+
+	table := map[string]struct {
+		name  string
+		typ   uint16
+		rcode int
+		soa   bool
+	}{
+		"nodata": {
+			name:  "foo.test.home.arpa.",
+			typ:   dns.TypeAAAA,
+			rcode: dns.RcodeSuccess,
+			soa:   true,
+		},
+		"nxdomain": {
+			name:  "bar.test.home.arpa.",
+			typ:   dns.TypeA,
+			rcode: dns.RcodeNameError,
+			soa:   true,
+		},
+		"empty non-terminal": {
+			name:  "y.test.home.arpa.",
+			typ:   dns.TypeA,
+			rcode: dns.RcodeSuccess,
+			soa:   true,
+		},
+		"wildcard nodata": {
+			name:  "bar.apps.test.home.arpa.",
+			typ:   dns.TypeTXT,
+			rcode: dns.RcodeSuccess,
+			soa:   true,
+		},
+		"soa below apex": {
+			name:  "foo.test.home.arpa.",
+			typ:   dns.TypeSOA,
+			rcode: dns.RcodeSuccess,
+			soa:   true,
+		},
+		"ns below apex": {
+			name:  "bar.test.home.arpa.",
+			typ:   dns.TypeNS,
+			rcode: dns.RcodeNameError,
+			soa:   true,
+		},
+		"refused": {
+			name:  "example.com.",
+			typ:   dns.TypeA,
+			rcode: dns.RcodeRefused,
+		},
+	}
+
+	for testName, test := range table {
+		r := query(t, ds, test.name, test.typ)
+		if r.Rcode != test.rcode {
+			t.Fatalf("Unexpected rcode for %q: %s (expected: %s)", testName, dns.RcodeToString[r.Rcode], dns.RcodeToString[test.rcode])
+		}
+
+		if len(r.Answer) != 0 {
+			t.Fatalf("Answers were returned for %q: %v", testName, r.Answer)
+		}
+
+		if !test.soa {
+			if len(r.Ns) != 0 || r.Authoritative {
+				t.Fatalf("Authoritative data was returned for %q: %v", testName, r.Ns)
+			}
+
+			continue
+		}
+
+		if !r.Authoritative {
+			t.Fatalf("Response for %q was not authoritative", testName)
+		}
+
+		if len(r.Ns) != 1 {
+			t.Fatalf("Invalid number of authority records for %q: %d", testName, len(r.Ns))
+		}
+
+		soa, ok := r.Ns[0].(*dns.SOA)
+		if !ok {
+			t.Fatalf("Authority record was not SOA for %q: %v", testName, r.Ns[0])
+		}
+
+		if soa.Hdr.Name != "test.home.arpa." || soa.Hdr.Ttl != 60 || soa.Minttl != 60 {
+			t.Fatalf("Unexpected SOA in authority section for %q: %v", testName, soa)
+		}
+	}
+}
+
+func TestNegativeCNAMEChain(t *testing.T) {
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name:  "nodata.test.home.arpa.",
+			Type:  dnsconfig.TypeCNAME,
+			Value: &dnsconfig.CNAME{Target: "foo.other.home.arpa.", TTL: 60},
+		},
+		{
+			Name:  "nxdomain.test.home.arpa.",
+			Type:  dnsconfig.TypeCNAME,
+			Value: &dnsconfig.CNAME{Target: "bar.other.home.arpa.", TTL: 60},
+		},
+	}
+
+	zones["other.home.arpa."] = &config.Zone{
+		SOA: &dnsconfig.SOA{Domain: "other.home.arpa.", Admin: "administrator.other.home.arpa.", MinTTL: 30, Serial: 1},
+		NS:  &dnsconfig.NS{Servers: []string{"test.home.arpa."}, TTL: 30},
+		Records: []*config.Record{
+			{
+				Name: "foo.other.home.arpa.",
+				Type: dnsconfig.TypeA,
+				Value: &dnsconfig.A{
+					Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+					TTL:       30,
+				},
+			},
+		},
+	}
+
+	for _, zone := range zones {
+		zone.DNSSEC = &config.DNSSEC{}
+	}
+
+	if _, err := (&config.Config{Zones: zones}).GenerateDNSSECKeys(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := startServer(t, zones)
+
+	table := map[string]struct {
+		rcode  int
+		target string
+	}{
+		"nodata.test.home.arpa.":   {rcode: dns.RcodeSuccess, target: "foo.other.home.arpa."},
+		"nxdomain.test.home.arpa.": {rcode: dns.RcodeNameError, target: "bar.other.home.arpa."},
+	}
+
+	keys := append(dnskeys(t, ds, "test.home.arpa."), dnskeys(t, ds, "other.home.arpa.")...)
+
+	for name, test := range table {
+		r := query(t, ds, name, dns.TypeAAAA)
+		if r.Rcode != test.rcode {
+			t.Fatalf("Unexpected rcode for %q: %s (expected: %s)", name, dns.RcodeToString[r.Rcode], dns.RcodeToString[test.rcode])
+		}
+
+		if len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeCNAME {
+			t.Fatalf("CNAME was not answered for %q: %v", name, r.Answer)
+		}
+
+		// the SOA is of the zone the chain ended in.
+		if len(r.Ns) != 1 || r.Ns[0].Header().Name != "other.home.arpa." || r.Ns[0].Header().Ttl != 30 {
+			t.Fatalf("Unexpected authority section for %q: %v", name, r.Ns)
+		}
+
+		// validators need the denial proven for the target, not the name
+		// asked for, which exists.
+		r = querySigned(t, ds, name, dns.TypeAAAA)
+		if r.Rcode != test.rcode {
+			t.Fatalf("Unexpected rcode for %q with DNSSEC: %s (expected: %s)", name, dns.RcodeToString[r.Rcode], dns.RcodeToString[test.rcode])
+		}
+
+		verify(t, r.Answer, keys)
+		verify(t, r.Ns, keys)
+
+		nsec3s := nsec3s(r.Ns)
+
+		if test.rcode == dns.RcodeNameError {
+			if matched(nsec3s, test.target) != nil || !covered(nsec3s, test.target) {
+				t.Fatalf("Target of %q was not proven not to exist: %v", name, r.Ns)
+			}
+		} else if nsec3 := matched(nsec3s, test.target); nsec3 == nil {
+			t.Fatalf("Target of %q was not matched: %v", name, r.Ns)
+		} else {
+			for _, typ := range nsec3.TypeBitMap {
+				if typ == dns.TypeAAAA {
+					t.Fatalf("Target of %q has the type it was denied: %v", name, nsec3)
+				}
+			}
+		}
+
+		if matched(nsec3s, name) != nil {
+			t.Fatalf("Denial for %q was proven for the name asked for: %v", name, r.Ns)
+		}
+	}
+}
+
+func TestAdditional(t *testing.T) {
+	key, err := josekit.MakeKey("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := config.New(hashchain.New(nil))
+	c.Peers = []*config.Peer{{
+		Key: key,
+		IPs: []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("::2")},
+	}}
+
+	zones := makeZones()
+	// only the second is glued to the peer: the others are outside the zone, or
+	// only share their first label with the peer.
+	zones["test.home.arpa."].NS.Servers = []string{"ns1.test.home.arpa.", "peer.test.home.arpa.", "ns.example.com.", "peer.example.com.", "peer.sub.test.home.arpa."}
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "ns1.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+				TTL:       60,
+			},
+		},
+		{
+			Name: "_ldap._tcp.test.home.arpa.",
+			Type: dnsconfig.TypeSRV,
+			Value: &dnsconfig.SRV{
+				Targets: []*dnsconfig.SRVTarget{
+					{Port: 389, Target: "ns1.test.home.arpa."},
+					{Port: 389, Target: "dc.example.com."},
+				},
+				TTL: 60,
+			},
+		},
+		{
+			Name:  "www.test.home.arpa.",
+			Type:  dnsconfig.TypeCNAME,
+			Value: &dnsconfig.CNAME{Target: "ns1.test.home.arpa.", TTL: 60},
+		},
+	}
+
+	ds := &DNSServer{Zones: zones, Config: c}
+
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	table := map[string]struct {
+		name  string
+		typ   uint16
+		extra []string
+	}{
+		"ns": {
+			name:  "test.home.arpa.",
+			typ:   dns.TypeNS,
+			extra: []string{"ns1.test.home.arpa./127.0.0.1", "peer.test.home.arpa./127.0.0.2", "peer.test.home.arpa./::2"},
+		},
+		"srv": {
+			name:  "_ldap._tcp.test.home.arpa.",
+			typ:   dns.TypeSRV,
+			extra: []string{"ns1.test.home.arpa./127.0.0.1"},
+		},
+		"cname": {
+			name:  "www.test.home.arpa.",
+			typ:   dns.TypeCNAME,
+			extra: []string{"ns1.test.home.arpa./127.0.0.1"},
+		},
+		// the target is chased into the answer, so it is not repeated.
+		"chased cname": {
+			name:  "www.test.home.arpa.",
+			typ:   dns.TypeA,
+			extra: []string{},
+		},
+	}
+
+	for testName, test := range table {
+		r := query(t, ds, test.name, test.typ)
+		if r.Rcode != dns.RcodeSuccess {
+			t.Fatalf("Unexpected rcode for %q: %d", testName, r.Rcode)
+		}
+
+		extra := []string{}
+
+		for _, rr := range r.Extra {
+			switch rr := rr.(type) {
+			case *dns.A:
+				extra = append(extra, rr.Hdr.Name+"/"+rr.A.String())
+			case *dns.AAAA:
+				extra = append(extra, rr.Hdr.Name+"/"+rr.AAAA.String())
+			}
+		}
+
+		if !reflect.DeepEqual(extra, test.extra) {
+			t.Fatalf("Unexpected additional records for %q: %v (expected: %v)", testName, extra, test.extra)
+		}
+	}
+}
+
+func TestOrdering(t *testing.T) {
+	addresses := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")}
+
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name:  "fixed.test.home.arpa.",
+			Type:  dnsconfig.TypeA,
+			Value: &dnsconfig.A{Addresses: addresses, TTL: 60},
+		},
+		{
+			Name:  "roundrobin.test.home.arpa.",
+			Type:  dnsconfig.TypeA,
+			Value: &dnsconfig.A{Addresses: addresses, TTL: 60, Order: dnsconfig.OrderingRoundRobin},
+		},
+		{
+			Name:  "random.test.home.arpa.",
+			Type:  dnsconfig.TypeA,
+			Value: &dnsconfig.A{Addresses: addresses, TTL: 60, Order: dnsconfig.OrderingRandom, MaxAnswers: 1},
+		},
+		{
+			Name: "lb.test.home.arpa.",
+			Type: dnsconfig.TypeLB,
+			Value: &dnsconfig.LB{
+				Listeners:  []string{"127.0.0.1:80", "[::1]:80", "127.0.0.2:80"},
+				TTL:        60,
+				Order:      dnsconfig.OrderingRoundRobin,
+				MaxAnswers: 1,
+			},
+		},
+	}
+
+	ds := startServer(t, zones)
+
+	answers := func(name string, typ uint16) []string {
+		r := query(t, ds, name, typ)
+
+		addresses := []string{}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addresses = append(addresses, rr.A.String())
+			case *dns.AAAA:
+				addresses = append(addresses, rr.AAAA.String())
+			}
+		}
+
+		return addresses
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := answers("fixed.test.home.arpa.", dns.TypeA); !reflect.DeepEqual(got, []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}) {
+			t.Fatalf("Fixed answers were reordered: %v", got)
+		}
+	}
+
+	expected := [][]string{
+		{"127.0.0.1", "127.0.0.2", "127.0.0.3"},
+		{"127.0.0.2", "127.0.0.3", "127.0.0.1"},
+		{"127.0.0.3", "127.0.0.1", "127.0.0.2"},
+		{"127.0.0.1", "127.0.0.2", "127.0.0.3"},
+	}
+
+	for _, want := range expected {
+		if got := answers("roundrobin.test.home.arpa.", dns.TypeA); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Unexpected round-robin answers: %v (expected %v)", got, want)
+		}
+	}
+
+	seen := map[string]bool{}
+
+	for i := 0; i < 100; i++ {
+		got := answers("random.test.home.arpa.", dns.TypeA)
+		if len(got) != 1 {
+			t.Fatalf("max_answers was not applied: %v", got)
+		}
+
+		seen[got[0]] = true
+	}
+
+	if len(seen) != len(addresses) {
+		t.Fatalf("Random answers did not spread across the addresses: %v", seen)
+	}
+
+	// LB records rotate the addresses of the query type only.
+	for _, want := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"} {
+		if got := answers("lb.test.home.arpa.", dns.TypeA); !reflect.DeepEqual(got, []string{want}) {
+			t.Fatalf("Unexpected LB answers: %v (expected %v)", got, want)
+		}
+	}
+
+	if got := answers("lb.test.home.arpa.", dns.TypeAAAA); !reflect.DeepEqual(got, []string{"::1"}) {
+		t.Fatalf("Unexpected LB answers: %v", got)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	ds := &DNSServer{}
+
+	record := func(value dnsconfig.Record) *config.Record {
+		typ := dnsconfig.TypeA
+		if _, ok := value.(*dnsconfig.LB); ok {
+			typ = dnsconfig.TypeLB
+		}
+
+		return &config.Record{Name: "foo.test.home.arpa.", Type: typ, Value: value}
+	}
+
+	// counts the first answer given over many queries.
+	count := func(rec *config.Record) map[string]int {
+		counts := map[string]int{}
+
+		for i := 0; i < 10000; i++ {
+			answers := ds.order(rec, rec.Value.Convert(rec.Name))
+			if len(answers) != 1 {
+				t.Fatalf("Weighted record gave %d answers", len(answers))
+			}
+
+			counts[answers[0].(*dns.A).A.String()]++
+		}
+
+		return counts
+	}
+
+	a := &dnsconfig.A{
+		Addresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")},
+		Weights:   map[string]float64{"127.0.0.1": 90, "127.0.0.2": 10},
+	}
+
+	if counts := count(record(a)); counts["127.0.0.1"] < 8500 || counts["127.0.0.1"] > 9500 {
+		t.Fatalf("Answers were not given according to their weights: %v", counts)
+	}
+
+	// a health check pruned the heavier address.
+	a.Addresses = []net.IP{net.ParseIP("127.0.0.2")}
+
+	if counts := count(record(a)); counts["127.0.0.2"] != 10000 {
+		t.Fatalf("Remaining address was not always given: %v", counts)
+	}
+
+	// addresses weighing nothing are only given when nothing else is left.
+	a.Addresses = []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")}
+	a.Weights = map[string]float64{"127.0.0.1": 1, "127.0.0.3": 0}
+
+	if counts := count(record(a)); counts["127.0.0.3"] != 0 || counts["127.0.0.1"] < 4500 || counts["127.0.0.1"] > 5500 {
+		t.Fatalf("Answers were not given according to their weights: %v", counts)
+	}
+
+	a.MaxAnswers = 3
+
+	if answers := ds.order(record(a), a.Convert("foo.test.home.arpa.")); len(answers) != 3 || answers[2].(*dns.A).A.String() != "127.0.0.3" {
+		t.Fatalf("Address weighing nothing was not given last: %v", answers)
+	}
+
+	lb := &dnsconfig.LB{
+		Listeners: []string{"127.0.0.1:80", "127.0.0.2:80"},
+		Weights:   map[string]float64{"127.0.0.1:80": 0, "127.0.0.2:80": 1},
+	}
+
+	if counts := count(record(lb)); counts["127.0.0.2"] != 10000 {
+		t.Fatalf("LB answers were not given according to their weights: %v", counts)
+	}
+}
@@ -0,0 +1,160 @@
+package dnsserver
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DoHPath is where DNS-over-HTTPS queries are served, as suggested by RFC
+	// 8484.
+	DoHPath = "/dns-query"
+	// DoHContentType is the media type of DNS messages over HTTPS.
+	DoHContentType = "application/dns-message"
+)
+
+// dohWriter adapts an HTTP request to the dns.ResponseWriter ServeDNS wants,
+// holding on to the response so it can be written out over HTTP.
+type dohWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (dw *dohWriter) LocalAddr() net.Addr  { return dw.local }
+func (dw *dohWriter) RemoteAddr() net.Addr { return dw.remote }
+func (dw *dohWriter) TsigStatus() error    { return errors.New("TSIG is not verified over HTTPS") }
+func (dw *dohWriter) TsigTimersOnly(bool)  {}
+func (dw *dohWriter) Hijack()              {}
+func (dw *dohWriter) Close() error         { return nil }
+
+func (dw *dohWriter) WriteMsg(m *dns.Msg) error {
+	dw.msg = m
+	return nil
+}
+
+func (dw *dohWriter) Write(byt []byte) (int, error) {
+	m := &dns.Msg{}
+	if err := m.Unpack(byt); err != nil {
+		return 0, err
+	}
+
+	dw.msg = m
+	return len(byt), nil
+}
+
+// tcpAddr converts the address of an HTTP client. Responses over HTTP are
+// never truncated, so ServeDNS is told this is TCP.
+func tcpAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+
+	portNum, _ := strconv.Atoi(port)
+
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: portNum}
+}
+
+// readDoH pulls the query out of a request: base64url encoded in the dns
+// parameter for GET, the body for POST.
+func readDoH(r *http.Request) ([]byte, error) {
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, errors.New("missing dns parameter")
+		}
+
+		return base64.RawURLEncoding.DecodeString(param)
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != DoHContentType {
+			return nil, fmt.Errorf("content type must be %q", DoHContentType)
+		}
+
+		return io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	}
+
+	return nil, fmt.Errorf("method %q is not supported", r.Method)
+}
+
+// ServeHTTP answers DNS-over-HTTPS queries (RFC 8484) with ServeDNS, so
+// answers are the same as over UDP and TCP.
+func (ds *DNSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	byt, err := readDoH(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := &dns.Msg{}
+	if err := query.Unpack(byt); err != nil {
+		http.Error(w, fmt.Sprintf("invalid DNS message: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohWriter{local: ds.dohListener.Addr(), remote: tcpAddr(r.RemoteAddr)}
+
+	// transfers are several messages long, which HTTP cannot carry, and
+	// updates must be signed, which is not checked here.
+	if query.Opcode == dns.OpcodeUpdate || (len(query.Question) != 0 && (query.Question[0].Qtype == dns.TypeAXFR || query.Question[0].Qtype == dns.TypeIXFR)) {
+		m := &dns.Msg{}
+		m.SetRcode(query, dns.RcodeRefused)
+		dw.msg = m
+	} else {
+		ds.ServeDNS(dw, query)
+	}
+
+	if dw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	out, err := dw.msg.Pack()
+	if err != nil {
+		logrus.Errorf("While packing DNS-over-HTTPS response: %v", err)
+		http.Error(w, "could not pack response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", DoHContentType)
+
+	// HTTP caches must not outlive the records; see RFC 8484, section 5.1.
+	if ttl, ok := minimumTTL(dw.msg); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+
+	w.Write(out) // nolint:errcheck
+}
+
+// minimumTTL finds the smallest TTL in a response. Negative responses are
+// cached for the SOA's minimum TTL, which is in the authority section.
+func minimumTTL(m *dns.Msg) (uint32, bool) {
+	var (
+		ttl   uint32
+		found bool
+	)
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	return ttl, found
+}
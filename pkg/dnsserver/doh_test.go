@@ -0,0 +1,121 @@
+package dnsserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+)
+
+func TestDoH(t *testing.T) {
+	cert, pool := makeCert(t)
+
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "foo.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+				TTL:       30,
+			},
+		},
+	}
+
+	ds := &DNSServer{
+		Zones: zones,
+		DoH:   "127.0.0.1:0",
+		TLS:   &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	client := &http.Client{
+		Timeout: time.Second,
+		// a custom TLS configuration turns HTTP/2 off, unless forced.
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true},
+	}
+
+	url := fmt.Sprintf("https://%s%s", ds.dohListener.Addr(), DoHPath)
+
+	m := &dns.Msg{}
+	m.SetQuestion("foo.test.home.arpa.", dns.TypeA)
+	m.Id = 0 // as RFC 8484 recommends, for caching
+
+	query, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := map[string]func() (*http.Response, error){
+		"get": func() (*http.Response, error) {
+			return client.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(query))
+		},
+		"post": func() (*http.Response, error) {
+			return client.Post(url, DoHContentType, bytes.NewBuffer(query))
+		},
+	}
+
+	for method, f := range table {
+		resp, err := f()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%q: unexpected status %d: %s", method, resp.StatusCode, body)
+		}
+
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("%q: answered over %s, not HTTP/2", method, resp.Proto)
+		}
+
+		if resp.Header.Get("Content-Type") != DoHContentType {
+			t.Fatalf("%q: unexpected content type %q", method, resp.Header.Get("Content-Type"))
+		}
+
+		if resp.Header.Get("Cache-Control") != "max-age=30" {
+			t.Fatalf("%q: unexpected cache control %q", method, resp.Header.Get("Cache-Control"))
+		}
+
+		r := &dns.Msg{}
+		if err := r.Unpack(body); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+			t.Fatalf("%q: unexpected answer: %v", method, r.Answer)
+		}
+	}
+
+	resp, err := client.Post(url, "text/plain", bytes.NewBuffer(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Wrong content type was not rejected: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,91 @@
+package dnsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// makeCert creates a self-signed certificate for 127.0.0.1.
+func makeCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "border test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestDoT(t *testing.T) {
+	cert, pool := makeCert(t)
+
+	ds := &DNSServer{
+		Zones: makeZones(),
+		DoT:   "127.0.0.1:0",
+		TLS:   &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	m := &dns.Msg{}
+	m.SetQuestion("test.home.arpa.", dns.TypeSOA)
+
+	client := &dns.Client{Net: "tcp-tls", Timeout: time.Second, TLSConfig: &tls.Config{RootCAs: pool}}
+
+	r, _, err := client.Exchange(m, ds.dotServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("Unexpected response over DNS-over-TLS: %v", r)
+	}
+
+	if _, ok := r.Answer[0].(*dns.SOA); !ok {
+		t.Fatalf("Answer was not SOA record: %v", r.Answer[0])
+	}
+
+	if err := (&DNSServer{Zones: makeZones(), DoT: "127.0.0.1:0"}).Start("127.0.0.1:0"); err == nil {
+		t.Fatal("DNS-over-TLS started without a certificate")
+	}
+}
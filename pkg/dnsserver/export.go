@@ -0,0 +1,33 @@
+package dnsserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var ErrZoneNotFound = errors.New("zone not found")
+
+// Export yields the zone in the master file format of RFC 1035, as it is
+// served right now. Like a transfer, records computed at query time (LB,
+// ALIAS and auto reverse zones) are computed now.
+func (ds *DNSServer) Export(name string) (string, error) {
+	name = dns.CanonicalName(name)
+
+	zone, ok := ds.Zones[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrZoneNotFound, name)
+	}
+
+	var out strings.Builder
+
+	fmt.Fprintf(&out, "$ORIGIN %s\n", name)
+
+	for _, rr := range append(zone.SOA.Convert(name), ds.render(name, zone)...) {
+		fmt.Fprintln(&out, rr.String())
+	}
+
+	return out.String(), nil
+}
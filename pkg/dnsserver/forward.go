@@ -0,0 +1,298 @@
+package dnsserver
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultForwardCacheSize is how many answers are cached for forwarded
+	// queries if the configuration does not say.
+	DefaultForwardCacheSize = 10000
+	// ForwardTimeout bounds the time spent talking to each upstream.
+	ForwardTimeout = 2 * time.Second
+)
+
+type forwardCacheEntry struct {
+	key     string
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// forwardCache holds the responses of upstream resolvers until they expire.
+// When it is full, the least recently used response is evicted.
+type forwardCache struct {
+	entries map[string]*list.Element
+	order   list.List
+	mutex   sync.Mutex
+}
+
+// get yields a copy of a cached response, with TTLs reduced by the time it has
+// spent in the cache.
+func (fc *forwardCache) get(key string, now time.Time) (*dns.Msg, bool) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	elem, ok := fc.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*forwardCacheEntry)
+
+	if !now.Before(entry.expires) {
+		fc.order.Remove(elem)
+		delete(fc.entries, key)
+		return nil, false
+	}
+
+	fc.order.MoveToFront(elem)
+
+	m := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+
+	return m, true
+}
+
+func (fc *forwardCache) set(key string, m *dns.Msg, ttl time.Duration, size int, now time.Time) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	if fc.entries == nil {
+		fc.entries = map[string]*list.Element{}
+	}
+
+	if elem, ok := fc.entries[key]; ok {
+		fc.order.Remove(elem)
+		delete(fc.entries, key)
+	}
+
+	for fc.order.Len() >= size && fc.order.Len() != 0 {
+		oldest := fc.order.Back()
+		fc.order.Remove(oldest)
+		delete(fc.entries, oldest.Value.(*forwardCacheEntry).key)
+	}
+
+	fc.entries[key] = fc.order.PushFront(&forwardCacheEntry{
+		key:     key,
+		msg:     m,
+		stored:  now,
+		expires: now.Add(ttl),
+	})
+}
+
+// cacheTTL finds how long a response may be cached: as long as its shortest
+// TTL, or for negative responses, the lesser of the SOA's TTL and minimum TTL
+// (RFC 2308). Negative responses without a SOA are not cached.
+func cacheTTL(m *dns.Msg) (time.Duration, bool) {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+
+	if m.Rcode == dns.RcodeNameError || len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := minTTL(soa.Hdr.Ttl, soa.Minttl)
+				return time.Duration(ttl) * time.Second, ttl != 0
+			}
+		}
+
+		return 0, false
+	}
+
+	ttl, ok := minimumTTL(m)
+	return time.Duration(ttl) * time.Second, ok && ttl != 0
+}
+
+func minTTL(a, b uint32) uint32 {
+	if b < a {
+		return b
+	}
+
+	return a
+}
+
+// remoteIP finds the address of the client, if it has one.
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+
+	return nil
+}
+
+// recursionAllowed reports whether the client may have queries for names
+// outside of our zones forwarded.
+func (ds *DNSServer) recursionAllowed(w dns.ResponseWriter) bool {
+	if ds.Forward == nil {
+		return false
+	}
+
+	ip := remoteIP(w)
+
+	return ip != nil && ds.Forward.Allowed(ip)
+}
+
+// upstreams finds the resolvers for a name: those of the longest matching
+// domain, or the default ones.
+func (ds *DNSServer) upstreams(name string) []string {
+	var (
+		servers []string
+		longest = -1
+	)
+
+	for domain, domainServers := range ds.Forward.Domains {
+		domain = dns.CanonicalName(domain)
+
+		if labels := dns.CountLabel(domain); labels > longest && dns.IsSubDomain(domain, name) {
+			servers = domainServers
+			longest = labels
+		}
+	}
+
+	if servers == nil {
+		servers = ds.Forward.Upstreams
+	}
+
+	return servers
+}
+
+// exchange sends a query to an upstream, over TCP if the UDP answer was
+// truncated.
+func exchange(m *dns.Msg, upstream string) (*dns.Msg, error) {
+	client := &dns.Client{Timeout: ForwardTimeout}
+
+	r, _, err := client.Exchange(m, upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Truncated {
+		client.Net = "tcp"
+
+		r, _, err = client.Exchange(m, upstream)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// resolveUpstream asks each upstream for the name in turn, until one gives an
+// answer, positive or negative.
+func (ds *DNSServer) resolveUpstream(q dns.Question) (*dns.Msg, error) {
+	m := &dns.Msg{}
+	m.SetQuestion(q.Name, q.Qtype)
+	m.Question[0].Qclass = q.Qclass
+	m.SetEdns0(dns.DefaultMsgSize, false)
+
+	upstreams := ds.upstreams(q.Name)
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("%w: no upstreams for %q", ErrUpstream, q.Name)
+	}
+
+	errs := []error{ErrUpstream}
+
+	for _, upstream := range upstreams {
+		upstream = withPort(upstream)
+
+		r, err := exchange(m, upstream)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		switch r.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+			return r, nil
+		}
+
+		errs = append(errs, fmt.Errorf("%q yielded %s for %q", upstream, dns.RcodeToString[r.Rcode], q.Name))
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// forward answers a query for a name outside of our zones from the cache, or
+// failing that, from the upstreams if the client asked for recursion.
+func (ds *DNSServer) forward(w dns.ResponseWriter, r *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetReply(r)
+	m.RecursionAvailable = true
+
+	q := r.Question[0]
+	key := fmt.Sprintf("%s/%d/%d", strings.ToLower(dns.CanonicalName(q.Name)), q.Qtype, q.Qclass)
+
+	resp, ok := ds.forwardCache.get(key, time.Now())
+	if !ok {
+		if !r.RecursionDesired {
+			m.SetRcode(r, dns.RcodeRefused)
+			ds.writeMsg(w, r, m, "")
+			return
+		}
+
+		var err error
+
+		resp, err = ds.resolveUpstream(q)
+		if err != nil {
+			logrus.Errorf("While forwarding %q: %v", q.Name, err)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			ds.writeMsg(w, r, m, "")
+			return
+		}
+
+		// the upstream's EDNS is between it and us.
+		resp.Extra = withoutOPT(resp.Extra)
+
+		if ttl, ok := cacheTTL(resp); ok {
+			size := ds.Forward.CacheSize
+			if size == 0 {
+				size = DefaultForwardCacheSize
+			}
+
+			ds.forwardCache.set(key, resp.Copy(), ttl, size, time.Now())
+		}
+	}
+
+	m.Rcode = resp.Rcode
+	m.Answer = resp.Answer
+	m.Ns = resp.Ns
+	m.Extra = resp.Extra
+
+	ds.writeMsg(w, r, m, "")
+}
+
+func withoutOPT(rrs []dns.RR) []dns.RR {
+	ret := []dns.RR{}
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			ret = append(ret, rr)
+		}
+	}
+
+	return ret
+}
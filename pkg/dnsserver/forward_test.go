@@ -0,0 +1,218 @@
+package dnsserver
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/miekg/dns"
+)
+
+// startUpstream runs a stand-in resolver, which answers A queries for
+// "host." names in the domain with the address, and NXDOMAIN for everything
+// else. It counts the queries it gets.
+func startUpstream(t *testing.T, domain string, address string) (string, *atomic.Int32) {
+	var queries atomic.Int32
+
+	upstream := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+
+		m := &dns.Msg{}
+		m.SetReply(r)
+		m.RecursionAvailable = true
+
+		if r.Question[0].Name == "host."+domain && r.Question[0].Qtype == dns.TypeA {
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: "host." + domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(address),
+			}}
+		} else {
+			m.Rcode = dns.RcodeNameError
+			m.Ns = []dns.RR{&dns.SOA{
+				Hdr:    dns.RR_Header{Name: domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:     "ns." + domain,
+				Mbox:   "admin." + domain,
+				Minttl: 30,
+			}}
+		}
+
+		w.WriteMsg(m) // nolint:errcheck
+	})}
+
+	started := make(chan struct{})
+	upstream.NotifyStartedFunc = func() { close(started) }
+
+	go upstream.ListenAndServe() // nolint:errcheck
+	<-started
+
+	t.Cleanup(func() {
+		upstream.Shutdown() // nolint:errcheck
+	})
+
+	return upstream.PacketConn.LocalAddr().String(), &queries
+}
+
+func TestForward(t *testing.T) {
+	defaultUpstream, defaultQueries := startUpstream(t, "example.com.", "192.0.2.1")
+	corpUpstream, corpQueries := startUpstream(t, "corp.example.com.", "192.0.2.2")
+
+	ds := &DNSServer{
+		Zones: makeZones(),
+		Forward: &config.Forward{
+			Upstreams: []string{defaultUpstream},
+			Domains:   map[string][]string{"corp.example.com": {corpUpstream}},
+			Allow:     []string{"127.0.0.0/8"},
+		},
+	}
+
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	r := query(t, ds, "host.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Unexpected forwarded response: %v", r)
+	}
+
+	if r.Authoritative || !r.RecursionAvailable {
+		t.Fatalf("Forwarded response has the wrong flags: %v", r)
+	}
+
+	// answered from the cache.
+	query(t, ds, "host.example.com.", dns.TypeA)
+
+	if defaultQueries.Load() != 1 {
+		t.Fatalf("Upstream was queried %d times", defaultQueries.Load())
+	}
+
+	// negative answers are cached too.
+	for i := 0; i < 2; i++ {
+		if r := query(t, ds, "missing.example.com.", dns.TypeA); r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 {
+			t.Fatalf("Unexpected negative response: %v", r)
+		}
+	}
+
+	if defaultQueries.Load() != 2 {
+		t.Fatalf("Upstream was queried %d times", defaultQueries.Load())
+	}
+
+	// the longest domain wins.
+	r = query(t, ds, "host.corp.example.com.", dns.TypeA)
+	if len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.2")) {
+		t.Fatalf("Unexpected forwarded response: %v", r)
+	}
+
+	if corpQueries.Load() != 1 || defaultQueries.Load() != 2 {
+		t.Fatalf("Wrong upstream was queried: %d corp, %d default", corpQueries.Load(), defaultQueries.Load())
+	}
+
+	// our zones are still answered by us.
+	r = query(t, ds, "test.home.arpa.", dns.TypeSOA)
+	if !r.Authoritative || !r.RecursionAvailable || len(r.Answer) != 1 {
+		t.Fatalf("Unexpected authoritative response: %v", r)
+	}
+
+	// without recursion, only the cache is consulted.
+	m := &dns.Msg{}
+	m.SetQuestion("other.example.com.", dns.TypeA)
+	m.RecursionDesired = false
+
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+
+	r, _, err := client.Exchange(m, ds.udpServer.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Rcode != dns.RcodeRefused {
+		t.Fatalf("Uncached query without recursion was not refused: %v", r)
+	}
+
+	m.SetQuestion("host.example.com.", dns.TypeA)
+	m.RecursionDesired = false
+
+	r, _, err = client.Exchange(m, ds.udpServer.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Answer) != 1 {
+		t.Fatalf("Cached query without recursion was not answered: %v", r)
+	}
+
+	// clients that are not allowed get nothing.
+	ds = &DNSServer{
+		Zones: makeZones(),
+		Forward: &config.Forward{
+			Upstreams: []string{defaultUpstream},
+			Allow:     []string{"192.0.2.0/24"},
+		},
+	}
+
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	r = query(t, ds, "host.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeRefused || r.RecursionAvailable {
+		t.Fatalf("Client that is not allowed could recurse: %v", r)
+	}
+
+	r = query(t, ds, "test.home.arpa.", dns.TypeSOA)
+	if r.RecursionAvailable {
+		t.Fatalf("Recursion was advertised to a client that is not allowed: %v", r)
+	}
+}
+
+func TestForwardCache(t *testing.T) {
+	fc := &forwardCache{}
+	now := time.Now()
+
+	answer := func(name string) *dns.Msg {
+		m := &dns.Msg{}
+		m.SetQuestion(name, dns.TypeA)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		}}
+
+		return m
+	}
+
+	fc.set("one", answer("one."), time.Minute, 2, now)
+	fc.set("two", answer("two."), time.Minute, 2, now)
+
+	// makes "two" the least recently used.
+	m, ok := fc.get("one", now.Add(10*time.Second))
+	if !ok {
+		t.Fatal("Entry was not cached")
+	}
+
+	if ttl := m.Answer[0].Header().Ttl; ttl != 50 {
+		t.Fatalf("TTL was not reduced by the time spent in the cache: %d", ttl)
+	}
+
+	fc.set("three", answer("three."), time.Minute, 2, now)
+
+	if _, ok := fc.get("two", now); ok {
+		t.Fatal("Least recently used entry was not evicted")
+	}
+
+	if _, ok := fc.get("three", now); !ok {
+		t.Fatal("New entry was not cached")
+	}
+
+	if _, ok := fc.get("one", now.Add(time.Minute)); ok {
+		t.Fatal("Entry outlived its TTL")
+	}
+}
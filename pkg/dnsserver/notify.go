@@ -0,0 +1,123 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// NotifyInterval is how long to wait between attempts to notify a
+	// secondary, or to see the new serial served locally.
+	NotifyInterval = 5 * time.Second
+	// NotifyTimeout is how long to keep trying before giving up on a secondary.
+	// It will still pick the change up at its next SOA refresh.
+	NotifyTimeout = 5 * time.Minute
+)
+
+var ErrNotify = errors.New("notify failed")
+
+// NotifyTarget normalizes the address of a secondary, which may omit the
+// port.
+func NotifyTarget(target string) string {
+	return withPort(target)
+}
+
+// withPort adds the DNS port to an address that lacks one.
+func withPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, "53")
+	}
+
+	return addr
+}
+
+// localAddr turns a listen spec, such as ":53", into an address we can query
+// ourselves on.
+func localAddr(listenSpec string) (string, error) {
+	host, port, err := net.SplitHostPort(listenSpec)
+	if err != nil {
+		return "", err
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// serialReached reports whether serving is target, or a serial after it, in
+// the serial number arithmetic of RFC 1982, which lets serials wrap around.
+func serialReached(serving, target uint32) bool {
+	return int32(serving-target) >= 0
+}
+
+// WaitForSerial polls a server until it serves the serial for the zone, or a
+// later one, as other changes may have come along in the meantime.
+// Configuration reloads restart the DNS server in the background, and a
+// secondary notified before that happens would find the old serial and go
+// back to sleep.
+func WaitForSerial(ctx context.Context, listenSpec, zone string, serial uint32, interval time.Duration) error {
+	addr, err := localAddr(listenSpec)
+	if err != nil {
+		return err
+	}
+
+	m := &dns.Msg{}
+	m.SetQuestion(zone, dns.TypeSOA)
+
+	client := &dns.Client{Timeout: interval}
+
+	for {
+		r, _, err := client.ExchangeContext(ctx, m, addr)
+		if err == nil && len(r.Answer) != 0 {
+			if soa, ok := r.Answer[0].(*dns.SOA); ok && serialReached(soa.Serial, serial) {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("serial %d for %q was never served by %s: %w", serial, zone, addr, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Notify sends an RFC 1996 NOTIFY for the zone to a secondary, retrying until
+// it is acknowledged or the context is done.
+func Notify(ctx context.Context, zone string, soa *dnsconfig.SOA, target string, interval time.Duration) error {
+	target = NotifyTarget(target)
+
+	m := &dns.Msg{}
+	m.SetNotify(zone)
+	// the SOA is a hint; secondaries will ask us for it anyway.
+	m.Answer = soa.Convert(zone)
+
+	client := &dns.Client{Timeout: interval}
+
+	for {
+		r, _, err := client.ExchangeContext(ctx, m, target)
+		switch {
+		case err != nil:
+			logrus.Debugf("Could not notify %q of changes to %q: %v", target, zone, err)
+		case r.Opcode != dns.OpcodeNotify || r.Rcode != dns.RcodeSuccess:
+			logrus.Debugf("Secondary %q did not acknowledge notify for %q: %s", target, zone, dns.RcodeToString[r.Rcode])
+		default:
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %q never acknowledged changes to %q: %v", ErrNotify, target, zone, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
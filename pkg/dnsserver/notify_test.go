@@ -0,0 +1,26 @@
+package dnsserver
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSerialReached(t *testing.T) {
+	table := map[string]struct {
+		serving, target uint32
+		reached         bool
+	}{
+		"same":              {serving: 5, target: 5, reached: true},
+		"later":             {serving: 7, target: 5, reached: true},
+		"earlier":           {serving: 4, target: 5},
+		"wrapped around":    {serving: 2, target: math.MaxUint32 - 1, reached: true},
+		"before wrapping":   {serving: math.MaxUint32 - 1, target: 2},
+		"half the space on": {serving: 5 + math.MaxInt32, target: 5, reached: true},
+	}
+
+	for name, test := range table {
+		if serialReached(test.serving, test.target) != test.reached {
+			t.Fatalf("%q: serial %d reaching %d should be %v", name, test.serving, test.target, test.reached)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package dnsserver
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+)
+
+// rotation counts the queries answered by each round-robin record, so each
+// answer starts with the address after the one the last answer started with.
+type rotation struct {
+	counts map[*config.Record]int
+	mutex  sync.Mutex
+}
+
+func (r *rotation) next(rec *config.Record) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.counts == nil {
+		r.counts = map[*config.Record]int{}
+	}
+
+	count := r.counts[rec]
+	r.counts[rec]++
+
+	return count
+}
+
+// order applies the record's answer ordering or weights to its answers, and
+// caps their number if it asks for that. Weighted records give one answer
+// unless they ask for more.
+func (ds *DNSServer) order(rec *config.Record, answers []dns.RR) []dns.RR {
+	ordered, ok := rec.Value.(dnsconfig.Ordered)
+	if !ok || len(answers) == 0 {
+		return answers
+	}
+
+	ordering, maxAnswers := ordered.Ordering()
+
+	if weights := ds.weights(rec); len(weights) != 0 {
+		answers = weigh(answers, weights)
+
+		// giving every address would leave the choice to the client.
+		if maxAnswers == 0 {
+			maxAnswers = 1
+		}
+	}
+
+	switch ordering {
+	case dnsconfig.OrderingRoundRobin:
+		offset := ds.rotation.next(rec) % len(answers)
+		answers = append(append([]dns.RR{}, answers[offset:]...), answers[:offset]...)
+	case dnsconfig.OrderingRandom:
+		rand.Shuffle(len(answers), func(i, j int) {
+			answers[i], answers[j] = answers[j], answers[i]
+		})
+	}
+
+	if maxAnswers != 0 && len(answers) > maxAnswers {
+		answers = answers[:maxAnswers]
+	}
+
+	return answers
+}
+
+// weights yields the weights of a record's addresses, keyed by the string
+// form of the address. LB records weigh listeners, which may name peers, so
+// those are turned into the addresses they listen on.
+func (ds *DNSServer) weights(rec *config.Record) map[string]float64 {
+	weighted, ok := rec.Value.(dnsconfig.Weighted)
+	if !ok || len(weighted.Weighting()) == 0 {
+		return nil
+	}
+
+	weights := map[string]float64{}
+
+	for key, weight := range weighted.Weighting() {
+		var ips []net.IP
+
+		if rec.Type == dnsconfig.TypeLB {
+			ips = ds.listenerIP(key)
+		} else if ip := net.ParseIP(key); ip != nil {
+			ips = []net.IP{ip}
+		}
+
+		for _, ip := range ips {
+			weights[ip.String()] = weight
+		}
+	}
+
+	return weights
+}
+
+// weigh orders answers at random, in proportion to their weights, as if
+// drawing them one by one from an urn: each answer gets a key of u^(1/w), for
+// u picked uniformly from [0, 1), and the highest keys go first. Addresses
+// without a weight weigh 1, and those weighing 0 only follow the others.
+func weigh(answers []dns.RR, weights map[string]float64) []dns.RR {
+	keys := make([]float64, len(answers))
+
+	for i, answer := range answers {
+		weight := 1.0
+
+		if ip := answerIP(answer); ip != nil {
+			if w, ok := weights[ip.String()]; ok {
+				weight = w
+			}
+		}
+
+		keys[i] = math.Pow(rand.Float64(), 1/weight)
+	}
+
+	weighed := append([]dns.RR{}, answers...)
+	sort.Stable(byKey{answers: weighed, keys: keys})
+
+	return weighed
+}
+
+type byKey struct {
+	answers []dns.RR
+	keys    []float64
+}
+
+func (bk byKey) Len() int           { return len(bk.answers) }
+func (bk byKey) Less(i, j int) bool { return bk.keys[i] > bk.keys[j] }
+func (bk byKey) Swap(i, j int) {
+	bk.answers[i], bk.answers[j] = bk.answers[j], bk.answers[i]
+	bk.keys[i], bk.keys[j] = bk.keys[j], bk.keys[i]
+}
+
+func answerIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package dnsserver
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+)
+
+// reverseIP turns a name in in-addr.arpa or ip6.arpa into the address it
+// represents. nil is returned for names that do not name a whole address.
+func reverseIP(name string) net.IP {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+
+	switch {
+	case len(labels) == 6 && labels[4] == "in-addr" && labels[5] == "arpa":
+		ip := make(net.IP, 0, net.IPv4len)
+
+		for i := 3; i >= 0; i-- {
+			octet, err := strconv.ParseUint(labels[i], 10, 8)
+			if err != nil {
+				return nil
+			}
+
+			ip = append(ip, byte(octet))
+		}
+
+		return ip
+	case len(labels) == 34 && labels[32] == "ip6" && labels[33] == "arpa":
+		ip := make(net.IP, 0, net.IPv6len)
+
+		for i := 31; i > 0; i -= 2 {
+			b, err := strconv.ParseUint(labels[i]+labels[i-1], 16, 8)
+			if err != nil || len(labels[i]) != 1 || len(labels[i-1]) != 1 {
+				return nil
+			}
+
+			ip = append(ip, byte(b))
+		}
+
+		return ip
+	}
+
+	return nil
+}
+
+// listenerIPs yields the addresses a load balancer listens on. Listeners may
+// name peers instead of addresses, in which case the peer's IPs are used.
+func (ds *DNSServer) listenerIPs(lb *dnsconfig.LB) []net.IP {
+	ips := []net.IP{}
+
+	for _, listener := range lb.Listeners {
+		ips = append(ips, ds.listenerIP(listener)...)
+	}
+
+	return ips
+}
+
+// listenerIP yields the addresses of a single listener.
+func (ds *DNSServer) listenerIP(listener string) []net.IP {
+	host, _, err := net.SplitHostPort(listener)
+	if err != nil {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+
+	if ds.Config == nil {
+		return nil
+	}
+
+	peer, err := ds.Config.FindPeer(host)
+	if err != nil {
+		return nil
+	}
+
+	return peer.IPs
+}
+
+// isWildcard reports whether the first label of a name is "*".
+func isWildcard(name string) bool {
+	return name == "*" || strings.HasPrefix(name, "*.")
+}
+
+// reverse synthesizes PTR records for names in an auto reverse zone. This is
+// computed from the forward zones at query time, so health checks pruning
+// addresses from records are reflected here too.
+func (ds *DNSServer) reverse(zone *config.Zone, name string) []dns.RR {
+	ip := reverseIP(name)
+	if ip == nil {
+		return nil
+	}
+
+	targets := map[string]struct{}{}
+
+	for _, forward := range ds.Zones {
+		if forward.Auto {
+			continue
+		}
+
+		for _, rec := range forward.Records {
+			// a wildcard is not a name a PTR record can point at.
+			if isWildcard(rec.Name) {
+				continue
+			}
+
+			var ips []net.IP
+
+			switch value := rec.Value.(type) {
+			case *dnsconfig.A:
+				ips = value.Addresses
+			case *dnsconfig.AAAA:
+				ips = value.Addresses
+			case *dnsconfig.LB:
+				ips = ds.listenerIPs(value)
+			}
+
+			for _, addr := range ips {
+				if addr.Equal(ip) {
+					targets[rec.Name] = struct{}{}
+				}
+			}
+		}
+	}
+
+	names := []string{}
+	for target := range targets {
+		names = append(names, target)
+	}
+
+	// zones are a map; keep the answers stable between queries.
+	sort.Strings(names)
+
+	answers := []dns.RR{}
+
+	for _, target := range names {
+		answers = append(answers, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    zone.SOA.MinTTL,
+			},
+			Ptr: target,
+		})
+	}
+
+	return answers
+}
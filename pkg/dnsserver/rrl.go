@@ -0,0 +1,259 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultRRLSlip             = 2
+	DefaultRRLWindow           = 15
+	DefaultRRLIPv4PrefixLength = 24
+	DefaultRRLIPv6PrefixLength = 56
+)
+
+type rrlAction int
+
+const (
+	rrlAllow rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+// RRLCounters tallies what response rate limiting did.
+type RRLCounters struct {
+	// Responses counts every response subject to rate limiting.
+	Responses uint64
+	// Dropped counts responses that were not sent at all.
+	Dropped uint64
+	// Slipped counts responses that were sent truncated instead.
+	Slipped uint64
+}
+
+// RRLStats keeps the counters of response rate limiting. Like the Journal, the
+// launcher hands the same one to every server it starts, so the counts survive
+// configuration reloads.
+type RRLStats struct {
+	responses atomic.Uint64
+	dropped   atomic.Uint64
+	slipped   atomic.Uint64
+}
+
+// Counters reports what response rate limiting has done so far.
+func (rs *RRLStats) Counters() RRLCounters {
+	return RRLCounters{
+		Responses: rs.responses.Load(),
+		Dropped:   rs.dropped.Load(),
+		Slipped:   rs.slipped.Load(),
+	}
+}
+
+type rrlBucket struct {
+	balance float64
+	last    time.Time
+	window  time.Duration
+	limited uint
+}
+
+type rateLimiter struct {
+	buckets   map[string]*rrlBucket
+	lastClean time.Time
+	mutex     sync.Mutex
+	stats     *RRLStats
+}
+
+// rrlKey groups responses the way BIND does: by client network, the kind of
+// response, and what is being answered. Errors and NXDOMAIN for any name in a
+// zone share an account, so random names do not escape the limit.
+func rrlKey(conf *config.RRL, ip net.IP, zone string, r *dns.Msg, m *dns.Msg) string {
+	var network net.IP
+
+	if ip4 := ip.To4(); ip4 != nil {
+		length := conf.IPv4PrefixLength
+		if length == 0 {
+			length = DefaultRRLIPv4PrefixLength
+		}
+
+		network = ip4.Mask(net.CIDRMask(length, 32))
+	} else {
+		length := conf.IPv6PrefixLength
+		if length == 0 {
+			length = DefaultRRLIPv6PrefixLength
+		}
+
+		network = ip.Mask(net.CIDRMask(length, 128))
+	}
+
+	switch {
+	case m.Rcode == dns.RcodeNameError:
+		return fmt.Sprintf("%s/nxdomain/%s", network, zone)
+	case m.Rcode != dns.RcodeSuccess || len(r.Question) == 0:
+		return fmt.Sprintf("%s/error/%d", network, m.Rcode)
+	case len(m.Answer) == 0:
+		return fmt.Sprintf("%s/nodata/%s", network, zone)
+	default:
+		q := r.Question[0]
+		return fmt.Sprintf("%s/answer/%s/%d", network, dns.CanonicalName(q.Name), q.Qtype)
+	}
+}
+
+// limit accounts for a response, and decides what to do with it. Each key has
+// a balance which is credited the configured rate every second, up to one
+// second's worth, and debited for each response. Responses are limited while
+// it is negative; the debt is capped at the window, so a client that stops
+// will be answered again after at most that long.
+func (rl *rateLimiter) limit(conf *config.RRL, key string, now time.Time) rrlAction {
+	rate := float64(conf.ResponsesPerSecond)
+
+	window := time.Duration(conf.Window) * time.Second
+	if window == 0 {
+		window = DefaultRRLWindow * time.Second
+	}
+
+	slip := uint(DefaultRRLSlip)
+	if conf.Slip != nil {
+		slip = *conf.Slip
+	}
+
+	rl.stats.responses.Add(1)
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if rl.buckets == nil {
+		rl.buckets = map[string]*rrlBucket{}
+	}
+
+	rl.clean(now)
+
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &rrlBucket{balance: rate, last: now}
+		rl.buckets[key] = bucket
+	}
+
+	bucket.window = window
+	bucket.balance += now.Sub(bucket.last).Seconds() * rate
+	bucket.last = now
+
+	if bucket.balance > rate {
+		bucket.balance = rate
+	}
+
+	bucket.balance--
+
+	if debt := -rate * window.Seconds(); bucket.balance < debt {
+		bucket.balance = debt
+	}
+
+	if bucket.balance >= 0 {
+		bucket.limited = 0
+		return rrlAllow
+	}
+
+	bucket.limited++
+
+	if slip != 0 && bucket.limited%slip == 0 {
+		rl.stats.slipped.Add(1)
+		return rrlSlip
+	}
+
+	rl.stats.dropped.Add(1)
+	return rrlDrop
+}
+
+// clean forgets clients we have not heard from in a window. Must be called
+// with the mutex held.
+func (rl *rateLimiter) clean(now time.Time) {
+	if now.Sub(rl.lastClean) < time.Second {
+		return
+	}
+
+	rl.lastClean = now
+
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.last) > bucket.window {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// RRLCounters reports what response rate limiting has done, across reloads if
+// RRLStats was handed to each server.
+func (ds *DNSServer) RRLCounters() RRLCounters {
+	return ds.RRLStats.Counters()
+}
+
+// rrlConfig finds the rate limiting for a query: the zone's, or the global
+// one.
+func (ds *DNSServer) rrlConfig(zone *config.Zone) *config.RRL {
+	if zone != nil && zone.RRL != nil {
+		return zone.RRL
+	}
+
+	return ds.RRL
+}
+
+// rateLimit decides whether a response may be sent to the client. Only UDP
+// is limited, as TCP clients cannot spoof their address. Slipped responses
+// are emptied and truncated in place. apex is the name of the zone the query
+// is for, if it is one of ours.
+func (ds *DNSServer) rateLimit(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, apex string) bool {
+	addr, ok := w.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		return true
+	}
+
+	zone := ds.Zones[apex]
+
+	conf := ds.rrlConfig(zone)
+	if conf == nil {
+		return true
+	}
+
+	switch ds.rateLimiter.limit(conf, rrlKey(conf, addr.IP, apex, r, m), time.Now()) {
+	case rrlDrop:
+		logrus.Debugf("Rate limited response to %v", addr)
+		return false
+	case rrlSlip:
+		m.Answer = nil
+		m.Ns = nil
+		m.Extra = nil
+		m.Truncated = true
+	}
+
+	return true
+}
+
+// logRRL periodically reports what rate limiting has done, if anything.
+func (ds *DNSServer) logRRL(done <-chan struct{}) {
+	// the counters may have been carried over from before a reload.
+	last := ds.RRLCounters()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Minute):
+		}
+
+		counters := ds.RRLCounters()
+		if counters.Dropped != last.Dropped || counters.Slipped != last.Slipped {
+			logrus.Infof(
+				"Response rate limiting: %d responses, %d dropped, %d slipped in the last minute",
+				counters.Responses-last.Responses,
+				counters.Dropped-last.Dropped,
+				counters.Slipped-last.Slipped,
+			)
+		}
+
+		last = counters
+	}
+}
@@ -0,0 +1,165 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/miekg/dns"
+)
+
+func TestRateLimiter(t *testing.T) {
+	slip := uint(2)
+	conf := &config.RRL{ResponsesPerSecond: 5, Slip: &slip, Window: 2}
+
+	rl := &rateLimiter{stats: &RRLStats{}}
+	now := time.Now()
+
+	actions := map[rrlAction]int{}
+
+	for i := 0; i < 15; i++ {
+		actions[rl.limit(conf, "client", now)]++
+	}
+
+	// the first second's worth is allowed, and every other response after that
+	// slips.
+	if actions[rrlAllow] != 5 || actions[rrlSlip] != 5 || actions[rrlDrop] != 5 {
+		t.Fatalf("Unexpected actions: %v", actions)
+	}
+
+	// other clients have their own account.
+	if rl.limit(conf, "other", now) != rrlAllow {
+		t.Fatal("Another client was limited")
+	}
+
+	// the debt is capped at the window, so after it the client is answered.
+	if rl.limit(conf, "client", now.Add(2*time.Second+time.Millisecond)) != rrlAllow {
+		t.Fatal("Client was still limited after the window")
+	}
+
+	if counters := rl.stats.Counters(); counters != (RRLCounters{Responses: 17, Dropped: 5, Slipped: 5}) {
+		t.Fatalf("Unexpected counters: %+v", counters)
+	}
+
+	// clients are forgotten after a window of silence.
+	rl.limit(conf, "client", now.Add(time.Minute))
+
+	if len(rl.buckets) != 1 {
+		t.Fatalf("Idle clients were not cleaned up: %v", rl.buckets)
+	}
+}
+
+func TestRRLKey(t *testing.T) {
+	conf := &config.RRL{ResponsesPerSecond: 5}
+
+	query := func(name string) *dns.Msg {
+		m := &dns.Msg{}
+		m.SetQuestion(name, dns.TypeA)
+		return m
+	}
+
+	answer := func(r *dns.Msg, rcode int, answers int) *dns.Msg {
+		m := &dns.Msg{}
+		m.SetRcode(r, rcode)
+
+		for i := 0; i < answers; i++ {
+			m.Answer = append(m.Answer, &dns.A{})
+		}
+
+		return m
+	}
+
+	foo := query("foo.test.home.arpa.")
+	bar := query("bar.test.home.arpa.")
+
+	table := map[string]struct {
+		a, b  string
+		equal bool
+	}{
+		"same network": {
+			a:     rrlKey(conf, net.ParseIP("10.0.0.1"), "test.home.arpa.", foo, answer(foo, dns.RcodeSuccess, 1)),
+			b:     rrlKey(conf, net.ParseIP("10.0.0.2"), "test.home.arpa.", foo, answer(foo, dns.RcodeSuccess, 1)),
+			equal: true,
+		},
+		"other network": {
+			a: rrlKey(conf, net.ParseIP("10.0.0.1"), "test.home.arpa.", foo, answer(foo, dns.RcodeSuccess, 1)),
+			b: rrlKey(conf, net.ParseIP("10.0.1.1"), "test.home.arpa.", foo, answer(foo, dns.RcodeSuccess, 1)),
+		},
+		"other names": {
+			a: rrlKey(conf, net.ParseIP("10.0.0.1"), "test.home.arpa.", foo, answer(foo, dns.RcodeSuccess, 1)),
+			b: rrlKey(conf, net.ParseIP("10.0.0.1"), "test.home.arpa.", bar, answer(bar, dns.RcodeSuccess, 1)),
+		},
+		"nxdomain for other names": {
+			a:     rrlKey(conf, net.ParseIP("10.0.0.1"), "test.home.arpa.", foo, answer(foo, dns.RcodeNameError, 0)),
+			b:     rrlKey(conf, net.ParseIP("10.0.0.1"), "test.home.arpa.", bar, answer(bar, dns.RcodeNameError, 0)),
+			equal: true,
+		},
+		"v6 network": {
+			a:     rrlKey(conf, net.ParseIP("2001:db8::1"), "test.home.arpa.", foo, answer(foo, dns.RcodeSuccess, 1)),
+			b:     rrlKey(conf, net.ParseIP("2001:db8:0:ff::1"), "test.home.arpa.", foo, answer(foo, dns.RcodeSuccess, 1)),
+			equal: true,
+		},
+	}
+
+	for name, test := range table {
+		if (test.a == test.b) != test.equal {
+			t.Fatalf("%q: unexpected keys %q and %q", name, test.a, test.b)
+		}
+	}
+}
+
+func TestRRL(t *testing.T) {
+	slip := uint(0)
+
+	ds := &DNSServer{Zones: makeZones(), RRL: &config.RRL{ResponsesPerSecond: 2, Slip: &slip}}
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	m := &dns.Msg{}
+	m.SetQuestion("test.home.arpa.", dns.TypeSOA)
+
+	client := &dns.Client{Net: "udp", Timeout: 100 * time.Millisecond}
+
+	var answered int
+
+	for i := 0; i < 5; i++ {
+		if _, _, err := client.Exchange(m, ds.udpServer.PacketConn.LocalAddr().String()); err == nil {
+			answered++
+		}
+	}
+
+	if answered != 2 {
+		t.Fatalf("Unexpected number of answers: %d", answered)
+	}
+
+	// TCP is never limited
+	client.Net = "tcp"
+
+	if _, _, err := client.Exchange(m, ds.tcpServer.Listener.Addr().String()); err != nil {
+		t.Fatalf("TCP query was limited: %v", err)
+	}
+
+	if counters := ds.RRLCounters(); counters.Dropped != 3 {
+		t.Fatalf("Unexpected counters: %+v", counters)
+	}
+
+	// the counters survive the server being replaced, as it is on reloads.
+	next := &DNSServer{Zones: makeZones(), RRL: ds.RRL, RRLStats: ds.RRLStats}
+	if err := next.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		next.Shutdown() // nolint:errcheck
+	})
+
+	if counters := next.RRLCounters(); counters.Dropped != 3 || counters.Responses != 5 {
+		t.Fatalf("Counters were not carried over: %+v", counters)
+	}
+}
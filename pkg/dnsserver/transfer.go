@@ -0,0 +1,436 @@
+package dnsserver
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// JournalSize is how many versions of each zone are kept to compute IXFR
+	// deltas from. Secondaries older than that get the whole zone.
+	JournalSize = 16
+	// TransferChunkSize is how many records are sent in each message of a
+	// transfer.
+	TransferChunkSize = 100
+)
+
+// ZoneVersion is a zone as it was served at some point.
+type ZoneVersion struct {
+	// Generation is the last sum in the configuration chain when this version
+	// was served. It is empty when the server has no configuration.
+	Generation string
+	Serial     uint32
+	Records    []dns.RR
+}
+
+// Journal holds previous versions of zones. The launcher hands the same
+// journal to every server it starts, so history survives configuration
+// reloads.
+//
+// The journal is only kept in memory. The configuration chain holds the sums
+// of previous generations, not their contents, so versions cannot be rebuilt
+// from it: it only tells whether a version is in the history of the current
+// configuration. After a restart, secondaries still on a version from before
+// it get the whole zone.
+type Journal struct {
+	versions map[string][]*ZoneVersion
+	mutex    sync.RWMutex
+}
+
+// Add records a version of a zone, unless it is the same as the last one. If
+// the contents changed without the serial changing, the last version is
+// replaced, as there is no way to tell the two apart over IXFR.
+func (j *Journal) Add(zone string, version *ZoneVersion) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.versions == nil {
+		j.versions = map[string][]*ZoneVersion{}
+	}
+
+	versions := j.versions[zone]
+
+	if len(versions) != 0 {
+		last := versions[len(versions)-1]
+
+		if last.Serial == version.Serial {
+			if !changed(last.Records, version.Records) {
+				return
+			}
+
+			logrus.Warnf("Zone %q changed, but the serial did not: secondaries will not see the change", zone)
+			versions = versions[:len(versions)-1]
+		}
+	}
+
+	versions = append(versions, version)
+	if len(versions) > JournalSize {
+		versions = versions[len(versions)-JournalSize:]
+	}
+
+	j.versions[zone] = versions
+}
+
+// Find yields the version of a zone with the serial, if there is one.
+func (j *Journal) Find(zone string, serial uint32) *ZoneVersion {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	for _, version := range j.versions[zone] {
+		if version.Serial == serial {
+			return version
+		}
+	}
+
+	return nil
+}
+
+func changed(old, new []dns.RR) bool {
+	deleted, added := diff(old, new)
+	return len(deleted) != 0 || len(added) != 0
+}
+
+// diff yields the records removed from and added to a zone between versions.
+func diff(old, new []dns.RR) ([]dns.RR, []dns.RR) {
+	oldSet := map[string]struct{}{}
+	newSet := map[string]struct{}{}
+
+	for _, rr := range old {
+		oldSet[rr.String()] = struct{}{}
+	}
+
+	for _, rr := range new {
+		newSet[rr.String()] = struct{}{}
+	}
+
+	deleted := []dns.RR{}
+	added := []dns.RR{}
+
+	for _, rr := range old {
+		if _, ok := newSet[rr.String()]; !ok {
+			deleted = append(deleted, rr)
+		}
+	}
+
+	for _, rr := range new {
+		if _, ok := oldSet[rr.String()]; !ok {
+			added = append(added, rr)
+		}
+	}
+
+	return deleted, added
+}
+
+// generation finds the newest sum in the configuration chain.
+func (ds *DNSServer) generation() string {
+	if ds.Config == nil {
+		return ""
+	}
+
+	sums := ds.Config.Chain().AllSums()
+	if len(sums) == 0 {
+		return ""
+	}
+
+	return sums[len(sums)-1]
+}
+
+// ancestor reports whether a version was served from a configuration in the
+// history of the current one. If the chain has been replaced with one that
+// does not share that history, the version cannot be trusted as a base for
+// deltas.
+func (ds *DNSServer) ancestor(version *ZoneVersion) bool {
+	if ds.Config == nil || version.Generation == "" {
+		return true
+	}
+
+	for _, sum := range ds.Config.Chain().AllSums() {
+		if sum == version.Generation {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tsigSecrets collects the TSIG keys of all zones for the dns package, which
+// verifies and signs messages with them.
+func (ds *DNSServer) tsigSecrets() map[string]string {
+	secrets := map[string]string{}
+
+	for _, zone := range ds.Zones {
+		if zone.Transfer != nil {
+			for name, secret := range zone.Transfer.TSIG {
+				secrets[name] = secret
+			}
+		}
+
+		if zone.Update != nil {
+			for name, secret := range zone.Update.TSIG {
+				secrets[name] = secret
+			}
+		}
+	}
+
+	return secrets
+}
+
+// render yields every record of the zone, except for the SOA, the way a
+// secondary should serve them. Records that are computed at query time (LB,
+// ALIAS and auto reverse zones) are computed now.
+func (ds *DNSServer) render(apex string, zone *config.Zone) []dns.RR {
+	records := zone.NS.Convert(apex)
+
+	for _, rec := range zone.Records {
+		switch value := rec.Value.(type) {
+		case *dnsconfig.LB:
+			for _, ip := range ds.listenerIPs(value) {
+				records = append(records, addressRecord(rec.Name, ip, value.TTL))
+			}
+		case *dnsconfig.ALIAS:
+			for _, typ := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				answers, _, _, err := ds.resolve(zone, rec.Name, typ)
+				if err != nil {
+					logrus.Errorf("While resolving ALIAS %q for transfer: %v", rec.Name, err)
+					continue
+				}
+
+				records = append(records, answers...)
+			}
+		default:
+			records = append(records, rec.Value.Convert(rec.Name)...)
+		}
+	}
+
+	if zone.Auto {
+		seen := map[string]struct{}{}
+
+		for _, ip := range ds.forwardIPs() {
+			name, err := dns.ReverseAddr(ip.String())
+			if err != nil || ds.findZone(name) != zone {
+				continue
+			}
+
+			if _, ok := seen[name]; ok {
+				continue
+			}
+
+			seen[name] = struct{}{}
+			records = append(records, ds.reverse(zone, name)...)
+		}
+	}
+
+	// zones are a map, and so is the set of addresses above; keep transfers
+	// stable.
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].String() < records[j].String()
+	})
+
+	return records
+}
+
+// forwardIPs yields the addresses of every A, AAAA and LB record outside of
+// the auto reverse zones. Wildcards are left out, as reverse does.
+func (ds *DNSServer) forwardIPs() []net.IP {
+	ips := []net.IP{}
+
+	for _, zone := range ds.Zones {
+		if zone.Auto {
+			continue
+		}
+
+		for _, rec := range zone.Records {
+			if isWildcard(rec.Name) {
+				continue
+			}
+
+			switch value := rec.Value.(type) {
+			case *dnsconfig.A:
+				ips = append(ips, value.Addresses...)
+			case *dnsconfig.AAAA:
+				ips = append(ips, value.Addresses...)
+			case *dnsconfig.LB:
+				ips = append(ips, ds.listenerIPs(value)...)
+			}
+		}
+	}
+
+	return ips
+}
+
+func addressRecord(name string, ip net.IP, ttl uint32) dns.RR {
+	if ip.To4() != nil {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   ip,
+		}
+	}
+
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+		AAAA: ip,
+	}
+}
+
+// journalZones records the current version of every zone that can be
+// transferred.
+func (ds *DNSServer) journalZones() {
+	generation := ds.generation()
+
+	for apex, zone := range ds.Zones {
+		if zone.Transfer == nil {
+			continue
+		}
+
+		ds.Journal.Add(apex, &ZoneVersion{
+			Generation: generation,
+			Serial:     zone.SOA.Serial,
+			Records:    ds.render(apex, zone),
+		})
+	}
+}
+
+// transferAllowed checks the client against the allow-list and TSIG keys of
+// the zone. A signed request must be signed with one of the zone's keys; the
+// dns package has already verified the signature by the time we get here.
+func (ds *DNSServer) transferAllowed(w dns.ResponseWriter, r *dns.Msg, zone *config.Zone) bool {
+	if zone.Transfer == nil {
+		return false
+	}
+
+	if tsig := r.IsTsig(); tsig != nil {
+		if w.TsigStatus() != nil {
+			return false
+		}
+
+		_, ok := zone.Transfer.TSIG[tsig.Hdr.Name]
+		return ok
+	}
+
+	ip := remoteIP(w)
+	if ip == nil {
+		return false
+	}
+
+	return zone.Transfer.Allowed(ip)
+}
+
+// serveTransfer answers AXFR and IXFR queries. IXFR answers are condensed
+// into a single delta from the client's version, found in the journal, to
+// ours. If the client's version is unknown, e.g. as it was served before we
+// started, the whole zone is sent instead, which RFC 1995 allows. apex is the
+// name of the zone the query is in.
+func (ds *DNSServer) serveTransfer(w dns.ResponseWriter, r *dns.Msg, apex string, zone *config.Zone) {
+	name := r.Question[0].Name
+	typ := r.Question[0].Qtype
+
+	m := &dns.Msg{}
+	m.SetReply(r)
+
+	if ds.Zones[name] != zone {
+		m.SetRcode(r, dns.RcodeNotAuth)
+		ds.writeMsg(w, r, m, apex)
+		return
+	}
+
+	if !ds.transferAllowed(w, r, zone) {
+		logrus.Warnf("Refused transfer of %q to %v", name, w.RemoteAddr())
+		m.SetRcode(r, dns.RcodeRefused)
+		ds.writeMsg(w, r, m, apex)
+		return
+	}
+
+	soa := zone.SOA.Convert(name)[0]
+	udp := w.LocalAddr().Network() == "udp"
+
+	if typ == dns.TypeAXFR && udp {
+		m.SetRcode(r, dns.RcodeRefused)
+		ds.writeMsg(w, r, m, apex)
+		return
+	}
+
+	records := ds.render(name, zone)
+
+	var answers []dns.RR
+
+	if typ == dns.TypeIXFR {
+		var serial uint32
+
+		for _, rr := range r.Ns {
+			if client, ok := rr.(*dns.SOA); ok {
+				serial = client.Serial
+			}
+		}
+
+		switch version := ds.Journal.Find(name, serial); {
+		// over UDP, or if the client is up to date, just tell it our serial.
+		case udp || serial == zone.SOA.Serial:
+			answers = []dns.RR{soa}
+		case version != nil && ds.ancestor(version):
+			deleted, added := diff(version.Records, records)
+
+			old := dns.Copy(soa).(*dns.SOA)
+			old.Serial = version.Serial
+
+			answers = append(answers, soa, old)
+			answers = append(answers, deleted...)
+			answers = append(answers, soa)
+			answers = append(answers, added...)
+			answers = append(answers, soa)
+		}
+	}
+
+	if answers == nil {
+		answers = append(answers, soa)
+		answers = append(answers, records...)
+		answers = append(answers, soa)
+	}
+
+	logrus.Debugf("Transferring %d records of %q to %v", len(answers), name, w.RemoteAddr())
+
+	if udp {
+		m.Answer = answers
+		ds.sign(r, m)
+		ds.writeMsg(w, r, m, apex)
+		return
+	}
+
+	ch := make(chan *dns.Envelope)
+	tr := &dns.Transfer{}
+
+	go func() {
+		defer close(ch)
+
+		for len(answers) > TransferChunkSize {
+			ch <- &dns.Envelope{RR: answers[:TransferChunkSize]}
+			answers = answers[TransferChunkSize:]
+		}
+
+		ch <- &dns.Envelope{RR: answers}
+	}()
+
+	if err := tr.Out(w, r, ch); err != nil {
+		logrus.Errorf("While transferring %q to %v: %v", name, w.RemoteAddr(), err)
+
+		// drain the channel so the goroutine above can finish.
+		for range ch {
+		}
+	}
+
+	w.Close() // nolint:errcheck
+}
+
+// sign adds a TSIG record to the response if the request had one; the dns
+// package computes the signature when the message is written.
+func (ds *DNSServer) sign(r *dns.Msg, m *dns.Msg) {
+	if tsig := r.IsTsig(); tsig != nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+}
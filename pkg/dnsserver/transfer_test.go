@@ -0,0 +1,239 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+)
+
+const testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+
+func transfer(t *testing.T, ds *DNSServer, m *dns.Msg, secrets map[string]string) ([]dns.RR, error) {
+	tr := &dns.Transfer{TsigSecret: secrets}
+
+	ch, err := tr.In(m, ds.tcpServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []dns.RR{}
+
+	for envelope := range ch {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+
+		records = append(records, envelope.RR...)
+	}
+
+	return records, nil
+}
+
+func transferZones(transfer *config.Transfer) map[string]*config.Zone {
+	zones := makeZones()
+	zones["test.home.arpa."].Transfer = transfer
+	zones["test.home.arpa."].Records = []*config.Record{
+		{
+			Name: "foo.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("127.0.0.1")},
+				TTL:       60,
+			},
+		},
+	}
+
+	return zones
+}
+
+func TestAXFR(t *testing.T) {
+	table := map[string]struct {
+		transfer *config.Transfer
+		secrets  map[string]string
+		refused  bool
+	}{
+		"no transfer": {
+			refused: true,
+		},
+		"allowed ip": {
+			transfer: &config.Transfer{Allow: []string{"127.0.0.1"}},
+		},
+		"allowed network": {
+			transfer: &config.Transfer{Allow: []string{"127.0.0.0/8"}},
+		},
+		"other network": {
+			transfer: &config.Transfer{Allow: []string{"10.0.0.0/8"}},
+			refused:  true,
+		},
+		"tsig": {
+			transfer: &config.Transfer{TSIG: map[string]string{"xfr.": testTSIGSecret}},
+			secrets:  map[string]string{"xfr.": testTSIGSecret},
+		},
+	}
+
+	for testName, test := range table {
+		ds := startServer(t, transferZones(test.transfer))
+
+		m := &dns.Msg{}
+		m.SetAxfr("test.home.arpa.")
+
+		if test.secrets != nil {
+			m.SetTsig("xfr.", dns.HmacSHA256, 300, time.Now().Unix())
+		}
+
+		records, err := transfer(t, ds, m, test.secrets)
+		if test.refused {
+			if err == nil {
+				t.Fatalf("%q: transfer was not refused", testName)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%q: transfer failed: %v", testName, err)
+		}
+
+		// SOA, NS, A, SOA
+		if len(records) != 4 {
+			t.Fatalf("%q: unexpected number of records: %d: %v", testName, len(records), records)
+		}
+
+		if _, ok := records[0].(*dns.SOA); !ok {
+			t.Fatalf("%q: first record was not the SOA: %v", testName, records[0])
+		}
+
+		if _, ok := records[3].(*dns.SOA); !ok {
+			t.Fatalf("%q: last record was not the SOA: %v", testName, records[3])
+		}
+	}
+
+	// signed with a key we don't know
+	ds := startServer(t, transferZones(&config.Transfer{TSIG: map[string]string{"xfr.": testTSIGSecret}}))
+
+	m := &dns.Msg{}
+	m.SetAxfr("test.home.arpa.")
+	m.SetTsig("other.", dns.HmacSHA256, 300, time.Now().Unix())
+
+	if _, err := transfer(t, ds, m, map[string]string{"other.": testTSIGSecret}); err == nil {
+		t.Fatal("transfer signed with an unknown key was not refused")
+	}
+}
+
+func TestAXFRAutoReverse(t *testing.T) {
+	zones := transferZones(nil)
+	zones["test.home.arpa."].Records = append(zones["test.home.arpa."].Records, &config.Record{
+		Name: "*.apps.test.home.arpa.",
+		Type: dnsconfig.TypeA,
+		Value: &dnsconfig.A{
+			Addresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")},
+			TTL:       60,
+		},
+	})
+
+	zones["0.0.127.in-addr.arpa."] = &config.Zone{
+		SOA:      &dnsconfig.SOA{Domain: "0.0.127.in-addr.arpa.", Admin: "administrator.test.home.arpa.", MinTTL: 30},
+		NS:       &dnsconfig.NS{Servers: []string{"test.home.arpa."}, TTL: 30},
+		Records:  []*config.Record{},
+		Auto:     true,
+		Transfer: &config.Transfer{Allow: []string{"127.0.0.1"}},
+	}
+
+	ds := startServer(t, zones)
+
+	m := &dns.Msg{}
+	m.SetAxfr("0.0.127.in-addr.arpa.")
+
+	records, err := transfer(t, ds, m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptrs := []*dns.PTR{}
+
+	for _, rr := range records {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			ptrs = append(ptrs, ptr)
+		}
+	}
+
+	// only foo's address; the wildcard's own address has no PTR record.
+	if len(ptrs) != 1 || ptrs[0].Hdr.Name != "1.0.0.127.in-addr.arpa." || ptrs[0].Ptr != "foo.test.home.arpa." {
+		t.Fatalf("Unexpected PTR records in transfer: %v", records)
+	}
+}
+
+func TestIXFR(t *testing.T) {
+	zones := transferZones(&config.Transfer{Allow: []string{"127.0.0.1"}})
+	journal := &Journal{}
+
+	ds := &DNSServer{Zones: zones, Journal: journal}
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next generation of the zone, as a reload would deliver it.
+	zones = transferZones(&config.Transfer{Allow: []string{"127.0.0.1"}})
+	zones["test.home.arpa."].SOA.Serial = 2
+	zones["test.home.arpa."].Records[0].Value.(*dnsconfig.A).Addresses = []net.IP{net.ParseIP("127.0.0.2")}
+
+	ds = &DNSServer{Zones: zones, Journal: journal}
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	ixfr := func(serial uint32) []dns.RR {
+		m := &dns.Msg{}
+		m.SetIxfr("test.home.arpa.", serial, "test.home.arpa.", "administrator.test.home.arpa.")
+
+		records, err := transfer(t, ds, m, nil)
+		if err != nil {
+			t.Fatalf("IXFR from serial %d failed: %v", serial, err)
+		}
+
+		return records
+	}
+
+	records := ixfr(1)
+	expected := []string{"SOA/2", "SOA/1", "A/127.0.0.1", "SOA/2", "A/127.0.0.2", "SOA/2"}
+
+	if len(records) != len(expected) {
+		t.Fatalf("Unexpected number of records in delta: %v", records)
+	}
+
+	for i, rr := range records {
+		var got string
+
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			got = "SOA/" + dns.Field(rr, 3)
+		case *dns.A:
+			got = "A/" + rr.A.String()
+		}
+
+		if got != expected[i] {
+			t.Fatalf("Unexpected record %d in delta: %v (expected: %v)", i, rr, expected[i])
+		}
+	}
+
+	if records := ixfr(2); len(records) != 1 {
+		t.Fatalf("Up to date secondary received more than the SOA: %v", records)
+	}
+
+	// unknown serials get the whole zone
+	if records := ixfr(100); len(records) != 4 {
+		t.Fatalf("Unexpected number of records in full transfer: %v", records)
+	}
+}
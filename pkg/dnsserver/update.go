@@ -0,0 +1,91 @@
+package dnsserver
+
+import (
+	"github.com/erikh/border/pkg/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// UpdateFunc applies an RFC 2136 dynamic update, which has already been
+// authorized, yielding the response code for it. The error, if any, says why
+// the update failed.
+type UpdateFunc func(update *dns.Msg) (int, error)
+
+// acceptMsg lets dynamic updates through to ServeDNS. The dns package rejects
+// them by default, as they carry any number of records in every section but
+// the first.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	const response = 1 << 15
+
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && dh.Bits&response == 0 {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+
+		return dns.MsgAccept
+	}
+
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// updateAllowed checks that the update is signed with one of the zone's keys.
+// The dns package has already verified the signature by the time we get here.
+func (ds *DNSServer) updateAllowed(w dns.ResponseWriter, r *dns.Msg, zone *config.Zone) bool {
+	if zone.Update == nil {
+		return false
+	}
+
+	tsig := r.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		return false
+	}
+
+	_, ok := zone.Update.TSIG[tsig.Hdr.Name]
+	return ok
+}
+
+// serveUpdate answers dynamic updates, handing them to Update once the client
+// is known to be allowed to make them.
+func (ds *DNSServer) serveUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetReply(r)
+
+	name := r.Question[0].Name
+
+	apex := ds.findApex(name)
+
+	zone := ds.Zones[apex]
+	if zone == nil || apex != name {
+		m.SetRcode(r, dns.RcodeNotAuth)
+		ds.writeMsg(w, r, m, apex)
+		return
+	}
+
+	if ds.Update == nil || !ds.updateAllowed(w, r, zone) {
+		logrus.Warnf("Refused update of %q from %v", name, w.RemoteAddr())
+		m.SetRcode(r, dns.RcodeRefused)
+
+		// a signature we could not verify cannot be answered with one.
+		if w.TsigStatus() == nil {
+			ds.sign(r, m)
+		}
+
+		ds.writeMsg(w, r, m, apex)
+		return
+	}
+
+	// the signature is ours to check, not the publisher's.
+	update := r.Copy()
+	if update.IsTsig() != nil {
+		update.Extra = update.Extra[:len(update.Extra)-1]
+	}
+
+	rcode, err := ds.Update(update)
+	if err != nil {
+		logrus.Warnf("Update of %q from %v failed: %v", name, w.RemoteAddr(), err)
+	}
+
+	m.SetRcode(r, rcode)
+	ds.sign(r, m)
+	ds.writeMsg(w, r, m, apex)
+}
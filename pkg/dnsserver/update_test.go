@@ -0,0 +1,96 @@
+package dnsserver
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/miekg/dns"
+)
+
+func TestUpdate(t *testing.T) {
+	var (
+		updates []*dns.Msg
+		mutex   sync.Mutex
+	)
+
+	zones := makeZones()
+	zones["test.home.arpa."].Update = &config.Update{TSIG: map[string]string{"update.": testTSIGSecret}}
+
+	ds := &DNSServer{
+		Zones: zones,
+		Update: func(update *dns.Msg) (int, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			updates = append(updates, update)
+			return dns.RcodeSuccess, nil
+		},
+	}
+
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	secrets := map[string]string{"update.": testTSIGSecret, "other.": testTSIGSecret}
+
+	send := func(zone, key string) *dns.Msg {
+		m := &dns.Msg{}
+		m.SetUpdate(zone)
+		m.Insert([]dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "foo." + zone, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("127.0.0.1"),
+		}})
+
+		if key != "" {
+			m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+
+		client := &dns.Client{Net: "tcp", Timeout: time.Second, TsigSecret: secrets}
+
+		r, _, err := client.Exchange(m, ds.tcpServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Update of %q signed with %q failed: %v", zone, key, err)
+		}
+
+		return r
+	}
+
+	if r := send("test.home.arpa.", ""); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("Unsigned update was not refused: %v", r)
+	}
+
+	if r := send("test.home.arpa.", "other."); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("Update signed with another key was not refused: %v", r)
+	}
+
+	if r := send("foo.test.home.arpa.", "update."); r.Rcode != dns.RcodeNotAuth {
+		t.Fatalf("Update of a name that is not a zone was not refused: %v", r)
+	}
+
+	r := send("test.home.arpa.", "update.")
+	if r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Signed update failed: %v", r)
+	}
+
+	if r.IsTsig() == nil {
+		t.Fatalf("Response to a signed update was not signed: %v", r)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(updates) != 1 {
+		t.Fatalf("Unexpected number of updates applied: %d", len(updates))
+	}
+
+	if updates[0].IsTsig() != nil || len(updates[0].Ns) != 1 {
+		t.Fatalf("Update was not passed on without its signature: %v", updates[0])
+	}
+}
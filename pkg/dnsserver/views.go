@@ -0,0 +1,104 @@
+package dnsserver
+
+import (
+	"sort"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/miekg/dns"
+)
+
+// view answers the queries of clients of a split-horizon view. Its server only
+// holds the zones as the view sees them, and is never started.
+type view struct {
+	config *config.View
+	server *DNSServer
+}
+
+// buildViews prepares the views. Records are shared with the zones they came
+// from, so health checks pruning them are seen by the views as well.
+func (ds *DNSServer) buildViews() {
+	names := []string{}
+	for name := range ds.Views {
+		names = append(names, name)
+	}
+
+	// views matching equally well are picked by name, instead of at random.
+	sort.Strings(names)
+
+	ds.views = []*view{}
+
+	for _, name := range names {
+		ds.views = append(ds.views, &view{
+			config: ds.Views[name],
+			server: &DNSServer{Zones: ds.Views[name].Apply(ds.Zones), Config: ds.Config},
+		})
+	}
+}
+
+// clientSubnet yields the EDNS Client Subnet option of the query, if it has a
+// usable one.
+func clientSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, option := range opt.Option {
+		if ecs, ok := option.(*dns.EDNS0_SUBNET); ok && ecs.SourceNetmask != 0 {
+			return ecs
+		}
+	}
+
+	return nil
+}
+
+// viewFor finds the server to answer the query with: that of the view most
+// specific to the client, or ds if no view is for it. If the EDNS Client
+// Subnet option of the query was consulted, the option to return in the
+// response is yielded too.
+func (ds *DNSServer) viewFor(w dns.ResponseWriter, r *dns.Msg) (*DNSServer, *dns.EDNS0_SUBNET) {
+	if len(ds.views) == 0 {
+		return ds, nil
+	}
+
+	var (
+		server = ds
+		best   = -1
+		used   bool
+	)
+
+	ip := remoteIP(w)
+	ecs := clientSubnet(r)
+
+	for _, v := range ds.views {
+		addr := ip
+
+		if v.config.ClientSubnet && ecs != nil {
+			addr = ecs.Address
+			used = true
+		}
+
+		if addr == nil {
+			continue
+		}
+
+		if match := v.config.Match(addr); match > best {
+			server = v.server
+			best = match
+		}
+	}
+
+	if !used {
+		return server, nil
+	}
+
+	// RFC 7871 asks for the option back, with the scope of the answer. Views
+	// are not known to be any more specific than what the client sent.
+	return server, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ecs.Family,
+		SourceNetmask: ecs.SourceNetmask,
+		SourceScope:   ecs.SourceNetmask,
+		Address:       ecs.Address,
+	}
+}
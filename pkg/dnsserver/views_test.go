@@ -0,0 +1,160 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/miekg/dns"
+)
+
+func makeViewRecord(address string) *config.Record {
+	return &config.Record{
+		Name: "foo.test.home.arpa.",
+		Type: dnsconfig.TypeA,
+		Value: &dnsconfig.A{
+			Addresses: []net.IP{net.ParseIP(address)},
+			TTL:       60,
+		},
+	}
+}
+
+func makeView(address string, client bool, networks ...string) *config.View {
+	return &config.View{
+		Networks:     networks,
+		ClientSubnet: client,
+		Zones: map[string]*config.ViewZone{
+			"test.home.arpa.": {Records: []*config.Record{makeViewRecord(address)}},
+		},
+	}
+}
+
+func startViewServer(t *testing.T, views map[string]*config.View) *DNSServer {
+	zones := makeZones()
+	zones["test.home.arpa."].Records = []*config.Record{
+		makeViewRecord("192.0.2.1"),
+		{
+			Name: "bar.test.home.arpa.",
+			Type: dnsconfig.TypeA,
+			Value: &dnsconfig.A{
+				Addresses: []net.IP{net.ParseIP("192.0.2.2")},
+				TTL:       60,
+			},
+		},
+	}
+
+	ds := &DNSServer{Zones: zones, Views: views}
+
+	if err := ds.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ds.Shutdown() // nolint:errcheck
+	})
+
+	return ds
+}
+
+func querySubnet(t *testing.T, ds *DNSServer, name string, subnet string) *dns.Msg {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ones, _ := ipnet.Mask.Size()
+
+	m := &dns.Msg{}
+	m.SetQuestion(name, dns.TypeA)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(ones),
+		Address:       ipnet.IP,
+	})
+
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	r, _, err := client.Exchange(m, ds.udpServer.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error querying %q from %s: %v", name, subnet, err)
+	}
+
+	return r
+}
+
+func answerA(r *dns.Msg) string {
+	if len(r.Answer) != 1 {
+		return ""
+	}
+
+	a, ok := r.Answer[0].(*dns.A)
+	if !ok {
+		return ""
+	}
+
+	return a.A.String()
+}
+
+func TestViews(t *testing.T) {
+	// the most specific view wins.
+	ds := startViewServer(t, map[string]*config.View{
+		"lan":      makeView("10.0.0.1", false, "127.0.0.0/8"),
+		"host":     makeView("10.0.0.2", false, "127.0.0.1"),
+		"internal": makeView("10.0.0.3", true, "10.0.0.0/8"),
+	})
+
+	if ip := answerA(query(t, ds, "foo.test.home.arpa.", dns.TypeA)); ip != "10.0.0.2" {
+		t.Fatalf("Most specific view was not used: %q", ip)
+	}
+
+	// records the view does not override are answered from the zone.
+	if ip := answerA(query(t, ds, "bar.test.home.arpa.", dns.TypeA)); ip != "192.0.2.2" {
+		t.Fatalf("Zone record was not answered in the view: %q", ip)
+	}
+
+	if r := query(t, ds, "test.home.arpa.", dns.TypeSOA); !r.Authoritative || len(r.Answer) != 1 {
+		t.Fatalf("Unexpected SOA response in the view: %v", r)
+	}
+
+	// clients outside of every view get the zone.
+	ds = startViewServer(t, map[string]*config.View{
+		"internal": makeView("10.0.0.3", true, "10.0.0.0/8"),
+	})
+
+	r := query(t, ds, "foo.test.home.arpa.", dns.TypeA)
+	if ip := answerA(r); ip != "192.0.2.1" {
+		t.Fatalf("Client outside of the views was answered with %q", ip)
+	}
+
+	if opt := r.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if _, ok := option.(*dns.EDNS0_SUBNET); ok {
+				t.Fatalf("Client subnet was returned without being sent: %v", r)
+			}
+		}
+	}
+
+	// views taking the client subnet match on it.
+	for subnet, expected := range map[string]string{
+		"10.1.2.0/24":  "10.0.0.3",
+		"192.0.2.0/24": "192.0.2.1",
+	} {
+		r := querySubnet(t, ds, "foo.test.home.arpa.", subnet)
+		if ip := answerA(r); ip != expected {
+			t.Fatalf("Client subnet %s was answered with %q", subnet, ip)
+		}
+
+		opt := r.IsEdns0()
+		if opt == nil || len(opt.Option) != 1 {
+			t.Fatalf("Client subnet was not returned for %s: %v", subnet, r)
+		}
+
+		ecs, ok := opt.Option[0].(*dns.EDNS0_SUBNET)
+		if !ok || ecs.SourceScope != 24 || ecs.SourceNetmask != 24 {
+			t.Fatalf("Unexpected client subnet returned for %s: %v", subnet, opt)
+		}
+	}
+}
@@ -15,7 +15,7 @@ import (
 const (
 	TypePing = "ping"
 	TypeHTTP = "http"
-	// FIXME add tcp type
+	TypeTCP  = "tcp"
 )
 
 type HealthCheck struct {
@@ -100,6 +100,13 @@ func (hc *HealthCheckAction) runCheck() error {
 		if resp.StatusCode != http.StatusOK {
 			return fmt.Errorf("Status was not OK (was: %d) on HTTP healthcheck %q for target %q", resp.StatusCode, hc.Check.Name, hc.Check.target)
 		}
+	case TypeTCP:
+		conn, err := net.DialTimeout("tcp", hc.Check.target, hc.Check.Timeout)
+		if err != nil {
+			return fmt.Errorf("Failed to connect to %q over TCP (check: %q): %v", hc.Check.target, hc.Check.Name, err)
+		}
+
+		conn.Close()
 	default:
 		return fmt.Errorf("Invalid health check type %q (check: %q): please adjust your configuration", hc.Check.Type, hc.Check.Name)
 	}
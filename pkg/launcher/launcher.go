@@ -3,11 +3,13 @@ package launcher
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/erikh/border/pkg/api"
@@ -25,11 +27,15 @@ import (
 
 type Server struct {
 	control       *controlserver.Server
-	dns           dnsserver.DNSServer // FIXME make pointer
+	dns           *dnsserver.DNSServer
 	balancers     []*lb.Balancer
 	healthChecker *healthcheck.HealthChecker
 	config        *config.Config
 	peerName      string
+	// the journal outlives the server across reloads, so IXFR has history.
+	journal *dnsserver.Journal
+	// so do the counters of response rate limiting.
+	rrlStats *dnsserver.RRLStats
 }
 
 func (s *Server) Launch(peerName string, c *config.Config) error {
@@ -49,8 +55,36 @@ func (s *Server) Launch(peerName string, c *config.Config) error {
 		return fmt.Errorf("Error while starting control server: %w", err)
 	}
 
-	dnsserver := dnsserver.DNSServer{
-		Zones: c.Zones,
+	if s.journal == nil {
+		s.journal = &dnsserver.Journal{}
+	}
+
+	if s.rrlStats == nil {
+		s.rrlStats = &dnsserver.RRLStats{}
+	}
+
+	cs.SetRRLStats(s.rrlStats)
+
+	dnsserver := &dnsserver.DNSServer{
+		Zones:    c.Zones,
+		Config:   c,
+		Journal:  s.journal,
+		RRL:      c.RRL,
+		RRLStats: s.rrlStats,
+		Forward:  c.Forward,
+		Update:   cs.SendUpdate,
+		Views:    c.Views,
+	}
+
+	if c.Listen.TLS != nil {
+		cert, err := c.Listen.TLS.KeyPair()
+		if err != nil {
+			return fmt.Errorf("Could not load TLS certificate for DNS: %w", err)
+		}
+
+		dnsserver.DoT = c.Listen.DoT
+		dnsserver.DoH = c.Listen.DoH
+		dnsserver.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
 	}
 
 	if err := dnsserver.Start(c.Listen.DNS); err != nil {
@@ -145,8 +179,9 @@ func (s *Server) monitorConfig() {
 		}
 
 		if chainSum != publisherSum {
-			// ensure our chain is an ancestor of the publisher
-			if _, err := publisherChain.LastMatch(s.config.Chain()); err != nil {
+			// ensure our chain is an ancestor of the publisher. A peer with no
+			// history yet has nothing to diverge from.
+			if _, err := publisherChain.LastMatch(s.config.Chain()); err != nil && len(s.config.Chain().AllSums()) != 0 {
 				logrus.Errorf("Publisher %q's configuration never had our configuration as an ancestor: %v", publisher.Name(), err)
 				continue // FIXME not sure what to do here really
 			}
@@ -190,7 +225,7 @@ retry:
 
 	logrus.Infoln("New configuration received; reloading services")
 
-	s2 := &Server{}
+	s2 := &Server{journal: s.journal, rrlStats: s.rrlStats}
 
 	if err := s2.Launch(s.peerName, s.config); err != nil {
 		logrus.Errorf("Error launching server after reload: %v", err)
@@ -200,53 +235,51 @@ retry:
 func (s *Server) createBalancers(peerName string, c *config.Config) ([]*lb.Balancer, error) {
 	balancers := []*lb.Balancer{}
 
-	for _, zone := range c.Zones {
-		for _, rec := range zone.Records {
-			if rec.Type == dnsconfig.TypeLB {
-				lbRecord, ok := rec.Value.(*dnsconfig.LB)
-				if !ok {
-					return nil, fmt.Errorf("LB record for %q was not parsed correctly", rec.Name)
+	for _, rec := range c.Records() {
+		if rec.Type == dnsconfig.TypeLB {
+			lbRecord, ok := rec.Value.(*dnsconfig.LB)
+			if !ok {
+				return nil, fmt.Errorf("LB record for %q was not parsed correctly", rec.Name)
+			}
+
+			var tls *lb.TLSBalancerConfig
+
+			if lbRecord.TLS != nil {
+				tls = &lb.TLSBalancerConfig{
+					CACertificate: lbRecord.TLS.CACertificate,
+					Certificate:   lbRecord.TLS.Certificate,
+					Key:           lbRecord.TLS.Key,
 				}
+			}
 
-				var tls *lb.TLSBalancerConfig
+			// work with the IP addresses directly.
+			for _, listener := range lbRecord.Listeners {
+				host, port, err := net.SplitHostPort(listener)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid listener %q: could not parse: %v", listener, err)
+				}
 
-				if lbRecord.TLS != nil {
-					tls = &lb.TLSBalancerConfig{
-						CACertificate: lbRecord.TLS.CACertificate,
-						Certificate:   lbRecord.TLS.Certificate,
-						Key:           lbRecord.TLS.Key,
-					}
+				peer, err := c.FindPeer(host)
+				if err != nil {
+					return nil, fmt.Errorf("Host %q is not a peer: %w", host, err)
 				}
 
-				// work with the IP addresses directly.
-				for _, listener := range lbRecord.Listeners {
-					host, port, err := net.SplitHostPort(listener)
-					if err != nil {
-						return nil, fmt.Errorf("Invalid listener %q: could not parse: %v", listener, err)
+				for _, ip := range peer.IPs {
+					bc := lb.BalancerConfig{
+						Kind:                     lbRecord.Kind,
+						Backends:                 lbRecord.Backends,
+						SimultaneousConnections:  lbRecord.SimultaneousConnections,
+						MaxConnectionsPerAddress: lbRecord.MaxConnectionsPerAddress,
+						ConnectionTimeout:        lbRecord.ConnectionTimeout,
+						TLS:                      tls,
 					}
 
-					peer, err := c.FindPeer(host)
-					if err != nil {
-						return nil, fmt.Errorf("Host %q is not a peer: %w", host, err)
+					balancer := lb.Init(net.JoinHostPort(ip.String(), port), bc)
+					if err := balancer.Start(); err != nil {
+						return nil, fmt.Errorf("Could not start balancer %q: %v", rec.Name, err)
 					}
 
-					for _, ip := range peer.IPs {
-						bc := lb.BalancerConfig{
-							Kind:                     lbRecord.Kind,
-							Backends:                 lbRecord.Backends,
-							SimultaneousConnections:  lbRecord.SimultaneousConnections,
-							MaxConnectionsPerAddress: lbRecord.MaxConnectionsPerAddress,
-							ConnectionTimeout:        lbRecord.ConnectionTimeout,
-							TLS:                      tls,
-						}
-
-						balancer := lb.Init(net.JoinHostPort(ip.String(), port), bc)
-						if err := balancer.Start(); err != nil {
-							return nil, fmt.Errorf("Could not start balancer %q: %v", rec.Name, err)
-						}
-
-						balancers = append(balancers, balancer)
-					}
+					balancers = append(balancers, balancer)
 				}
 			}
 		}
@@ -264,6 +297,15 @@ func (s *Server) holdElection() error {
 
 	logrus.Infof("Electing %q as new leader", peer.Name())
 	s.config.SetPublisher(peer)
+
+	// the publisher makes the DNSSEC keys, and the other peers get them with
+	// its configuration.
+	if peer.Name() == s.peerName {
+		if err := s.control.GenerateDNSSECKeys(); err != nil {
+			return fmt.Errorf("Could not generate DNSSEC keys: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -312,61 +354,75 @@ func (s *Server) buildHealthChecks(c *config.Config) (*healthcheck.HealthChecker
 		})
 	}
 
-	for _, zone := range c.Zones {
-		for _, rec := range zone.Records {
-			switch rec.Type {
-			case dnsconfig.TypeA:
-				aRecord := rec.Value.(*dnsconfig.A)
-
-				for _, check := range aRecord.HealthCheck {
-					for _, ip := range aRecord.Addresses {
-						newCheck := check.Copy()
+	for _, rec := range c.Records() {
+		switch rec.Type {
+		case dnsconfig.TypeA:
+			aRecord := rec.Value.(*dnsconfig.A)
+			checks = append(checks, addressHealthChecks(rec.Name, "A", &aRecord.Addresses, aRecord.HealthCheck)...)
+		case dnsconfig.TypeAAAA:
+			aaaaRecord := rec.Value.(*dnsconfig.AAAA)
+			checks = append(checks, addressHealthChecks(rec.Name, "AAAA", &aaaaRecord.Addresses, aaaaRecord.HealthCheck)...)
+		case dnsconfig.TypeSRV:
+			checks = append(checks, srvHealthChecks(rec.Name, rec.Value.(*dnsconfig.SRV))...)
+		case dnsconfig.TypeLB:
+			lbRecord := rec.Value.(*dnsconfig.LB)
+
+			for _, check := range lbRecord.HealthCheck {
+				for _, backend := range lbRecord.Backends {
+					newCheck := check.Copy()
+
+					host, _, err := net.SplitHostPort(backend)
+					if err != nil {
+						return nil, fmt.Errorf("While computing healthcheck records for load balancer backend %q: %w", backend, err)
+					}
 
-						newCheck.SetTarget(ip.String())
+					if newCheck.Name == "" {
+						newCheck.Name = rec.Name
+					}
 
-						if newCheck.Name == "" {
-							newCheck.Name = rec.Name
-						}
+					if newCheck.Type == "" {
+						newCheck.Type = healthcheck.TypePing
+					}
 
-						if newCheck.Type == "" {
-							newCheck.Type = healthcheck.TypePing
-						}
+					newCheck.SetTarget(host)
 
-						checks = append(checks, &healthcheck.HealthCheckAction{
-							Check: newCheck,
-							FailedAction: func(check *healthcheck.HealthCheck) error {
-								logrus.Errorf("Health Check for %q (name: %q) failed: pruning A record", newCheck.Target(), newCheck.Name)
-								ips := []net.IP{}
+					checks = append(checks, &healthcheck.HealthCheckAction{
+						Check: newCheck,
+						FailedAction: func(check *healthcheck.HealthCheck) error {
+							logrus.Errorf("Health Check for %q (name: %q) failed: pruning LB backend record", newCheck.Target(), newCheck.Name)
+							backends := []string{}
 
-								for _, ip := range aRecord.Addresses {
-									if ip.String() != check.Target() {
-										ips = append(ips, ip)
-									}
+							for _, be := range lbRecord.Backends {
+								if be != backend {
+									backends = append(backends, be)
 								}
+							}
 
-								aRecord.Addresses = ips
-								return nil
-							},
-							ReviveAction: func(check *healthcheck.HealthCheck) error {
-								logrus.Infof("Health Check for %q (name: %q) revived: adjusting A record", newCheck.Target(), newCheck.Name)
+							lbRecord.Backends = backends
+							return nil
+						},
+						ReviveAction: func(check *healthcheck.HealthCheck) error {
+							logrus.Infof("Health Check for %q (name: %q) revived: adjusting LB record", newCheck.Target(), newCheck.Name)
 
-								aRecord.Addresses = append(aRecord.Addresses, net.ParseIP(check.Target()))
-								return nil
-							},
-						})
-					}
+							lbRecord.Backends = append(lbRecord.Backends, backend)
+							return nil
+						},
+					})
 				}
-			case dnsconfig.TypeLB:
-				lbRecord := rec.Value.(*dnsconfig.LB)
 
-				for _, check := range lbRecord.HealthCheck {
-					for _, backend := range lbRecord.Backends {
-						newCheck := check.Copy()
+				for _, listener := range lbRecord.Listeners {
+					host, _, err := net.SplitHostPort(listener)
+					if err != nil {
+						return nil, fmt.Errorf("While computing healthcheck records for load balancer listener %q: %w", listener, err)
+					}
 
-						host, _, err := net.SplitHostPort(backend)
-						if err != nil {
-							return nil, fmt.Errorf("While computing healthcheck records for load balancer backend %q: %w", backend, err)
-						}
+					peer, err := s.config.FindPeer(host)
+					if err != nil {
+						return nil, fmt.Errorf("Could not locate IPs for peer %q: %w", peer.Name(), err)
+					}
+
+					for _, ip := range peer.IPs {
+						newCheck := check.Copy()
 
 						if newCheck.Name == "" {
 							newCheck.Name = rec.Name
@@ -376,84 +432,151 @@ func (s *Server) buildHealthChecks(c *config.Config) (*healthcheck.HealthChecker
 							newCheck.Type = healthcheck.TypePing
 						}
 
-						newCheck.SetTarget(host)
+						newCheck.SetTarget(ip.String())
 
 						checks = append(checks, &healthcheck.HealthCheckAction{
 							Check: newCheck,
 							FailedAction: func(check *healthcheck.HealthCheck) error {
 								logrus.Errorf("Health Check for %q (name: %q) failed: pruning LB backend record", newCheck.Target(), newCheck.Name)
-								backends := []string{}
+								listeners := []string{}
 
-								for _, be := range lbRecord.Backends {
-									if be != backend {
-										backends = append(backends, be)
+								for _, lis := range lbRecord.Listeners {
+									if lis != listener {
+										listeners = append(listeners, lis)
 									}
 								}
 
-								lbRecord.Backends = backends
+								lbRecord.Listeners = listeners
 								return nil
 							},
 							ReviveAction: func(check *healthcheck.HealthCheck) error {
 								logrus.Infof("Health Check for %q (name: %q) revived: adjusting LB record", newCheck.Target(), newCheck.Name)
 
-								lbRecord.Backends = append(lbRecord.Backends, backend)
+								lbRecord.Listeners = append(lbRecord.Listeners, listener)
 								return nil
 							},
 						})
 					}
+				}
+			}
+		}
+	}
 
-					for _, listener := range lbRecord.Listeners {
-						host, _, err := net.SplitHostPort(listener)
-						if err != nil {
-							return nil, fmt.Errorf("While computing healthcheck records for load balancer listener %q: %w", listener, err)
-						}
+	return healthcheck.Init(checks, time.Second), nil
+}
 
-						peer, err := s.config.FindPeer(host)
-						if err != nil {
-							return nil, fmt.Errorf("Could not locate IPs for peer %q: %w", peer.Name(), err)
+// addressHealthChecks builds the checks for address records (A and AAAA). The
+// addresses are passed by reference so that failed targets can be pruned from
+// the record, and revived targets re-added.
+func addressHealthChecks(name, kind string, addresses *[]net.IP, healthChecks []*healthcheck.HealthCheck) []*healthcheck.HealthCheckAction {
+	checks := []*healthcheck.HealthCheckAction{}
+
+	for _, check := range healthChecks {
+		for _, ip := range *addresses {
+			newCheck := check.Copy()
+
+			newCheck.SetTarget(ip.String())
+
+			if newCheck.Name == "" {
+				newCheck.Name = name
+			}
+
+			if newCheck.Type == "" {
+				newCheck.Type = healthcheck.TypePing
+			}
+
+			checks = append(checks, &healthcheck.HealthCheckAction{
+				Check: newCheck,
+				FailedAction: func(check *healthcheck.HealthCheck) error {
+					logrus.Errorf("Health Check for %q (name: %q) failed: pruning %s record", newCheck.Target(), newCheck.Name, kind)
+					ips := []net.IP{}
+
+					for _, ip := range *addresses {
+						if ip.String() != check.Target() {
+							ips = append(ips, ip)
 						}
+					}
 
-						for _, ip := range peer.IPs {
-							newCheck := check.Copy()
+					*addresses = ips
+					return nil
+				},
+				ReviveAction: func(check *healthcheck.HealthCheck) error {
+					logrus.Infof("Health Check for %q (name: %q) revived: adjusting %s record", newCheck.Target(), newCheck.Name, kind)
 
-							if newCheck.Name == "" {
-								newCheck.Name = rec.Name
-							}
+					*addresses = append(*addresses, net.ParseIP(check.Target()))
+					return nil
+				},
+			})
+		}
+	}
 
-							if newCheck.Type == "" {
-								newCheck.Type = healthcheck.TypePing
-							}
+	return checks
+}
 
-							newCheck.SetTarget(ip.String())
+// srvHealthChecks builds the checks for the targets of a SRV record. Since
+// the target and port are known, these default to TCP checks against the
+// service itself. Failed targets are pruned from the record, and re-added when
+// they revive.
+func srvHealthChecks(name string, srvRecord *dnsconfig.SRV) []*healthcheck.HealthCheckAction {
+	checks := []*healthcheck.HealthCheckAction{}
 
-							checks = append(checks, &healthcheck.HealthCheckAction{
-								Check: newCheck,
-								FailedAction: func(check *healthcheck.HealthCheck) error {
-									logrus.Errorf("Health Check for %q (name: %q) failed: pruning LB backend record", newCheck.Target(), newCheck.Name)
-									listeners := []string{}
+	for _, target := range srvRecord.Targets {
+		target := target // golang, for loops shouldn't work that way
 
-									for _, lis := range lbRecord.Listeners {
-										if lis != listener {
-											listeners = append(listeners, lis)
-										}
-									}
+		for _, check := range target.HealthCheck {
+			newCheck := check.Copy()
 
-									lbRecord.Listeners = listeners
-									return nil
-								},
-								ReviveAction: func(check *healthcheck.HealthCheck) error {
-									logrus.Infof("Health Check for %q (name: %q) revived: adjusting LB record", newCheck.Target(), newCheck.Name)
+			if newCheck.Name == "" {
+				newCheck.Name = name
+			}
+
+			if newCheck.Type == "" {
+				newCheck.Type = healthcheck.TypeTCP
+			}
 
-									lbRecord.Listeners = append(lbRecord.Listeners, listener)
-									return nil
-								},
-							})
+			host := strings.TrimSuffix(target.Target, ".")
+			hostPort := net.JoinHostPort(host, fmt.Sprintf("%d", target.Port))
+
+			switch newCheck.Type {
+			case healthcheck.TypeTCP:
+				newCheck.SetTarget(hostPort)
+			case healthcheck.TypeHTTP:
+				newCheck.SetTarget(fmt.Sprintf("http://%s/", hostPort))
+			default:
+				newCheck.SetTarget(host)
+			}
+
+			checks = append(checks, &healthcheck.HealthCheckAction{
+				Check: newCheck,
+				FailedAction: func(check *healthcheck.HealthCheck) error {
+					logrus.Errorf("Health Check for %q (name: %q) failed: pruning SRV target", newCheck.Target(), newCheck.Name)
+					targets := []*dnsconfig.SRVTarget{}
+
+					for _, t := range srvRecord.Targets {
+						if t != target {
+							targets = append(targets, t)
 						}
 					}
-				}
-			}
+
+					srvRecord.Targets = targets
+					return nil
+				},
+				ReviveAction: func(check *healthcheck.HealthCheck) error {
+					logrus.Infof("Health Check for %q (name: %q) revived: adjusting SRV record", newCheck.Target(), newCheck.Name)
+
+					// a target with several checks may already have been revived by another.
+					for _, t := range srvRecord.Targets {
+						if t == target {
+							return nil
+						}
+					}
+
+					srvRecord.Targets = append(srvRecord.Targets, target)
+					return nil
+				},
+			})
 		}
 	}
 
-	return healthcheck.Init(checks, time.Second), nil
+	return checks
 }
@@ -0,0 +1,126 @@
+package launcher
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/erikh/border/pkg/config"
+	"github.com/erikh/border/pkg/dnsconfig"
+	"github.com/erikh/border/pkg/josekit"
+	"github.com/erikh/go-hashchain"
+)
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return port
+}
+
+func lbRecord(listener string) *config.Record {
+	return &config.Record{
+		Type: dnsconfig.TypeLB,
+		Name: "balancer.test.home.arpa",
+		LiteralValue: map[string]any{
+			"listeners":   []string{listener},
+			"kind":        "tcp",
+			"backends":    []string{"127.0.0.1:1"},
+			"healthcheck": []map[string]any{{"failures": 3, "timeout": "1s"}},
+		},
+	}
+}
+
+// loadConfig saves a configuration whose zone and view both have an LB record
+// for the same name, and loads it the way the service would.
+func loadConfig(t *testing.T, zoneListener, viewListener string) (*config.Config, error) {
+	jwk, err := josekit.MakeKey("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+
+	c := config.New(hashchain.New(nil))
+	c.FilenamePrefix = filepath.Join(dir, "config")
+	c.AuthKey = jwk
+	c.Peers = []*config.Peer{{Key: jwk, IPs: []net.IP{net.ParseIP("127.0.0.1")}}}
+	c.Zones = map[string]*config.Zone{
+		"test.home.arpa": {
+			SOA:     &dnsconfig.SOA{Domain: "test.home.arpa", Admin: "administrator.test.home.arpa", MinTTL: 60, Serial: 1},
+			NS:      &dnsconfig.NS{Servers: []string{"test.home.arpa"}},
+			Records: []*config.Record{lbRecord(zoneListener)},
+		},
+	}
+	c.Views = map[string]*config.View{
+		"internal": {
+			Networks: []string{"10.0.0.0/8"},
+			Zones:    map[string]*config.ViewZone{"test.home.arpa": {Records: []*config.Record{lbRecord(viewListener)}}},
+		},
+	}
+
+	filename := filepath.Join(dir, "config.yaml")
+
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SaveYAML(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	return c.FromDisk(filename, config.LoadYAML)
+}
+
+func TestViewBalancers(t *testing.T) {
+	zonePort, viewPort := freePort(t), freePort(t)
+
+	// a view's LB record replaces the zone's for its clients, but a listener
+	// can only have one balancer.
+	if _, err := loadConfig(t, "peer:"+zonePort, "peer:"+zonePort); err == nil {
+		t.Fatal("View LB record sharing a listener with the zone was accepted")
+	}
+
+	c, err := loadConfig(t, "peer:"+zonePort, "peer:"+viewPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{config: c}
+
+	balancers, err := s.createBalancers("peer", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		for _, balancer := range balancers {
+			balancer.Shutdown()
+		}
+	})
+
+	if len(balancers) != 2 {
+		t.Fatalf("Expected a balancer for each listener, got %d", len(balancers))
+	}
+
+	checker, err := s.buildHealthChecks(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer, then a check of the backend and the listener for each record.
+	if len(checker.HealthChecks) != 5 {
+		t.Fatalf("Unexpected number of health checks: %d", len(checker.HealthChecks))
+	}
+}